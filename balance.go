@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Lobbies up to this size are balanced by trying every possible split;
+// larger ones fall back to simulated annealing
+const exhaustiveBalanceLimit = 12
+
+// Annealing schedule for large lobbies
+const (
+	annealIterations = 20000
+	annealStartTemp  = 0.05
+	annealEndTemp    = 0.0001
+)
+
+// TeamSplit is a division of players into two teams with its predicted outcome
+type TeamSplit struct {
+	Team1 *Team
+	Team2 *Team
+	// Team1WinChance is the predicted chance that team 1 wins
+	Team1WinChance float64
+	// RepeatedPairs counts teammates who also played together in the
+	// previous game, -1 when there is no previous game to compare with
+	RepeatedPairs int
+}
+
+// Team2WinChance is the predicted chance that team 2 wins
+func (s *TeamSplit) Team2WinChance() float64 {
+	return 1 - s.Team1WinChance
+}
+
+// Gap is how far the predicted result is from an even game
+func (s *TeamSplit) Gap() float64 {
+	return math.Abs(s.Team1WinChance - 0.5)
+}
+
+// swapped returns the same split with the sides exchanged
+func (s *TeamSplit) swapped() *TeamSplit {
+	team1 := &Team{Name: "Team 1", Players: s.Team2.Players}
+	team2 := &Team{Name: "Team 2", Players: s.Team1.Players}
+	return &TeamSplit{Team1: team1, Team2: team2, Team1WinChance: s.Team2WinChance(), RepeatedPairs: s.RepeatedPairs}
+}
+
+// countRepeatedPairs counts the teammates of the split that were also
+// teammates in a previous game
+func countRepeatedPairs(split *TeamSplit, previous [2][]string) int {
+	previousTeam := make(map[string]int)
+	for team, playerIDs := range previous {
+		for _, playerID := range playerIDs {
+			previousTeam[playerID] = team + 1
+		}
+	}
+
+	count := 0
+	for _, team := range []*Team{split.Team1, split.Team2} {
+		for i, player := range team.Players {
+			for _, other := range team.Players[i+1:] {
+				if previousTeam[player.PlayerID] != 0 && previousTeam[player.PlayerID] == previousTeam[other.PlayerID] {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+// BalanceOptions are constraints the balancer must honor
+type BalanceOptions struct {
+	// Together lists groups of players (by ID) that must play on the same team
+	Together [][]string
+	// Apart lists groups of players (by ID) that must play on different teams
+	Apart [][]string
+	// MaxSnipers is the most snipers allowed per team, 0 for no limit. With
+	// more snipers than the teams can take they are spread as evenly as possible.
+	MaxSnipers int
+
+	// RecentTeams holds the teams of the last matches, most recent first
+	RecentTeams [][2][]string
+	// VarietyWeight is the win chance gap the balancer accepts to avoid
+	// recreating the teammates of recent matches, 0 to ignore them
+	VarietyWeight float64
+
+	// Synergy holds how well pairs of players did together in past matches
+	Synergy SynergyMatrix
+	// SynergyWeight is the win chance gap the balancer accepts to split up
+	// every pair of players that does better than even together, 0 to ignore
+	// synergy. Splitting up only some of them is worth part of it, by how
+	// strong the pairs are.
+	SynergyWeight float64
+}
+
+// balancer searches for the most even split that satisfies the options
+type balancer struct {
+	players []*Player
+	rs      RatingSystem
+	opts    BalanceOptions
+	index   map[string]int
+	// maxSnipers is the sniper limit per team after spreading surplus snipers
+	maxSnipers int
+	// together holds how often two players were teammates recently, recent
+	// matches counting more, scaled so always being teammates is 1
+	together [][]float64
+	// synergy holds the synergy of each pair of players, see SynergyMatrix.Synergy
+	synergy [][]float64
+
+	// ranked holds the best distinct valid splits found, at most keep of them
+	keep   int
+	ranked []rankedSplit
+}
+
+func newBalancer(players []*Player, rs RatingSystem, opts BalanceOptions) (*balancer, error) {
+	b := &balancer{players: players, rs: rs, opts: opts, index: make(map[string]int)}
+	for i, player := range players {
+		b.index[player.PlayerID] = i
+	}
+	for _, group := range append(append([][]string{}, opts.Together...), opts.Apart...) {
+		for _, playerID := range group {
+			if _, ok := b.index[playerID]; !ok {
+				return nil, fmt.Errorf("player %s is not in the lobby", playerID)
+			}
+		}
+	}
+
+	b.together = make([][]float64, len(players))
+	for i := range b.together {
+		b.together[i] = make([]float64, len(players))
+	}
+	var totalWeight float64
+	for age := range opts.RecentTeams {
+		totalWeight += 1 / float64(age+1)
+	}
+	for age, teams := range opts.RecentTeams {
+		for _, team := range teams {
+			for i, playerID := range team {
+				for _, otherID := range team[i+1:] {
+					p, ok1 := b.index[playerID]
+					q, ok2 := b.index[otherID]
+					if ok1 && ok2 {
+						b.together[p][q] += 1 / float64(age+1) / totalWeight
+						b.together[q][p] = b.together[p][q]
+					}
+				}
+			}
+		}
+	}
+
+	if opts.SynergyWeight > 0 && opts.Synergy != nil {
+		b.synergy = make([][]float64, len(players))
+		for i, player := range players {
+			b.synergy[i] = make([]float64, len(players))
+			for j, other := range players {
+				if i != j {
+					b.synergy[i][j] = opts.Synergy.Synergy(player.PlayerID, other.PlayerID)
+				}
+			}
+		}
+	}
+
+	if opts.MaxSnipers > 0 {
+		snipers := 0
+		for _, player := range players {
+			if player.Sniper {
+				snipers++
+			}
+		}
+		b.maxSnipers = opts.MaxSnipers
+		if spread := (snipers + 1) / 2; spread > b.maxSnipers {
+			b.maxSnipers = spread
+		}
+	}
+	return b, nil
+}
+
+// violations counts the constraints a split breaks
+func (b *balancer) violations(inTeam1 []bool) int {
+	count := 0
+	for _, group := range b.opts.Together {
+		for _, playerID := range group[1:] {
+			if inTeam1[b.index[playerID]] != inTeam1[b.index[group[0]]] {
+				count++
+			}
+		}
+	}
+	for _, group := range b.opts.Apart {
+		for i := range group {
+			for _, other := range group[i+1:] {
+				if inTeam1[b.index[group[i]]] == inTeam1[b.index[other]] {
+					count++
+				}
+			}
+		}
+	}
+
+	if b.maxSnipers > 0 {
+		snipers := map[bool]int{}
+		for i, player := range b.players {
+			if player.Sniper {
+				snipers[inTeam1[i]]++
+			}
+		}
+		for _, n := range snipers {
+			if n > b.maxSnipers {
+				count += n - b.maxSnipers
+			}
+		}
+	}
+	return count
+}
+
+// repetition is how much the split recreates recent teammates, from 0 (no
+// recent teammates together) to 1 (the same teams every recent match)
+func (b *balancer) repetition(inTeam1 []bool) float64 {
+	var together float64
+	pairs := 0
+	for i := range inTeam1 {
+		for j := i + 1; j < len(inTeam1); j++ {
+			if inTeam1[i] == inTeam1[j] {
+				together += b.together[i][j]
+				pairs++
+			}
+		}
+	}
+	if pairs == 0 {
+		return 0
+	}
+	return together / float64(pairs)
+}
+
+// violationCost is what a broken constraint adds to the cost of a split: more
+// than the largest possible win chance gap (0.5) plus the variety and synergy
+// penalties, which are at most their weights
+func (b *balancer) violationCost() float64 {
+	return 1 + b.opts.VarietyWeight + b.opts.SynergyWeight
+}
+
+// cost ranks splits: any broken constraint outweighs the largest possible win
+// chance gap plus the variety and synergy penalties
+func (b *balancer) cost(inTeam1 []bool, split *TeamSplit) float64 {
+	cost := float64(b.violations(inTeam1))*b.violationCost() + split.Gap()
+	if b.opts.VarietyWeight > 0 && len(b.opts.RecentTeams) > 0 {
+		cost += b.opts.VarietyWeight * b.repetition(inTeam1)
+	}
+	if b.synergy != nil {
+		cost += b.opts.SynergyWeight * b.stackedSynergy(inTeam1)
+	}
+	return cost
+}
+
+// newTeamSplit builds the split where inTeam1 marks the players of team 1
+func newTeamSplit(players []*Player, inTeam1 []bool, rs RatingSystem) *TeamSplit {
+	team1 := &Team{Name: "Team 1", Players: []*Player{}}
+	team2 := &Team{Name: "Team 2", Players: []*Player{}}
+	for i, player := range players {
+		if inTeam1[i] {
+			team1.Players = append(team1.Players, player)
+		} else {
+			team2.Players = append(team2.Players, player)
+		}
+	}
+	return &TeamSplit{Team1: team1, Team2: team2, Team1WinChance: rs.ExpectedScore(team1, team2)}
+}
+
+// BalanceTeams splits players into the two teams whose predicted win chances,
+// from the rating system's ExpectedScore, are closest to even while honoring
+// the options. Teams differ in size by at most one player.
+func BalanceTeams(players []*Player, rs RatingSystem, opts BalanceOptions) (*TeamSplit, error) {
+	splits, err := ProposeSplits(players, rs, opts, 1)
+	if err != nil {
+		return nil, err
+	}
+	return splits[0], nil
+}
+
+// ProposeSplits returns up to count distinct splits that honor the options,
+// most balanced first
+func ProposeSplits(players []*Player, rs RatingSystem, opts BalanceOptions, count int) ([]*TeamSplit, error) {
+	if len(players) < 2 {
+		return nil, fmt.Errorf("need at least 2 players to form teams, got %d", len(players))
+	}
+
+	// Shuffle first so equally balanced splits are picked at random
+	shuffled := append([]*Player{}, players...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	b, err := newBalancer(shuffled, rs, opts)
+	if err != nil {
+		return nil, err
+	}
+	b.keep = count
+
+	if len(shuffled) <= exhaustiveBalanceLimit {
+		b.searchAllSplits()
+	} else {
+		b.annealSplit()
+	}
+	if len(b.ranked) == 0 {
+		return nil, fmt.Errorf("no split of these players satisfies the constraints")
+	}
+
+	// The search ranks splits with the first player on team 1, so pick the sides at random
+	var splits []*TeamSplit
+	for _, ranked := range b.ranked {
+		split := ranked.split
+		split.RepeatedPairs = -1
+		if len(opts.RecentTeams) > 0 {
+			split.RepeatedPairs = countRepeatedPairs(split, opts.RecentTeams[0])
+		}
+		if rand.Intn(2) == 0 {
+			split = split.swapped()
+		}
+		splits = append(splits, split)
+	}
+	return splits, nil
+}
+
+// rankedSplit is a split that satisfies every constraint, with its cost
+type rankedSplit struct {
+	key   string
+	cost  float64
+	split *TeamSplit
+}
+
+// rank remembers the split if it is among the best distinct valid splits seen so far
+func (b *balancer) rank(inTeam1 []bool, split *TeamSplit, cost float64) {
+	if b.violations(inTeam1) > 0 {
+		return
+	}
+	if len(b.ranked) == b.keep && cost >= b.ranked[len(b.ranked)-1].cost {
+		return
+	}
+
+	// Mirrored assignments are the same split
+	key := make([]byte, len(inTeam1))
+	for i := range inTeam1 {
+		if inTeam1[i] == inTeam1[0] {
+			key[i] = '1'
+		} else {
+			key[i] = '2'
+		}
+	}
+	for _, ranked := range b.ranked {
+		if ranked.key == string(key) {
+			return
+		}
+	}
+
+	if !inTeam1[0] {
+		split = split.swapped()
+	}
+	b.ranked = append(b.ranked, rankedSplit{key: string(key), cost: cost, split: split})
+	sort.SliceStable(b.ranked, func(i, j int) bool {
+		return b.ranked[i].cost < b.ranked[j].cost
+	})
+	if len(b.ranked) > b.keep {
+		b.ranked = b.ranked[:b.keep]
+	}
+}
+
+// searchAllSplits tries every split with teams of equal size (or one apart).
+// The first player is fixed to team 1 so mirrored splits are only tried once.
+func (b *balancer) searchAllSplits() {
+	n := len(b.players)
+	inTeam1 := make([]bool, n)
+	inTeam1[0] = true
+
+	for mask := 0; mask < 1<<(n-1); mask++ {
+		size := 1
+		for i := 1; i < n; i++ {
+			inTeam1[i] = mask&(1<<(i-1)) != 0
+			if inTeam1[i] {
+				size++
+			}
+		}
+		if size != n/2 && size != (n+1)/2 {
+			continue
+		}
+
+		split := newTeamSplit(b.players, inTeam1, b.rs)
+		b.rank(inTeam1, split, b.cost(inTeam1, split))
+	}
+}
+
+// annealSplit searches large lobbies by swapping players between the teams,
+// accepting worse splits with a probability that shrinks as it cools down
+func (b *balancer) annealSplit() {
+	n := len(b.players)
+	inTeam1 := make([]bool, n)
+	for i := 0; i < (n+1)/2; i++ {
+		inTeam1[i] = true
+	}
+
+	current := newTeamSplit(b.players, inTeam1, b.rs)
+	currentCost := b.cost(inTeam1, current)
+	b.rank(inTeam1, current, currentCost)
+	for step := 0; step < annealIterations; step++ {
+		temp := annealStartTemp * math.Pow(annealEndTemp/annealStartTemp, float64(step)/annealIterations)
+
+		// Swap a random player of team 1 with a random player of team 2
+		i, j := rand.Intn(n), rand.Intn(n)
+		if inTeam1[i] == inTeam1[j] {
+			continue
+		}
+		inTeam1[i], inTeam1[j] = inTeam1[j], inTeam1[i]
+
+		candidate := newTeamSplit(b.players, inTeam1, b.rs)
+		candidateCost := b.cost(inTeam1, candidate)
+		delta := candidateCost - currentCost
+		if delta <= 0 || rand.Float64() < math.Exp(-delta/temp) {
+			current, currentCost = candidate, candidateCost
+			b.rank(inTeam1, current, currentCost)
+		} else {
+			inTeam1[i], inTeam1[j] = inTeam1[j], inTeam1[i]
+		}
+	}
+}
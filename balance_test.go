@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Build test players with a spread of MMRs similar to the real ladder
+func getTestPlayers(playerIDs []string) []*Player {
+	mmrs := []int{1180, 1120, 1090, 1060, 1030, 1000, 980, 950, 920, 870}
+	var players []*Player
+	for i, playerID := range playerIDs {
+		players = append(players, &Player{
+			PlayerID:   playerID,
+			PlayerName: playerID,
+			MMR:        mmrs[i%len(mmrs)],
+		})
+	}
+	return players
+}
+
+func TestBalanceTeamsFindsEvenSplit(t *testing.T) {
+	for _, count := range []int{6, 10, 16} {
+		var playerIDs []string
+		for i := 0; i < count; i++ {
+			playerIDs = append(playerIDs, string(rune('a'+i)))
+		}
+
+		split, err := BalanceTeams(getTestPlayers(playerIDs), &EloRatingSystem{}, BalanceOptions{})
+		if err != nil {
+			t.Fatalf("Error balancing %d players: %v", count, err)
+		}
+		if abs(len(split.Team1.Players)-len(split.Team2.Players)) > 1 {
+			t.Fatalf("uneven teams for %d players: %d vs %d", count, len(split.Team1.Players), len(split.Team2.Players))
+		}
+
+		// The predicted win chance comes from the Elo expectation of the two teams
+		expected := calculateExpectedScore(split.Team1.calculateTeamMmr(), split.Team2.calculateTeamMmr())
+		if split.Team1WinChance != expected || split.Team1WinChance+split.Team2WinChance() != 1 {
+			t.Fatalf("unexpected win chances %.3f/%.3f, expected %.3f", split.Team1WinChance, split.Team2WinChance(), expected)
+		}
+		if split.Gap() > 0.01 {
+			t.Fatalf("split of %d players is not balanced: team 1 wins %.3f", count, split.Team1WinChance)
+		}
+	}
+}
+
+func TestBalanceTeamsConstraints(t *testing.T) {
+	playerIDs := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	players := getTestPlayers(playerIDs)
+	players[0].Sniper, players[1].Sniper, players[2].Sniper = true, true, true
+
+	opts := BalanceOptions{
+		Together:   [][]string{{"a", "b"}},
+		Apart:      [][]string{{"c", "d"}},
+		MaxSnipers: 1,
+	}
+	for i := 0; i < 20; i++ {
+		split, err := BalanceTeams(players, &EloRatingSystem{}, opts)
+		if err != nil {
+			t.Fatalf("Error balancing teams: %v", err)
+		}
+
+		team1 := split.Team1.GetPlayerIDs()
+		if strings.Contains(team1, "a") != strings.Contains(team1, "b") {
+			t.Fatalf("a and b should play together: %s vs %s", team1, split.Team2.GetPlayerIDs())
+		}
+		if strings.Contains(team1, "c") == strings.Contains(team1, "d") {
+			t.Fatalf("c and d should play apart: %s vs %s", team1, split.Team2.GetPlayerIDs())
+		}
+
+		// Three snipers cannot be one per side, so two may share a team
+		for _, team := range []*Team{split.Team1, split.Team2} {
+			snipers := 0
+			for _, player := range team.Players {
+				if player.Sniper {
+					snipers++
+				}
+			}
+			if snipers > 2 {
+				t.Fatalf("%d snipers on one team", snipers)
+			}
+		}
+	}
+
+	opts = BalanceOptions{Together: [][]string{{"a", "b"}}, Apart: [][]string{{"a", "b"}}}
+	if _, err := BalanceTeams(players, &EloRatingSystem{}, opts); err == nil {
+		t.Fatalf("expected an error for contradicting constraints")
+	}
+}
+
+func TestBalanceTeamsVariety(t *testing.T) {
+	var players []*Player
+	for _, playerID := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		players = append(players, &Player{PlayerID: playerID, PlayerName: playerID, MMR: 1000})
+	}
+	previous := [2][]string{{"a", "b", "c", "d", "e"}, {"f", "g", "h", "i", "j"}}
+
+	// Every split is even, so the penalty decides: mixing 3+2 and 2+3 repeats 8 pairs
+	opts := BalanceOptions{RecentTeams: [][2][]string{previous}, VarietyWeight: 0.05}
+	split, err := BalanceTeams(players, &EloRatingSystem{}, opts)
+	if err != nil {
+		t.Fatalf("Error balancing teams: %v", err)
+	}
+	if split.RepeatedPairs != 8 {
+		t.Fatalf("expected 8 repeated pairs, got %d: %s vs %s", split.RepeatedPairs, split.Team1.GetPlayerIDs(), split.Team2.GetPlayerIDs())
+	}
+
+	// Without history nothing is compared
+	split, _ = BalanceTeams(players, &EloRatingSystem{}, BalanceOptions{})
+	if split.RepeatedPairs != -1 {
+		t.Fatalf("expected no comparison without recent matches, got %d", split.RepeatedPairs)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SitOut is how often a player sat out during a voice channel's session
+type SitOut struct {
+	Count int
+	// Last is whether they sat out the last game of the session
+	Last bool
+}
+
+// Retrieve the sit-out counts of a voice channel's session. Rows not touched
+// since the session started belong to an earlier session and are ignored.
+func (db *DB) GetSitOuts(guildID, voiceChannelID string, sessionStart time.Time) (map[string]SitOut, error) {
+	rows, err := db.db.Query(`
+		SELECT PlayerID, SitOuts, SatOutLast FROM sit_outs
+		WHERE GuildID = ? AND VoiceChannelID = ? AND UpdatedAt >= ?
+	`, guildID, voiceChannelID, sessionStart.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sitOuts := make(map[string]SitOut)
+	for rows.Next() {
+		var playerID string
+		var sitOut SitOut
+		if err := rows.Scan(&playerID, &sitOut.Count, &sitOut.Last); err != nil {
+			return nil, err
+		}
+		sitOuts[playerID] = sitOut
+	}
+	return sitOuts, rows.Err()
+}
+
+// Record who played and who sat out a game in a voice channel at playedAt.
+// Counts from before sessionStart are discarded so every session starts from
+// zero.
+func (db *DB) RecordRotation(guildID, voiceChannelID string, playing, bench []string, sessionStart, playedAt time.Time) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE sit_outs SET SatOutLast = FALSE WHERE GuildID = ? AND VoiceChannelID = ?", guildID, voiceChannelID); err != nil {
+		return err
+	}
+	record := func(playerID string, satOut bool) error {
+		count := 0
+		if satOut {
+			count = 1
+		}
+		_, err := tx.Exec(`
+			INSERT INTO sit_outs (GuildID, VoiceChannelID, PlayerID, SitOuts, SatOutLast, UpdatedAt)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(GuildID, VoiceChannelID, PlayerID) DO UPDATE SET
+				SitOuts = CASE WHEN UpdatedAt < ? THEN excluded.SitOuts ELSE SitOuts + excluded.SitOuts END,
+				SatOutLast = excluded.SatOutLast,
+				UpdatedAt = excluded.UpdatedAt
+		`, guildID, voiceChannelID, playerID, count, satOut, playedAt.UTC(), sessionStart.UTC())
+		return err
+	}
+	for _, playerID := range playing {
+		if err := record(playerID, false); err != nil {
+			return err
+		}
+	}
+	for _, playerID := range bench {
+		if err := record(playerID, true); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Record the rotation of a lobby formed from a voice channel once its teams
+// are final. Every game of the session counts, so who sat out last is always
+// known.
+func recordRotation(db *DB, lobby *Lobby, bench []string, sessionStart time.Time) {
+	var playing []string
+	for _, team := range []*Team{lobby.Team1, lobby.Team2} {
+		for _, player := range team.Players {
+			playing = append(playing, player.PlayerID)
+		}
+	}
+	if err := db.RecordRotation(lobby.GuildID, lobby.VoiceChannelID, playing, bench, sessionStart, time.Now()); err != nil {
+		log.Printf("Error recording sit-outs: %v", err)
+	}
+}
+
+// Start a new session in a voice channel, forgetting its sit-out counts
+func (db *DB) ResetSitOuts(guildID, voiceChannelID string) error {
+	_, err := db.db.Exec("DELETE FROM sit_outs WHERE GuildID = ? AND VoiceChannelID = ?", guildID, voiceChannelID)
+	return err
+}
+
+// rotatePlayers picks who plays when more players are available than a match
+// takes. Players who sat out the last game go first, then those who sat out
+// most often this session; ties are broken at random.
+func rotatePlayers(playerIDs []string, size int, sitOuts map[string]SitOut) (playing, bench []string) {
+	if len(playerIDs) <= size {
+		return playerIDs, nil
+	}
+
+	ordered := append([]string{}, playerIDs...)
+	rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := sitOuts[ordered[i]], sitOuts[ordered[j]]
+		if a.Last != b.Last {
+			return a.Last
+		}
+		return a.Count > b.Count
+	})
+	return ordered[:size], ordered[size:]
+}
+
+// voiceSelection is who plays a game formed from a voice channel and who sits
+// out of it
+type voiceSelection struct {
+	Players []*Player
+	Bench   []*Player
+	// BenchIDs and SessionStart are recorded once the lobby is formed
+	BenchIDs     []string
+	SitOuts      map[string]SitOut
+	SessionStart time.Time
+}
+
+// selectVoicePlayers picks the players of a game from the players in a voice
+// channel. With more than size players the rest sit out in rotation, except
+// the captains who always play; a size of 0 takes everyone. An odd number of
+// players is refused unless allowUneven is set.
+func selectVoicePlayers(db *DB, discordInstance *Discord, guildID, voiceChannelID string, playerIDs []string, size int, allowUneven bool, cfg *Config, captainIDs ...string) (*voiceSelection, error) {
+	selection := &voiceSelection{SessionStart: time.Now().Add(-cfg.SessionTimeout)}
+	if size > 0 && len(playerIDs) > size {
+		sitOuts, err := db.GetSitOuts(guildID, voiceChannelID, selection.SessionStart)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load sit-outs: %v", err)
+		}
+		var captains, others []string
+		for _, playerID := range playerIDs {
+			if containsString(captainIDs, playerID) {
+				captains = append(captains, playerID)
+			} else {
+				others = append(others, playerID)
+			}
+		}
+		playing, bench := rotatePlayers(others, size-len(captains), sitOuts)
+		playerIDs = append(captains, playing...)
+		selection.BenchIDs, selection.SitOuts = bench, sitOuts
+	}
+
+	var err error
+	if selection.Players, err = loadPlayers(db, discordInstance, guildID, playerIDs); err != nil {
+		return nil, err
+	}
+	if selection.Bench, err = loadPlayers(db, discordInstance, guildID, selection.BenchIDs); err != nil {
+		return nil, err
+	}
+	if len(selection.Players) < 2 {
+		return nil, fmt.Errorf("not enough players to form teams")
+	}
+	if len(selection.Players)%2 != 0 && !allowUneven {
+		return nil, fmt.Errorf("%d players would make uneven teams. Add `-u` to play anyway, or have someone sit out", len(selection.Players))
+	}
+	return selection, nil
+}
+
+// Describe the players sitting out with their sit-out counts for the session
+func describeBench(players []*Player, sitOuts map[string]SitOut) string {
+	var names []string
+	for _, player := range players {
+		names = append(names, fmt.Sprintf("%s (%d)", player.PlayerName, sitOuts[player.PlayerID].Count+1))
+	}
+	return fmt.Sprintf("Sitting out this game (times this session): %s", strings.Join(names, ", "))
+}
+
+// Command to show the sit-out counts of the caller's voice channel, or to
+// start a new session with `!bench reset` (admins only)
+func benchCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	voiceChannelID := getVoiceChannelIDForUser(s, m.GuildID, m.Author.ID)
+	if voiceChannelID == "" {
+		s.ChannelMessageSend(m.ChannelID, "You need to be in a voice channel!")
+		return
+	}
+
+	if len(args) > 1 && strings.ToLower(args[1]) == "reset" {
+		// Rotation relies on the sit-out history, so only admins may clear it
+		if !isAdmin(s, m.ChannelID, m.Author.ID) {
+			s.ChannelMessageSend(m.ChannelID, "Only admins can reset the bench.")
+			return
+		}
+		if err := db.ResetSitOuts(m.GuildID, voiceChannelID); err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error resetting the bench: %v", err))
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, "Sit-out counts cleared, a new session starts with the next game.")
+		return
+	}
+
+	cfg, err := db.GetGuildConfig(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading settings: %v", err))
+		return
+	}
+	sitOuts, err := db.GetSitOuts(m.GuildID, voiceChannelID, time.Now().Add(-cfg.SessionTimeout))
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading the bench: %v", err))
+		return
+	}
+	if len(sitOuts) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Nobody has sat out a game in this channel's session yet.")
+		return
+	}
+
+	playerIDs := make([]string, 0, len(sitOuts))
+	for playerID := range sitOuts {
+		playerIDs = append(playerIDs, playerID)
+	}
+	sort.SliceStable(playerIDs, func(i, j int) bool {
+		return sitOuts[playerIDs[i]].Count > sitOuts[playerIDs[j]].Count
+	})
+	var lines []string
+	for _, playerID := range playerIDs {
+		line := fmt.Sprintf("<@%s>: %d", playerID, sitOuts[playerID].Count)
+		if sitOuts[playerID].Last {
+			line += " (sat out the last game, plays next)"
+		}
+		lines = append(lines, line)
+	}
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Title:       "Sit-outs this session",
+		Description: strings.Join(lines, "\n"),
+		Color:       0x00ff00,
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRotatePlayers(t *testing.T) {
+	db := newTestDB(t)
+	sessionStart := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+
+	var playerIDs []string
+	for _, playerID := range "abcdefghijkl" {
+		playerIDs = append(playerIDs, string(playerID))
+	}
+	sitOuts := make(map[string]SitOut)
+
+	// Over six games with 12 players and 10 spots, everyone sits out exactly once
+	satOut := make(map[string]int)
+	for game := 0; game < 6; game++ {
+		playing, bench := rotatePlayers(playerIDs, 10, sitOuts)
+		if len(playing) != 10 || len(bench) != 2 {
+			t.Fatalf("expected 10 playing and 2 on the bench, got %d and %d", len(playing), len(bench))
+		}
+		for _, playerID := range bench {
+			if sitOuts[playerID].Last {
+				t.Fatalf("%s sat out two games in a row", playerID)
+			}
+			satOut[playerID]++
+		}
+		playedAt := sessionStart.Add(time.Duration(game+1) * 40 * time.Minute)
+		if err := db.RecordRotation(testGuildID, "voice", playing, bench, sessionStart, playedAt); err != nil {
+			t.Fatalf("Error recording rotation: %v", err)
+		}
+		var err error
+		sitOuts, err = db.GetSitOuts(testGuildID, "voice", sessionStart)
+		if err != nil {
+			t.Fatalf("Error loading sit-outs: %v", err)
+		}
+	}
+	for _, playerID := range playerIDs {
+		if satOut[playerID] != 1 || sitOuts[playerID].Count != 1 {
+			t.Fatalf("expected %s to sit out once, sat out %d (stored %d)", playerID, satOut[playerID], sitOuts[playerID].Count)
+		}
+	}
+
+	// A new session starts from zero
+	later := sessionStart.Add(24 * time.Hour)
+	if sitOuts, _ := db.GetSitOuts(testGuildID, "voice", later); len(sitOuts) != 0 {
+		t.Fatalf("expected no sit-outs in a new session, got %v", sitOuts)
+	}
+	if err := db.RecordRotation(testGuildID, "voice", playerIDs[2:], playerIDs[:2], later, later.Add(time.Minute)); err != nil {
+		t.Fatalf("Error recording rotation: %v", err)
+	}
+	sitOuts, _ = db.GetSitOuts(testGuildID, "voice", later)
+	var benched []string
+	for playerID, sitOut := range sitOuts {
+		if sitOut.Count > 0 {
+			benched = append(benched, playerID)
+		}
+	}
+	sort.Strings(benched)
+	if len(benched) != 2 || benched[0] != "a" || benched[1] != "b" || sitOuts["a"].Count != 1 {
+		t.Fatalf("expected only a and b benched once in the new session, got %v", sitOuts)
+	}
+
+	// Without extra players nobody sits out
+	if playing, bench := rotatePlayers(playerIDs[:10], 10, sitOuts); len(playing) != 10 || len(bench) != 0 {
+		t.Fatalf("expected everyone to play, got %d playing and %d benched", len(playing), len(bench))
+	}
+}
+
+func TestRecordRotationOfLobby(t *testing.T) {
+	db := newTestDB(t)
+	sessionStart := time.Now().Add(-time.Hour)
+	lobby := &Lobby{
+		GuildID:        testGuildID,
+		VoiceChannelID: "voice",
+		Team1:          &Team{Players: []*Player{{PlayerID: "a"}}},
+		Team2:          &Team{Players: []*Player{{PlayerID: "b"}}},
+	}
+
+	// The players of both teams played, the bench sat out
+	recordRotation(db, lobby, []string{"c"}, sessionStart)
+	sitOuts, err := db.GetSitOuts(testGuildID, "voice", sessionStart)
+	if err != nil {
+		t.Fatalf("Error loading sit-outs: %v", err)
+	}
+	if len(sitOuts) != 3 || sitOuts["a"].Count != 0 || sitOuts["b"].Count != 0 || !sitOuts["c"].Last {
+		t.Fatalf("expected a and b to have played and c to have sat out, got %v", sitOuts)
+	}
+}
+
+func TestSelectVoicePlayers(t *testing.T) {
+	db := newTestDB(t)
+	cfg, err := db.GetGuildConfig(testGuildID)
+	if err != nil {
+		t.Fatalf("Error loading settings: %v", err)
+	}
+	var playerIDs []string
+	for i := 0; i < 11; i++ {
+		playerID := string(rune('a' + i))
+		if err := db.SavePlayer(NewPlayer(testGuildID, playerID, playerID)); err != nil {
+			t.Fatalf("Error saving player: %v", err)
+		}
+		playerIDs = append(playerIDs, playerID)
+	}
+
+	// Captains play even when the rotation benches most of the channel
+	selection, err := selectVoicePlayers(db, nil, testGuildID, "voice", playerIDs, 4, false, cfg, "j", "k")
+	if err != nil {
+		t.Fatalf("Error selecting players: %v", err)
+	}
+	if len(selection.Players) != 4 || len(selection.BenchIDs) != 7 || selection.Players[0].PlayerID != "j" || selection.Players[1].PlayerID != "k" {
+		t.Fatalf("expected the captains and two more to play, got %v playing and %v benched", selection.Players, selection.BenchIDs)
+	}
+
+	// An odd number of players is refused unless uneven teams are allowed
+	if _, err := selectVoicePlayers(db, nil, testGuildID, "voice", playerIDs, 0, false, cfg); err == nil {
+		t.Fatalf("expected 11 players to make uneven teams")
+	}
+	if selection, err := selectVoicePlayers(db, nil, testGuildID, "voice", playerIDs, 0, true, cfg); err != nil || len(selection.Players) != 11 {
+		t.Fatalf("expected all 11 players to play, got %v, %v", selection, err)
+	}
+}
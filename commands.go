@@ -5,28 +5,32 @@ import (
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// Command to display player stats
+// Command to display player stats, overall or on one map: `!stats [@user] [map]`
 func playerStatsCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB, discordInstance *Discord) {
 	var playerID string
 	var playerName string
 
+	// A map name may follow the optional mention
+	var mapName string
+	if len(args) > 1 {
+		if name, ok := parseMapName(args[len(args)-1]); ok {
+			mapName = name
+			args = args[:len(args)-1]
+		}
+	}
+
 	if len(args) == 1 {
 		// No additional arguments; use the caller's ID and username
 		playerID = m.Author.ID
 		playerName = m.Author.Username
 	} else {
 		// Additional argument supplied; expect a user mention
-		arg := args[1]
-		// Mentions are in the format <@1234567890> or <@!1234567890>
-		if len(arg) > 3 && strings.HasPrefix(arg, "<@") && strings.HasSuffix(arg, ">") {
-			// Extract the user ID from the mention
-			userID := arg[2 : len(arg)-1]
-			// Remove the '!' prefix if present
-			userID = strings.TrimPrefix(userID, "!")
+		if userID, ok := parseUserMention(args[1]); ok {
 			playerID = userID
 
 			// Fetch the user's username
@@ -42,8 +46,8 @@ func playerStatsCommand(s *discordgo.Session, m *discordgo.MessageCreate, args [
 		}
 	}
 
-	// Fetch the player stats from the database
-	player, err := db.GetPlayer(playerID)
+	// Fetch the player stats from the guild's ladder
+	player, err := db.GetPlayer(m.GuildID, playerID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Player %s not found in the database.", playerName))
@@ -53,6 +57,16 @@ func playerStatsCommand(s *discordgo.Session, m *discordgo.MessageCreate, args [
 		return
 	}
 
+	if mapName != "" {
+		records, err := db.GetMapRecords(m.GuildID)
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading maps: %v", err))
+			return
+		}
+		s.ChannelMessageSendEmbed(m.ChannelID, mapStatsEmbed(player, mapName, records[playerID][mapName]))
+		return
+	}
+
 	// Create an embed message
 	embed := &discordgo.MessageEmbed{
 		Title: fmt.Sprintf("Stats for %s", player.PlayerName),
@@ -90,12 +104,92 @@ func playerStatsCommand(s *discordgo.Session, m *discordgo.MessageCreate, args [
 			},
 		},
 	}
+
+	// Extended stats of the rated matches they were reported for
+	totals, err := db.GetExtendedStatTotals(m.GuildID, playerID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading stats: %v", err))
+		return
+	}
+	embed.Fields = append(embed.Fields, extendedStatFields(totals)...)
+
+	// Show the uncertainty tracked by the guild's rating system
+	rs, err := db.GetRatingSystem(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading rating system: %v", err))
+		return
+	}
+	switch rs.(type) {
+	case *GlickoRatingSystem:
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   "Rating Deviation",
+			Value:  fmt.Sprintf("%.0f", player.RatingDeviation),
+			Inline: true,
+		})
+	case *OpenSkillRatingSystem:
+		mu, sigma := openSkillRating(player)
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   "Skill (μ ± σ)",
+			Value:  fmt.Sprintf("%.0f ± %.0f", mu, sigma),
+			Inline: true,
+		}, &discordgo.MessageEmbedField{
+			Name:   "Conservative Rating",
+			Value:  fmt.Sprintf("%d", player.ConservativeRating()),
+			Inline: true,
+		})
+	}
+
 	s.ChannelMessageSendEmbed(m.ChannelID, embed)
 }
 
+// Extract the user ID from a mention in the format <@1234567890> or <@!1234567890>
+func parseUserMention(arg string) (string, bool) {
+	if len(arg) <= 3 || !strings.HasPrefix(arg, "<@") || !strings.HasSuffix(arg, ">") {
+		return "", false
+	}
+	return strings.TrimPrefix(arg[2:len(arg)-1], "!"), true
+}
+
+// Parse the balancing constraints of !teams: mentions after "together" must
+// share a team and mentions after "apart" must be split. Each keyword starts
+// a new group, e.g. `!teams together @a @b together @c @d apart @e @f`.
+func parseBalanceConstraints(args []string) (BalanceOptions, error) {
+	var opts BalanceOptions
+	var group *[]string
+	for _, arg := range args {
+		switch strings.ToLower(arg) {
+		case "-a", "-u":
+			continue
+		case "together":
+			opts.Together = append(opts.Together, nil)
+			group = &opts.Together[len(opts.Together)-1]
+			continue
+		case "apart":
+			opts.Apart = append(opts.Apart, nil)
+			group = &opts.Apart[len(opts.Apart)-1]
+			continue
+		}
+
+		userID, ok := parseUserMention(arg)
+		if !ok || group == nil {
+			return opts, fmt.Errorf("unexpected argument %q, use `together @a @b` or `apart @a @b`", arg)
+		}
+		*group = append(*group, userID)
+	}
+
+	for _, groups := range [][][]string{opts.Together, opts.Apart} {
+		for _, group := range groups {
+			if len(group) < 2 {
+				return opts, fmt.Errorf("`together` and `apart` need at least two players each")
+			}
+		}
+	}
+	return opts, nil
+}
+
 // Command to display ELO graph data (for graphing or text output)
-func eloGraphCommand(s *discordgo.Session, channelID, playerID string, db *DB) {
-	mmrs, timestamps, err := db.GetMmrHistory(playerID)
+func eloGraphCommand(s *discordgo.Session, channelID, guildID, playerID string, db *DB) {
+	mmrs, timestamps, err := db.GetMmrHistory(guildID, playerID)
 	if err != nil {
 		s.ChannelMessageSend(channelID, fmt.Sprintf("Error fetching MMR history: %v", err))
 		return
@@ -125,6 +219,49 @@ func getVoiceChannelIDForUser(s *discordgo.Session, guildID string, userID strin
 	return ""
 }
 
+// ID of a regular who commentates the games instead of playing
+const commentatorID = "108220450194092032"
+
+// Get the IDs of the players in a voice channel, leaving out the commentator
+func getVoiceChannelPlayerIDs(discordInstance *Discord, guildID, voiceChannelID string) ([]string, error) {
+	playerIDs, err := discordInstance.GetPlayersInVoiceChannel(guildID, voiceChannelID)
+	if err != nil {
+		return nil, err
+	}
+
+	var filteredIDs []string
+	for _, id := range playerIDs {
+		if id != commentatorID {
+			filteredIDs = append(filteredIDs, id)
+		}
+	}
+	return filteredIDs, nil
+}
+
+// Load players from the guild's ladder, creating the ones that play for the first time
+func loadPlayers(db *DB, discordInstance *Discord, guildID string, playerIDs []string) ([]*Player, error) {
+	var players []*Player
+	for _, playerID := range playerIDs {
+		player, err := db.GetPlayer(guildID, playerID)
+		if err != nil {
+			// If player doesn't exist, create a new one
+			if err != sql.ErrNoRows {
+				return nil, fmt.Errorf("failed to get player: %v", err)
+			}
+			playerName, err := discordInstance.GetPlayerName(playerID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get player name: %v", err)
+			}
+			player = NewPlayer(guildID, playerID, playerName)
+			if err := db.SavePlayer(player); err != nil {
+				return nil, fmt.Errorf("failed to save player: %v", err)
+			}
+		}
+		players = append(players, player)
+	}
+	return players, nil
+}
+
 func handleTeamsCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB, discordInstance *Discord) {
 	guildID := m.GuildID
 	voiceChannelID := getVoiceChannelIDForUser(s, guildID, m.Author.ID)
@@ -134,88 +271,146 @@ func handleTeamsCommand(s *discordgo.Session, m *discordgo.MessageCreate, args [
 		return
 	}
 
-	// Check if the `-a` flag is set (take all players)
-	takeAll := false
-	if len(args) > 1 && args[1] == "-a" {
-		takeAll = true
+	// `-a` takes every player in the channel, `-u` allows teams of different sizes
+	takeAll, allowUneven := false, false
+	for _, arg := range args[1:] {
+		switch arg {
+		case "-a":
+			takeAll = true
+		case "-u":
+			allowUneven = true
+		}
 	}
 
-	commentatorID := "108220450194092032"
+	opts, err := parseBalanceConstraints(args[1:])
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
 
 	// Use helper function to get players
-	playerIDs, err := discordInstance.GetPlayersInVoiceChannel(guildID, voiceChannelID)
+	playerIDs, err := getVoiceChannelPlayerIDs(discordInstance, guildID, voiceChannelID)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error fetching players in voice channel: %v", err))
 		return
 	}
 
-	// Remove commentatorID
-	var filteredIDs []string
-	for _, id := range playerIDs {
-		if id != commentatorID {
-			filteredIDs = append(filteredIDs, id)
-		}
+	// Select teams based on the guild's rating system and settings
+	cfg, err := db.GetGuildConfig(guildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading settings: %v", err))
+		return
 	}
-	playerIDs = filteredIDs
-
-	// Limit to 10 players if not taking all
-	if !takeAll && len(playerIDs) > 10 {
-		playerIDs = playerIDs[:10]
+	rs, err := NewRatingSystem(cfg.RatingSystem)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading rating system: %v", err))
+		return
 	}
 
-	// Load players from DB or create new ones
-	var players []*Player
-	for _, playerID := range playerIDs {
-		player, err := db.GetPlayer(playerID)
-		if err != nil {
-			// If player doesn't exist, create a new one
-			if err == sql.ErrNoRows {
-				playerName, err := discordInstance.GetPlayerName(playerID)
-				if err != nil {
-					s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error getting player name: %v", err))
-					return
-				}
-				player = &Player{
-					PlayerID:   playerID,
-					PlayerName: playerName,
-					MMR:        1000, // Default MMR
-				}
-				err = db.SavePlayer(player)
-				if err != nil {
-					s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error saving player: %v", err))
-					return
-				}
-			} else {
-				s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error getting player: %v", err))
-				return
-			}
-		}
-		players = append(players, player)
+	// Unless taking all, players beyond a full match sit out in rotation
+	size := cfg.QueueSize
+	if takeAll {
+		size = 0
 	}
-
-	// Check if we have at least 2 players to form teams
-	if len(players) < 2 {
-		s.ChannelMessageSend(m.ChannelID, "Not enough players to form teams.")
+	selection, err := selectVoicePlayers(db, discordInstance, guildID, voiceChannelID, playerIDs, size, allowUneven, cfg)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
 		return
 	}
+	players := selection.Players
 
-	// Select teams based on MMR
-	team1, team2, err := BalanceTeams(players)
+	if err := loadBalanceSettings(db, guildID, cfg, &opts); err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	splits, err := ProposeSplits(players, rs, opts, teamProposalCount)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error balancing teams: %v", err))
 		return
 	}
 
-	// Store teams in DB
-	teamStorage := NewTeamStorage(db, 48*time.Hour)
-	err = teamStorage.StoreTeams(team1, team2)
-	if err != nil {
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error storing teams: %v", err))
+	if len(selection.Bench) > 0 {
+		s.ChannelMessageSend(m.ChannelID, describeBench(selection.Bench, selection.SitOuts))
+	}
+
+	// With a single possible split there is nothing to vote on
+	if len(splits) == 1 {
+		lobby, err := formLobby(db, guildID, m.ChannelID, voiceChannelID, splits[0])
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+			return
+		}
+		recordRotation(db, lobby, selection.BenchIDs, selection.SessionStart)
+		announceLobby(s, m.ChannelID, lobby, splits[0])
 		return
 	}
 
-	// Send team compositions
-	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Team 1: %v\nTeam 2: %v", getTeamNames(team1), getTeamNames(team2)))
+	startTeamVote(s, db, &TeamVote{
+		GuildID:        guildID,
+		ChannelID:      m.ChannelID,
+		VoiceChannelID: voiceChannelID,
+		Proposals:      splits,
+		Voters:         len(players),
+		Bench:          selection.BenchIDs,
+		SessionStart:   selection.SessionStart,
+	}, cfg.TeamVoteTimeout)
+}
+
+// Fill in the balancing options that come from the guild's settings and history
+func loadBalanceSettings(db *DB, guildID string, cfg *Config, opts *BalanceOptions) error {
+	opts.MaxSnipers = cfg.MaxSnipers
+	opts.VarietyWeight = cfg.VarietyWeight
+	if cfg.VarietyMatches > 0 {
+		recent, err := db.GetRecentTeams(guildID, cfg.VarietyMatches)
+		if err != nil {
+			return fmt.Errorf("failed to load recent matches: %v", err)
+		}
+		opts.RecentTeams = recent
+	}
+	opts.SynergyWeight = cfg.SynergyWeight
+	if cfg.SynergyWeight > 0 {
+		records, err := db.GetMatchRecords(guildID)
+		if err != nil {
+			return fmt.Errorf("failed to load matches: %v", err)
+		}
+		opts.Synergy = BuildSynergyMatrix(records)
+	}
+	return nil
+}
+
+// Create the match for a split and store its teams as the channel's lobby
+func formLobby(db *DB, guildID, channelID, voiceChannelID string, split *TeamSplit) (*Lobby, error) {
+	matchID, err := db.CreateMatch(guildID, split.Team1, split.Team2, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create match: %v", err)
+	}
+	lobby := &Lobby{
+		GuildID:        guildID,
+		ChannelID:      channelID,
+		VoiceChannelID: voiceChannelID,
+		Team1:          split.Team1,
+		Team2:          split.Team2,
+		MatchID:        matchID,
+	}
+	if err := NewTeamStorage(db, 48*time.Hour).StoreTeams(lobby); err != nil {
+		return nil, fmt.Errorf("failed to store teams: %v", err)
+	}
+	return lobby, nil
+}
+
+// Send the team compositions of a freshly formed lobby
+func announceLobby(s *discordgo.Session, channelID string, lobby *Lobby, split *TeamSplit) {
+	s.ChannelMessageSend(channelID, fmt.Sprintf("Lobby %d, match %d\n%s", lobby.LobbyID, lobby.MatchID, describeSplit(split)))
+}
+
+// Describe the teams of a split with their win chances and repeated pairings
+func describeSplit(split *TeamSplit) string {
+	description := fmt.Sprintf("Team 1 (%.0f%% to win): %v\nTeam 2 (%.0f%% to win): %v",
+		split.Team1WinChance*100, getTeamNames(split.Team1), split.Team2WinChance()*100, getTeamNames(split.Team2))
+	if split.RepeatedPairs >= 0 {
+		description += fmt.Sprintf("\nTeammate pairs repeated from the last game: %d", split.RepeatedPairs)
+	}
+	return description
 }
 
 func handleWinCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
@@ -233,51 +428,348 @@ func handleWinCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []s
 		s.ChannelMessageSend(m.ChannelID, "Invalid team. Use team1 or team2.")
 		return
 	}
+	reportResult(s, m, args[2:], db, winningTeam)
+}
+
+// Command to report a tied match: `!draw [map] [12-12] [lobby]`
+func handleDrawCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	reportResult(s, m, args[1:], db, drawResult)
+}
+
+// Report the result of the lobby the arguments refer to and ask the other
+// side to confirm it. The map and a round score such as 13-7 may be among args.
+func reportResult(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB, winningTeam int) {
+	var winnerScore, loserScore int
+	var mapName string
+	var lobbyArgs []string
+	for _, arg := range args {
+		if name, ok := parseMapName(arg); ok {
+			mapName = name
+			continue
+		}
+		if strings.ContainsAny(arg, "-:") && !strings.HasPrefix(arg, "<") {
+			var err error
+			winnerScore, loserScore, err = parseScore(arg, winningTeam == drawResult)
+			if err != nil {
+				s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+				return
+			}
+			continue
+		}
+		lobbyArgs = append(lobbyArgs, arg)
+	}
 
-	// Retrieve stored teams from the database
+	// Retrieve the lobby's stored teams from the database
 	ts := NewTeamStorage(db, 48*time.Hour)
-	team1, team2, err := ts.GetStoredTeams()
+	lobby, err := findLobbyForCommand(s, m, lobbyArgs, ts)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v. Please run `!teams` to form new teams.", err))
 		return
 	}
+	matchID := lobby.MatchID
 
-	// Assign winner and loser teams based on the winning team
-	var winnerTeam, loserTeam *Team
-	if winningTeam == 1 {
-		winnerTeam = team1
-		loserTeam = team2
-	} else {
-		winnerTeam = team2
-		loserTeam = team1
+	// The same teams can play again; start a new match once the last one is settled
+	match, err := db.GetMatch(matchID)
+	if err == nil && (match.Status == MatchStatusPending || match.Status == MatchStatusDisputed || match.Status == MatchStatusConfirmed) {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d already has a result (%s). Confirm it, or ask an admin to `!void %d` it first.", matchID, match.Status, matchID))
+		return
+	}
+	if err != nil || match.Status == MatchStatusFinalized || match.Status == MatchStatusVoided {
+		matchID, err = db.CreateMatch(lobby.GuildID, lobby.Team1, lobby.Team2, m.ChannelID)
+		if err == nil {
+			err = db.SetLobbyMatch(lobby.LobbyID, matchID)
+		}
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error creating match: %v", err))
+			return
+		}
+	}
+
+	// Record the result; ratings are applied once the losing team confirms it
+	err = db.ReportScoredMatchResult(matchID, winningTeam, winnerScore, loserScore)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error reporting match: %v", err))
+		return
 	}
+	if mapName != "" {
+		if err := db.SetMatchMap(matchID, mapName); err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error storing map: %v", err))
+			return
+		}
+	}
+	match, err = db.GetMatch(matchID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading match: %v", err))
+		return
+	}
+	cfg, err := db.GetGuildConfig(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading settings: %v", err))
+		return
+	}
+
+	sendResultConfirmationPrompt(s, m.ChannelID, match, cfg)
+	sendMatchReportPrompt(s, m.ChannelID, matchID, cfg)
+}
+
+// Resolve the lobby a command refers to, from an explicit lobby ID among the
+// arguments or from the caller's voice and text channel
+func findLobbyForCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, ts *TeamStorage) (*Lobby, error) {
+	for _, arg := range args {
+		if lobbyID, err := strconv.Atoi(strings.TrimPrefix(arg, "#")); err == nil {
+			lobby, err := ts.GetLobby(lobbyID)
+			if err != nil {
+				return nil, err
+			}
+			if lobby.GuildID != m.GuildID {
+				return nil, fmt.Errorf("lobby %d not found", lobbyID)
+			}
+			return lobby, nil
+		}
+	}
+
+	voiceChannelID := getVoiceChannelIDForUser(s, m.GuildID, m.Author.ID)
+	return ts.FindLobby(m.GuildID, m.ChannelID, voiceChannelID)
+}
+
+// Command to list the lobbies currently running in the guild
+func lobbiesCommand(s *discordgo.Session, m *discordgo.MessageCreate, db *DB) {
+	ts := NewTeamStorage(db, 48*time.Hour)
+	lobbies, err := ts.GetLobbies(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error fetching lobbies: %v", err))
+		return
+	}
+	if len(lobbies) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "No lobbies are running. Use `!teams` to form teams.")
+		return
+	}
+
+	message := "Active lobbies:\n"
+	for _, lobby := range lobbies {
+		location := fmt.Sprintf("<#%s>", lobby.ChannelID)
+		if lobby.VoiceChannelID != "" {
+			location = fmt.Sprintf("<#%s>", lobby.VoiceChannelID)
+		}
+		message += fmt.Sprintf("Lobby %d (%s), match %d\n  Team 1: %v\n  Team 2: %v\n", lobby.LobbyID, location, lobby.MatchID, getTeamNames(lobby.Team1), getTeamNames(lobby.Team2))
+	}
+	s.ChannelMessageSend(m.ChannelID, message)
+}
+
+// Command to mark the lobby's match as being played
+func startMatchCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	ts := NewTeamStorage(db, 48*time.Hour)
+	lobby, err := findLobbyForCommand(s, m, args[1:], ts)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v. Please run `!teams` to form new teams.", err))
+		return
+	}
+	matchID := lobby.MatchID
 
-	// Create a Match instance
-	match := &Match{
-		Winner: winnerTeam,
-		Loser:  loserTeam,
-		db:     db,
+	if err := db.TransitionMatch(matchID, MatchStatusLive); err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error starting match: %v", err))
+		return
 	}
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d is live. Good luck!", matchID))
+}
 
-	// Save the match result using the stored teams
-	matchID, err := match.SaveMatch(db)
+// Command for admins to accept a pending or disputed result
+func confirmMatchCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	if !isAdmin(s, m.ChannelID, m.Author.ID) {
+		s.ChannelMessageSend(m.ChannelID, "Only admins can confirm disputed matches.")
+		return
+	}
+
+	if len(args) < 2 {
+		s.ChannelMessageSend(m.ChannelID, "Please specify the match ID, e.g. `!confirm 42`.")
+		return
+	}
+	matchID, err := strconv.Atoi(args[1])
 	if err != nil {
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error saving match: %v", err))
+		s.ChannelMessageSend(m.ChannelID, "Invalid match ID.")
 		return
 	}
 
-	// Send an interactive message with a button to report stats
-	sendMatchReportPrompt(s, m.ChannelID, matchID)
+	if match, err := db.GetMatch(matchID); err != nil || match.GuildID != m.GuildID {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d not found.", matchID))
+		return
+	}
+	if _, err := ForceConfirmMatch(db, matchID); err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error confirming match: %v", err))
+		return
+	}
 
-	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d reported: Team %d won! Please report your stats using the button below.", matchID, winningTeam))
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d confirmed. Ratings updated with the stats reported so far.", matchID))
 }
 
 func handleEndSessionCommand(s *discordgo.Session, m *discordgo.MessageCreate, db *DB, args []string) {
-	// Clear stored teams
+	// Clear the lobby's stored teams
 	ts := NewTeamStorage(db, 48*time.Hour)
-	err := ts.ClearStoredTeams()
+	lobby, err := findLobbyForCommand(s, m, args[1:], ts)
+	if err == nil {
+		err = ts.ClearLobby(lobby.LobbyID)
+	}
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error clearing stored teams: %v", err))
 		return
 	}
 }
+
+// Command to void a wrongly reported match and roll back its rating changes
+func voidMatchCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	if !isAdmin(s, m.ChannelID, m.Author.ID) {
+		s.ChannelMessageSend(m.ChannelID, "Only admins can void matches.")
+		return
+	}
+
+	if len(args) < 2 {
+		s.ChannelMessageSend(m.ChannelID, "Please specify the match ID, e.g. `!void 42`.")
+		return
+	}
+	matchID, err := strconv.Atoi(args[1])
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Invalid match ID.")
+		return
+	}
+
+	match, err := VoidMatch(db, matchID, m.GuildID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d not found.", matchID))
+		} else {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error voiding match: %v", err))
+		}
+		return
+	}
+
+	team1, team2 := match.Teams()
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d has been voided and its rating changes reverted.\nTeams restored in lobby %d:\nTeam 1: %v\nTeam 2: %v\nUse `!win team1 %d`, `!win team2 %d` or `!draw %d` to report the correct result.",
+		matchID, match.LobbyID, getTeamNames(team1), getTeamNames(team2), match.LobbyID, match.LobbyID, match.LobbyID))
+}
+
+// Command to take over the players kept from before per-guild ladders when
+// the bot could not tell which guild they belong to
+func claimLadderCommand(s *discordgo.Session, m *discordgo.MessageCreate, db *DB) {
+	if !isAdmin(s, m.ChannelID, m.Author.ID) {
+		s.ChannelMessageSend(m.ChannelID, "Only admins can claim the ladder.")
+		return
+	}
+	claimed, err := db.ClaimLegacyData(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	if claimed == 0 {
+		s.ChannelMessageSend(m.ChannelID, "There is no unclaimed ladder.")
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Moved %d players and their matches into this server's ladder.", claimed))
+}
+
+// Command to recompute the guild's ratings from match history, dry run unless "apply" is given
+func replayCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	if !isAdmin(s, m.ChannelID, m.Author.ID) {
+		s.ChannelMessageSend(m.ChannelID, "Only admins can replay match history.")
+		return
+	}
+
+	apply := len(args) > 1 && strings.ToLower(args[1]) == "apply"
+
+	rs, err := db.GetRatingSystem(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading rating system: %v", err))
+		return
+	}
+	report, err := ReplayRatings(db, m.GuildID, rs, apply)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error replaying matches: %v", err))
+		return
+	}
+
+	message := report.Format(25)
+	if !apply {
+		message += "\nRun `!replay apply` to store these ratings."
+	}
+	s.ChannelMessageSend(m.ChannelID, message)
+}
+
+// Command for admins to show or change the guild's settings
+func settingsCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	if len(args) > 1 {
+		if !isAdmin(s, m.ChannelID, m.Author.ID) {
+			s.ChannelMessageSend(m.ChannelID, "Only admins can change settings.")
+			return
+		}
+		if len(args) < 3 {
+			s.ChannelMessageSend(m.ChannelID, "Please specify a value, e.g. `!settings rating_system glicko2`, or `default` to reset it.")
+			return
+		}
+
+		var err error
+		if strings.ToLower(args[2]) == "default" {
+			err = db.ResetGuildSetting(m.GuildID, args[1])
+		} else {
+			err = db.SetGuildSetting(m.GuildID, args[1], args[2])
+		}
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error changing setting: %v", err))
+			return
+		}
+	}
+
+	cfg, err := db.GetGuildConfig(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading settings: %v", err))
+		return
+	}
+
+	message := "Settings for this server:\n"
+	for _, setting := range guildSettings {
+		message += fmt.Sprintf("`%s` = %s (%s)\n", setting.Key, setting.get(cfg), setting.Description)
+	}
+	s.ChannelMessageSend(m.ChannelID, message)
+}
+
+// Command to toggle the sniper role the balancer spreads across teams.
+// Players toggle their own flag; admins can toggle it for a mentioned player.
+func sniperCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB, discordInstance *Discord) {
+	playerID := m.Author.ID
+	if len(args) > 1 {
+		userID, ok := parseUserMention(args[1])
+		if !ok {
+			s.ChannelMessageSend(m.ChannelID, "Invalid user mention. Please mention a user like @username.")
+			return
+		}
+		if userID != m.Author.ID && !isAdmin(s, m.ChannelID, m.Author.ID) {
+			s.ChannelMessageSend(m.ChannelID, "Only admins can change the sniper role of other players.")
+			return
+		}
+		playerID = userID
+	}
+
+	player, err := db.GetPlayer(m.GuildID, playerID)
+	if err == sql.ErrNoRows {
+		playerName, nameErr := discordInstance.GetPlayerName(playerID)
+		if nameErr != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error getting player name: %v", nameErr))
+			return
+		}
+		player, err = NewPlayer(m.GuildID, playerID, playerName), nil
+	}
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error getting player: %v", err))
+		return
+	}
+
+	player.Sniper = !player.Sniper
+	if err := db.SavePlayer(player); err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error saving player: %v", err))
+		return
+	}
+
+	if player.Sniper {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s is now a sniper. Snipers are spread across teams when balancing.", player.PlayerName))
+	} else {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s is no longer a sniper.", player.PlayerName))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds bot settings that can be overridden through the environment
+type Config struct {
+	// RatingSystem selects the rating engine, see NewRatingSystem
+	RatingSystem string
+	// MarginOfVictory scales rating changes by the round difference of scored matches
+	MarginOfVictory bool
+	// ResultConfirmations is how many losing players, or players of each team for
+	// a draw, must confirm a reported result
+	ResultConfirmations int
+	// ResultConfirmTimeout is how long a result waits before it is confirmed automatically
+	ResultConfirmTimeout time.Duration
+	// StatsDeadline is how long players have to report their stats once a
+	// result is confirmed before the match is rated without them
+	StatsDeadline time.Duration
+	// ReviewChannelID is where suspicious stats are flagged for admins, the
+	// match's own channel when empty
+	ReviewChannelID string
+	// TeamVoteTimeout is how long players can vote on the proposed team splits
+	TeamVoteTimeout time.Duration
+	// DraftPickTimeout is how long a captain has for each pick in a draft
+	DraftPickTimeout time.Duration
+	// VarietyWeight is the win chance gap the balancer accepts to avoid
+	// repeating the teammates of the last VarietyMatches matches
+	VarietyWeight  float64
+	VarietyMatches int
+	// SynergyWeight is the win chance gap the balancer accepts to split up all
+	// players who win unusually often together, 0 to ignore synergy. Stronger
+	// duos weigh more of it than weaker ones.
+	SynergyWeight float64
+	// QueueSize is how many players a match takes: the size of a queue's ready
+	// check, and how many play when more are in a voice channel
+	QueueSize int
+	// ReadyCheckTimeout is how long queued players have to accept a ready check
+	ReadyCheckTimeout time.Duration
+	// SessionTimeout is how long a voice channel can go without a game before
+	// its sit-out counts start over
+	SessionTimeout time.Duration
+	// MaxSnipers is how many snipers the balancer puts on one team, 0 for no limit
+	MaxSnipers int
+	// LegacyGuildID is the guild that data from before per-guild ladders belongs to
+	LegacyGuildID string
+}
+
+// config is the active configuration, replaced by LoadConfig on startup.
+// Guilds can override most of it, see GetGuildConfig.
+var config = DefaultConfig()
+
+func DefaultConfig() *Config {
+	return &Config{
+		RatingSystem:         "elo",
+		ResultConfirmations:  2,
+		ResultConfirmTimeout: 30 * time.Minute,
+		StatsDeadline:        15 * time.Minute,
+		TeamVoteTimeout:      2 * time.Minute,
+		DraftPickTimeout:     30 * time.Second,
+		VarietyWeight:        0.05,
+		VarietyMatches:       3,
+		SynergyWeight:        0,
+		QueueSize:            10,
+		ReadyCheckTimeout:    time.Minute,
+		SessionTimeout:       6 * time.Hour,
+		MaxSnipers:           1,
+	}
+}
+
+// LoadConfig reads the configuration from environment variables, falling back to defaults
+func LoadConfig() *Config {
+	cfg := DefaultConfig()
+	if v := os.Getenv("RATING_SYSTEM"); v != "" {
+		cfg.RatingSystem = v
+	}
+	cfg.MarginOfVictory = getEnvBool("MARGIN_OF_VICTORY", cfg.MarginOfVictory)
+	cfg.ResultConfirmations = getEnvInt("RESULT_CONFIRMATIONS", cfg.ResultConfirmations)
+	cfg.ResultConfirmTimeout = getEnvDuration("RESULT_CONFIRM_TIMEOUT", cfg.ResultConfirmTimeout)
+	cfg.StatsDeadline = getEnvDuration("STATS_DEADLINE", cfg.StatsDeadline)
+	cfg.ReviewChannelID = os.Getenv("REVIEW_CHANNEL_ID")
+	cfg.TeamVoteTimeout = getEnvDuration("TEAM_VOTE_TIMEOUT", cfg.TeamVoteTimeout)
+	cfg.DraftPickTimeout = getEnvDuration("DRAFT_PICK_TIMEOUT", cfg.DraftPickTimeout)
+	cfg.VarietyWeight = getEnvFloat("VARIETY_WEIGHT", cfg.VarietyWeight)
+	cfg.VarietyMatches = getEnvInt("VARIETY_MATCHES", cfg.VarietyMatches)
+	cfg.SynergyWeight = getEnvFloat("SYNERGY_WEIGHT", cfg.SynergyWeight)
+	if n := getEnvInt("QUEUE_SIZE", cfg.QueueSize); n >= 2 && n%2 == 0 {
+		cfg.QueueSize = n
+	} else {
+		log.Printf("Invalid value %d for QUEUE_SIZE, expected an even number of at least 2, using %d", n, cfg.QueueSize)
+	}
+	cfg.ReadyCheckTimeout = getEnvDuration("READY_CHECK_TIMEOUT", cfg.ReadyCheckTimeout)
+	cfg.SessionTimeout = getEnvDuration("SESSION_TIMEOUT", cfg.SessionTimeout)
+	cfg.MaxSnipers = getEnvInt("MAX_SNIPERS", cfg.MaxSnipers)
+	cfg.LegacyGuildID = os.Getenv("LEGACY_GUILD_ID")
+	return cfg
+}
+
+func getEnvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %d", v, key, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %t", v, key, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %g", v, key, fallback)
+		return fallback
+	}
+	return f
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %s", v, key, fallback)
+		return fallback
+	}
+	return d
+}
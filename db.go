@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"log"
 	_ "modernc.org/sqlite"
 	"strings"
 	"time"
@@ -12,6 +13,37 @@ type DB struct {
 	db *sql.DB
 }
 
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Schema of the players table, shared with the migration that rebuilds it per guild
+const playersTableSchema = `(
+	GuildID TEXT,
+	PlayerID TEXT,
+	PlayerName TEXT,
+	CoreMember INTEGER,
+	Mmr INTEGER,
+	GamesPlayed INTEGER,
+	Wins INTEGER,
+	Kills INTEGER,
+	Assists INTEGER,
+	Deaths INTEGER,
+	Sniper BOOLEAN DEFAULT FALSE,
+	RatingDeviation REAL DEFAULT 350,
+	Volatility REAL DEFAULT 0.06,
+	LastPlayed DATETIME,
+	Mu REAL DEFAULT 0,
+	Sigma REAL DEFAULT 0,
+	PRIMARY KEY (GuildID, PlayerID)
+)`
+
 func InitDB(dbName string) (*DB, error) {
 	var err error
 	db := &DB{}
@@ -22,24 +54,24 @@ func InitDB(dbName string) (*DB, error) {
 
 	// Create tables
 	_, err = db.db.Exec(`
-		CREATE TABLE IF NOT EXISTS players (
-			PlayerID TEXT PRIMARY KEY,
-			PlayerName TEXT,
-			CoreMember INTEGER,
-			Mmr INTEGER,
-			GamesPlayed INTEGER,
-			Wins INTEGER,
-			Kills INTEGER,
-			Assists INTEGER,
-			Deaths INTEGER,
-			Sniper BOOLEAN DEFAULT FALSE
-		);
+		CREATE TABLE IF NOT EXISTS players ` + playersTableSchema + `;
 		CREATE TABLE IF NOT EXISTS matches (
 			MatchID INTEGER PRIMARY KEY AUTOINCREMENT,
+			GuildID TEXT,
 			Winner TEXT,
 			Loser TEXT,
-			FOREIGN KEY (Winner) REFERENCES players(PlayerID),
-			FOREIGN KEY (Loser) REFERENCES players(PlayerID)
+			Timestamp DATETIME,
+			Status TEXT DEFAULT 'finalized',
+			Team1 TEXT,
+			Team2 TEXT,
+			WinningTeam INTEGER,
+			ReportedAt DATETIME,
+			ChannelID TEXT,
+			LobbyID INTEGER,
+			Team1Score INTEGER,
+			Team2Score INTEGER,
+			Map TEXT,
+			ConfirmedAt DATETIME
 		);
 		CREATE TABLE IF NOT EXISTS player_performances (
 			PerformanceID INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -48,32 +80,298 @@ func InitDB(dbName string) (*DB, error) {
 			Kills INTEGER,
 			Assists INTEGER,
 			Deaths INTEGER,
-			FOREIGN KEY (MatchID) REFERENCES matches(MatchID),
-			FOREIGN KEY (PlayerID) REFERENCES players(PlayerID)
+			FOREIGN KEY (MatchID) REFERENCES matches(MatchID)
 		);
 		CREATE TABLE IF NOT EXISTS mmr_history (
 			ID INTEGER PRIMARY KEY AUTOINCREMENT,
+			GuildID TEXT,
 			PlayerID TEXT,
 			Mmr INTEGER,
 			MatchID INTEGER,
 			Timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY(PlayerID) REFERENCES players(PlayerID),
+			Deviation REAL,
+			Volatility REAL,
+			Mu REAL,
+			Sigma REAL,
+			FOREIGN KEY(GuildID, PlayerID) REFERENCES players(GuildID, PlayerID),
 			FOREIGN KEY(MatchID) REFERENCES matches(MatchID)
 		);
-		CREATE TABLE IF NOT EXISTS temp_teams (
-			id INTEGER PRIMARY KEY,
-			team1 TEXT,
-			team2 TEXT,
-			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+		CREATE TABLE IF NOT EXISTS lobbies (
+			LobbyID INTEGER PRIMARY KEY AUTOINCREMENT,
+			GuildID TEXT,
+			ChannelID TEXT,
+			VoiceChannelID TEXT,
+			Team1 TEXT,
+			Team2 TEXT,
+			MatchID INTEGER,
+			Timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (MatchID) REFERENCES matches(MatchID)
+		);
+		CREATE TABLE IF NOT EXISTS match_confirmations (
+			MatchID INTEGER,
+			PlayerID TEXT,
+			Timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (MatchID, PlayerID),
+			FOREIGN KEY (MatchID) REFERENCES matches(MatchID)
+		);
+		CREATE TABLE IF NOT EXISTS guild_settings (
+			GuildID TEXT,
+			Key TEXT,
+			Value TEXT,
+			PRIMARY KEY (GuildID, Key)
+		);
+		CREATE TABLE IF NOT EXISTS queue (
+			QueueID INTEGER PRIMARY KEY AUTOINCREMENT,
+			GuildID TEXT,
+			ChannelID TEXT,
+			PlayerID TEXT,
+			JoinedAt DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (ChannelID, PlayerID)
+		);
+		CREATE TABLE IF NOT EXISTS substitutions (
+			SubstitutionID INTEGER PRIMARY KEY AUTOINCREMENT,
+			MatchID INTEGER,
+			OutPlayerID TEXT,
+			InPlayerID TEXT,
+			Round INTEGER,
+			Timestamp DATETIME,
+			FOREIGN KEY (MatchID) REFERENCES matches(MatchID)
+		);
+		CREATE TABLE IF NOT EXISTS player_stat_values (
+			MatchID INTEGER,
+			PlayerID TEXT,
+			Stat TEXT,
+			Value REAL,
+			PRIMARY KEY (MatchID, PlayerID, Stat),
+			FOREIGN KEY (MatchID) REFERENCES matches(MatchID)
+		);
+		CREATE TABLE IF NOT EXISTS performance_edits (
+			EditID INTEGER PRIMARY KEY AUTOINCREMENT,
+			MatchID INTEGER,
+			PlayerID TEXT,
+			EditorID TEXT,
+			Previous TEXT,
+			Stats TEXT,
+			Timestamp DATETIME,
+			FOREIGN KEY (MatchID) REFERENCES matches(MatchID)
+		);
+		CREATE TABLE IF NOT EXISTS sit_outs (
+			GuildID TEXT,
+			VoiceChannelID TEXT,
+			PlayerID TEXT,
+			SitOuts INTEGER DEFAULT 0,
+			SatOutLast BOOLEAN DEFAULT FALSE,
+			UpdatedAt DATETIME,
+			PRIMARY KEY (GuildID, VoiceChannelID, PlayerID)
 		);
 	`)
 	if err != nil {
 		return nil, fmt.Errorf("error creating tables: %v", err)
 	}
 
+	if err = db.migrate(); err != nil {
+		return nil, fmt.Errorf("error migrating database: %v", err)
+	}
+
 	return db, nil
 }
 
+// Columns added after the first release, created on databases that predate them
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"players", "RatingDeviation", "REAL DEFAULT 350"},
+	{"players", "Volatility", "REAL DEFAULT 0.06"},
+	{"players", "LastPlayed", "DATETIME"},
+	{"matches", "Timestamp", "DATETIME"},
+	{"mmr_history", "Deviation", "REAL"},
+	{"mmr_history", "Volatility", "REAL"},
+	{"players", "Mu", "REAL DEFAULT 0"},
+	{"players", "Sigma", "REAL DEFAULT 0"},
+	{"mmr_history", "Mu", "REAL"},
+	{"mmr_history", "Sigma", "REAL"},
+	{"matches", "Status", "TEXT DEFAULT 'finalized'"},
+	{"matches", "Team1", "TEXT"},
+	{"matches", "Team2", "TEXT"},
+	{"matches", "WinningTeam", "INTEGER"},
+	{"matches", "ReportedAt", "DATETIME"},
+	{"matches", "ChannelID", "TEXT"},
+	{"matches", "LobbyID", "INTEGER"},
+	{"matches", "GuildID", "TEXT"},
+	{"mmr_history", "GuildID", "TEXT"},
+	{"matches", "Team1Score", "INTEGER"},
+	{"matches", "Team2Score", "INTEGER"},
+	{"matches", "Map", "TEXT"},
+	{"matches", "ConfirmedAt", "DATETIME"},
+}
+
+// Bring an existing database schema up to date
+func (db *DB) migrate() error {
+	for _, m := range columnMigrations {
+		exists, err := db.hasColumn(m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = db.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition))
+		if err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %v", m.table, m.column, err)
+		}
+	}
+
+	// Matches stored before teams were recorded separately were all won by the first team
+	_, err := db.db.Exec(`
+		UPDATE matches SET Team1 = Winner, Team2 = Loser, WinningTeam = 1
+		WHERE Team1 IS NULL AND Winner IS NOT NULL
+	`)
+	if err != nil {
+		return err
+	}
+
+	// The single global set of stored teams was replaced by per-channel lobbies.
+	// The old teams have no guild, channel or match to form a lobby from, so
+	// they are logged for admins to form again with !teams.
+	if err := db.logStoredTeams(); err != nil {
+		return fmt.Errorf("failed to read the stored teams: %v", err)
+	}
+	_, err = db.db.Exec("DROP TABLE IF EXISTS temp_teams")
+	if err != nil {
+		return err
+	}
+
+	if err := db.migratePerformances(); err != nil {
+		return fmt.Errorf("failed to deduplicate performances: %v", err)
+	}
+
+	return db.migrateToGuilds()
+}
+
+// Log the teams stored before lobbies, if any are left
+func (db *DB) logStoredTeams() error {
+	var exists int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'temp_teams'").Scan(&exists)
+	if err != nil || exists == 0 {
+		return err
+	}
+
+	rows, err := db.db.Query("SELECT team1, team2, timestamp FROM temp_teams")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var team1, team2, timestamp sql.NullString
+		if err := rows.Scan(&team1, &team2, &timestamp); err != nil {
+			return err
+		}
+		log.Printf("Dropping teams stored before lobbies at %s: %s vs %s", timestamp.String, team1.String, team2.String)
+	}
+	return rows.Err()
+}
+
+// Guild that data from before per-guild ladders is kept in until a guild
+// claims it, when LEGACY_GUILD_ID does not name the guild it belongs to
+const unclaimedGuildID = "unclaimed"
+
+// Move data from before per-guild ladders into the guild the bot was first
+// deployed in, or into unclaimedGuildID when it is not known. Players are
+// keyed by (guild, user), so their table is rebuilt.
+func (db *DB) migrateToGuilds() error {
+	hasGuild, err := db.hasColumn("players", "GuildID")
+	if err != nil || hasGuild {
+		return err
+	}
+
+	guildID := config.LegacyGuildID
+	if guildID == "" {
+		log.Printf("LEGACY_GUILD_ID is not set, keeping existing players until a guild claims them")
+		guildID = unclaimedGuildID
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	columns := strings.TrimPrefix(playerColumns, "GuildID, ")
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"CREATE TABLE players_by_guild " + playersTableSchema, nil},
+		{fmt.Sprintf("INSERT INTO players_by_guild (GuildID, %s) SELECT ?, %s FROM players", columns, columns), []interface{}{guildID}},
+		{"DROP TABLE players", nil},
+		{"ALTER TABLE players_by_guild RENAME TO players", nil},
+		{"UPDATE matches SET GuildID = ? WHERE GuildID IS NULL", []interface{}{guildID}},
+		{"UPDATE mmr_history SET GuildID = ? WHERE GuildID IS NULL", []interface{}{guildID}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return fmt.Errorf("failed to migrate to per-guild ladders: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Move the data kept in unclaimedGuildID into a guild and return how many
+// players were moved. A guild that already has players of its own cannot
+// claim it, as the two ladders cannot be merged.
+func (db *DB) ClaimLegacyData(guildID string) (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var unclaimed, existing int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM players WHERE GuildID = ?", unclaimedGuildID).Scan(&unclaimed); err != nil {
+		return 0, err
+	}
+	if unclaimed == 0 {
+		return 0, nil
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM players WHERE GuildID = ?", guildID).Scan(&existing); err != nil {
+		return 0, err
+	}
+	if existing > 0 {
+		return 0, fmt.Errorf("guild %s already has a ladder of its own", guildID)
+	}
+
+	for _, table := range []string{"players", "matches", "mmr_history"} {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET GuildID = ? WHERE GuildID = ?", table), guildID, unclaimedGuildID); err != nil {
+			return 0, fmt.Errorf("failed to claim %s: %v", table, err)
+		}
+	}
+	return unclaimed, tx.Commit()
+}
+
+// Check whether a table already has the given column
+func (db *DB) hasColumn(table, column string) (bool, error) {
+	rows, err := db.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(name, column) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 func (db *DB) Close() error {
 	if db.db != nil {
 		return db.db.Close()
@@ -83,10 +381,14 @@ func (db *DB) Close() error {
 
 // Save a player to the database
 func (db *DB) SavePlayer(player *Player) error {
+	return savePlayer(db.db, player)
+}
+
+func savePlayer(exec execer, player *Player) error {
 	query := `
-        INSERT INTO players (PlayerID, PlayerName, CoreMember, Mmr, GamesPlayed, Wins, Kills, Assists, Deaths, Sniper)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-        ON CONFLICT(PlayerID) DO UPDATE SET 
+        INSERT INTO players (GuildID, PlayerID, PlayerName, CoreMember, Mmr, GamesPlayed, Wins, Kills, Assists, Deaths, Sniper, RatingDeviation, Volatility, LastPlayed, Mu, Sigma)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(GuildID, PlayerID) DO UPDATE SET
             PlayerName = excluded.PlayerName,
             CoreMember = excluded.CoreMember,
             Mmr = excluded.Mmr,
@@ -95,129 +397,303 @@ func (db *DB) SavePlayer(player *Player) error {
             Kills = excluded.Kills,
             Assists = excluded.Assists,
             Deaths = excluded.Deaths,
-            Sniper = excluded.Sniper;
+            Sniper = excluded.Sniper,
+            RatingDeviation = excluded.RatingDeviation,
+            Volatility = excluded.Volatility,
+            LastPlayed = excluded.LastPlayed,
+            Mu = excluded.Mu,
+            Sigma = excluded.Sigma;
     `
 	args := []interface{}{
-		player.PlayerID, player.PlayerName, player.CoreMember, player.MMR,
+		player.GuildID, player.PlayerID, player.PlayerName, player.CoreMember, player.MMR,
 		player.GamesPlayed, player.Wins, player.Kills, player.Assists,
-		player.Deaths, player.Sniper,
+		player.Deaths, player.Sniper, player.RatingDeviation, player.Volatility,
+		nullTime(player.LastPlayed), player.Mu, player.Sigma,
 	}
 
-	if len(args) != 10 {
-		return fmt.Errorf("expected 10 arguments, got %d", len(args))
+	if len(args) != 16 {
+		return fmt.Errorf("expected 16 arguments, got %d", len(args))
 	}
 
-	_, err := db.db.Exec(query, args...)
+	_, err := exec.Exec(query, args...)
 	return err
 }
 
-// Save individual player performance to the database
-func (db *DB) SavePlayerPerformance(matchID int, player *Player) error {
-	_, err := db.db.Exec(`
-		INSERT INTO player_performances (MatchID, PlayerID, Kills, Assists, Deaths)
-		VALUES (?, ?, ?, ?, ?)
-	`, matchID, player.PlayerID, player.Kills, player.Assists, player.Deaths)
-	return err
+// Save individual player performance for a single match to the database
+func (db *DB) SavePlayerPerformance(matchID int, playerID string, stats PlayerStats) error {
+	return upsertPerformance(db.db, matchID, playerID, stats)
 }
 
-// Retrieve a player from the database
-func (db *DB) GetPlayer(playerID string) (*Player, error) {
+const playerColumns = "GuildID, PlayerID, PlayerName, CoreMember, Mmr, GamesPlayed, Wins, Kills, Assists, Deaths, Sniper, RatingDeviation, Volatility, LastPlayed, Mu, Sigma"
+
+func scanPlayer(row scanner) (*Player, error) {
 	var player Player
-	err := db.db.QueryRow(`
-		SELECT PlayerID, PlayerName, CoreMember, Mmr, GamesPlayed, Wins, Kills, Assists, Deaths, Sniper FROM players WHERE PlayerID = ?
-	`, playerID).Scan(
-		&player.PlayerID, &player.PlayerName, &player.CoreMember, &player.MMR, &player.GamesPlayed, &player.Wins, &player.Kills, &player.Assists, &player.Deaths, &player.Sniper,
+	var lastPlayed sql.NullTime
+	err := row.Scan(
+		&player.GuildID, &player.PlayerID, &player.PlayerName, &player.CoreMember, &player.MMR, &player.GamesPlayed, &player.Wins, &player.Kills, &player.Assists, &player.Deaths, &player.Sniper, &player.RatingDeviation, &player.Volatility, &lastPlayed, &player.Mu, &player.Sigma,
 	)
 	if err != nil {
 		return nil, err
 	}
+	player.LastPlayed = lastPlayed.Time
 	return &player, nil
 }
 
-// Save a match to the database and individual player performances
+// Retrieve a player of a guild's ladder from the database
+func (db *DB) GetPlayer(guildID, playerID string) (*Player, error) {
+	return scanPlayer(db.db.QueryRow("SELECT "+playerColumns+" FROM players WHERE GuildID = ? AND PlayerID = ?", guildID, playerID))
+}
+
+// Retrieve every player of a guild's ladder from the database
+func (db *DB) GetAllPlayers(guildID string) ([]*Player, error) {
+	rows, err := db.db.Query("SELECT "+playerColumns+" FROM players WHERE GuildID = ? ORDER BY PlayerID", guildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var players []*Player
+	for rows.Next() {
+		player, err := scanPlayer(rows)
+		if err != nil {
+			return nil, err
+		}
+		players = append(players, player)
+	}
+	return players, rows.Err()
+}
+
+// Save a finished match to the database and individual player performances
 func (db *DB) SaveMatch(match *Match) (int, error) {
 	winnerIds := match.Winner.GetPlayerIDs()
 	loserIds := match.Loser.GetPlayerIDs()
 
+	// A draw has no winner, only the two teams
+	winningTeam := 1
+	winner, loser := sql.NullString{String: winnerIds, Valid: true}, sql.NullString{String: loserIds, Valid: true}
+	if match.Draw {
+		winningTeam = drawResult
+		winner.Valid, loser.Valid = false, false
+	}
+
 	// Perform the database operation to save the basic match result (team IDs, winner)
 	result, err := db.db.Exec(`
-		INSERT INTO matches (Winner, Loser)
-		VALUES (?, ?)
-	`, winnerIds, loserIds)
+		INSERT INTO matches (GuildID, Winner, Loser, Team1, Team2, WinningTeam, Timestamp, Status, Team1Score, Team2Score, Map)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, match.GuildID, winner, loser, winnerIds, loserIds, winningTeam, nullTime(match.Timestamp), MatchStatusFinalized,
+		nullScore(match, match.WinnerScore), nullScore(match, match.LoserScore), sql.NullString{String: match.Map, Valid: match.Map != ""})
 	if err != nil {
 		return 0, err
 	}
 
 	// Get the match ID for player performance association
 	matchID, _ := result.LastInsertId()
+	match.MatchID = int(matchID)
+
+	if err := db.SaveMatchPerformances(match); err != nil {
+		return 0, err
+	}
+
+	return int(matchID), nil
+}
 
-	// Save individual performances for Team 1 players
-	for _, player := range match.Winner.Players {
-		err := db.SavePlayerPerformance(int(matchID), player)
+// Save the individual performances recorded with a match, including those of
+// players who were substituted. Players without stats get no performance.
+func (db *DB) SaveMatchPerformances(match *Match) error {
+	for _, player := range match.players() {
+		stats, ok := match.Performances[player.PlayerID]
+		if !ok {
+			continue
+		}
+		err := db.SavePlayerPerformance(match.MatchID, player.PlayerID, stats)
 		if err != nil {
-			return 0, err
+			return err
 		}
 	}
+	return nil
+}
+
+// Create a match for freshly formed teams, before any result is known
+func (db *DB) CreateMatch(guildID string, team1, team2 *Team, channelID string) (int, error) {
+	result, err := db.db.Exec(`
+		INSERT INTO matches (GuildID, Team1, Team2, Timestamp, Status, ChannelID)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, guildID, team1.GetPlayerIDs(), team2.GetPlayerIDs(), time.Now().UTC(), MatchStatusCreated, channelID)
+	if err != nil {
+		return 0, err
+	}
+	matchID, err := result.LastInsertId()
+	return int(matchID), err
+}
+
+// Store a lobby's teams, replacing the lobby already running in the same
+// voice channel (or the same text channel when no voice channel is used)
+func (db *DB) StoreLobby(lobby *Lobby) error {
+	team1IDs := lobby.Team1.GetPlayerIDs()
+	team2IDs := lobby.Team2.GetPlayerIDs()
 
-	// Save individual performances for Team 2 players
-	for _, player := range match.Loser.Players {
-		err := db.SavePlayerPerformance(int(matchID), player)
+	// A voice channel plays one game at a time, so its lobby is reused. Queue
+	// games have no voice channel and several can run from one text channel,
+	// so each gets a new lobby; the ones whose match is settled are dropped.
+	if lobby.LobbyID == 0 && lobby.VoiceChannelID != "" {
+		err := db.db.QueryRow("SELECT LobbyID FROM lobbies WHERE GuildID = ? AND VoiceChannelID = ?", lobby.GuildID, lobby.VoiceChannelID).Scan(&lobby.LobbyID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if lobby.LobbyID == 0 && lobby.VoiceChannelID == "" {
+		_, err := db.db.Exec(`
+			DELETE FROM lobbies WHERE GuildID = ? AND ChannelID = ? AND VoiceChannelID = ''
+			AND MatchID IN (SELECT MatchID FROM matches WHERE Status IN (?, ?))
+		`, lobby.GuildID, lobby.ChannelID, MatchStatusFinalized, MatchStatusVoided)
 		if err != nil {
-			return 0, err
+			return err
 		}
 	}
 
-	return int(matchID), nil
+	if lobby.LobbyID != 0 {
+		_, err := db.db.Exec(`
+			UPDATE lobbies SET ChannelID = ?, Team1 = ?, Team2 = ?, MatchID = ?, Timestamp = CURRENT_TIMESTAMP
+			WHERE LobbyID = ?
+		`, lobby.ChannelID, team1IDs, team2IDs, lobby.MatchID, lobby.LobbyID)
+		return err
+	}
+
+	result, err := db.db.Exec(`
+		INSERT INTO lobbies (GuildID, ChannelID, VoiceChannelID, Team1, Team2, MatchID, Timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, lobby.GuildID, lobby.ChannelID, lobby.VoiceChannelID, team1IDs, team2IDs, lobby.MatchID)
+	if err != nil {
+		return err
+	}
+	lobbyID, err := result.LastInsertId()
+	lobby.LobbyID = int(lobbyID)
+	return err
 }
 
-// Temporarily store teams in db
-func (db *DB) StoreTeams(team1, team2 *Team) error {
-	team1IDs := team1.GetPlayerIDs()
-	team2IDs := team2.GetPlayerIDs()
+// StoredLobby is a lobby row with its teams still as comma separated player IDs
+type StoredLobby struct {
+	LobbyID        int
+	GuildID        string
+	ChannelID      string
+	VoiceChannelID string
+	Team1IDs       string
+	Team2IDs       string
+	MatchID        int
+	Timestamp      time.Time
+}
 
-	_, err := db.db.Exec(`
-		INSERT INTO temp_teams (id, team1, team2, timestamp)
-		VALUES (1, ?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT(id) DO UPDATE SET team1 = ?, team2 = ?, timestamp = CURRENT_TIMESTAMP;
-	`, team1IDs, team2IDs, team1IDs, team2IDs)
+const lobbyColumns = "LobbyID, GuildID, ChannelID, VoiceChannelID, Team1, Team2, COALESCE(MatchID, 0), Timestamp"
+
+func scanLobby(row scanner) (*StoredLobby, error) {
+	var lobby StoredLobby
+	err := row.Scan(&lobby.LobbyID, &lobby.GuildID, &lobby.ChannelID, &lobby.VoiceChannelID, &lobby.Team1IDs, &lobby.Team2IDs, &lobby.MatchID, &lobby.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &lobby, nil
+}
+
+func (db *DB) GetLobby(lobbyID int) (*StoredLobby, error) {
+	return scanLobby(db.db.QueryRow("SELECT "+lobbyColumns+" FROM lobbies WHERE LobbyID = ?", lobbyID))
+}
+
+// Retrieve every lobby of a guild, oldest first
+func (db *DB) GetLobbies(guildID string) ([]*StoredLobby, error) {
+	rows, err := db.db.Query("SELECT "+lobbyColumns+" FROM lobbies WHERE GuildID = ? ORDER BY LobbyID", guildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lobbies []*StoredLobby
+	for rows.Next() {
+		lobby, err := scanLobby(rows)
+		if err != nil {
+			return nil, err
+		}
+		lobbies = append(lobbies, lobby)
+	}
+	return lobbies, rows.Err()
+}
+
+// Point a lobby at a new match, e.g. for a rematch with the same teams
+func (db *DB) SetLobbyMatch(lobbyID, matchID int) error {
+	_, err := db.db.Exec("UPDATE lobbies SET MatchID = ? WHERE LobbyID = ?", matchID, lobbyID)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("UPDATE matches SET LobbyID = ? WHERE MatchID = ?", lobbyID, matchID)
 	return err
 }
 
-func (db *DB) GetStoredTeams() (string, string, time.Time, error) {
-	var team1IDs, team2IDs string
-	var timestampStr string
+// Remove a lobby's stored teams
+func (db *DB) DeleteLobby(lobbyID int) error {
+	_, err := db.db.Exec("DELETE FROM lobbies WHERE LobbyID = ?", lobbyID)
+	return err
+}
 
-	err := db.db.QueryRow("SELECT team1, team2, timestamp FROM temp_teams WHERE id = 1").Scan(&team1IDs, &team2IDs, &timestampStr)
+// Add a player to the end of a channel's queue, reporting false if they were already queued
+func (db *DB) JoinQueue(guildID, channelID, playerID string) (bool, error) {
+	result, err := db.db.Exec(`
+		INSERT OR IGNORE INTO queue (GuildID, ChannelID, PlayerID, JoinedAt) VALUES (?, ?, ?, ?)
+	`, guildID, channelID, playerID, time.Now().UTC())
 	if err != nil {
-		return "", "", time.Time{}, err
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Remove players from a channel's queue, reporting whether any of them were queued
+func (db *DB) LeaveQueue(channelID string, playerIDs ...string) (bool, error) {
+	removed := false
+	for _, playerID := range playerIDs {
+		result, err := db.db.Exec("DELETE FROM queue WHERE ChannelID = ? AND PlayerID = ?", channelID, playerID)
+		if err != nil {
+			return removed, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			removed = true
+		}
 	}
+	return removed, nil
+}
 
-	// Parse the timestamp string using time.RFC3339
-	timestamp, err := time.Parse(time.RFC3339, timestampStr)
+// Retrieve the players queued in a channel, first to join first
+func (db *DB) GetQueue(channelID string) ([]string, error) {
+	rows, err := db.db.Query("SELECT PlayerID FROM queue WHERE ChannelID = ? ORDER BY QueueID", channelID)
 	if err != nil {
-		return "", "", time.Time{}, fmt.Errorf("failed to parse timestamp: %v", err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	return team1IDs, team2IDs, timestamp, nil
+	var playerIDs []string
+	for rows.Next() {
+		var playerID string
+		if err := rows.Scan(&playerID); err != nil {
+			return nil, err
+		}
+		playerIDs = append(playerIDs, playerID)
+	}
+	return playerIDs, rows.Err()
 }
 
-// Clear stored teams
-func (db *DB) ClearStoredTeams() error {
-	_, err := db.db.Exec("DELETE FROM temp_teams WHERE id = 1")
-	return err
+// Record MMR history for a player, including the rating uncertainty after the match
+func (db *DB) RecordMmrHistory(player *Player, matchID int) error {
+	return recordMmrHistory(db.db, player, matchID, time.Now())
 }
 
-// Record MMR history for a player
-func (db *DB) RecordMmrHistory(playerID string, mmr int, matchID int) error {
-	_, err := db.db.Exec(`
-        INSERT INTO mmr_history (PlayerID, Mmr, MatchID)
-        VALUES (?, ?, ?)
-    `, playerID, mmr, matchID)
+func recordMmrHistory(exec execer, player *Player, matchID int, timestamp time.Time) error {
+	_, err := exec.Exec(`
+        INSERT INTO mmr_history (GuildID, PlayerID, Mmr, MatchID, Timestamp, Deviation, Volatility, Mu, Sigma)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, player.GuildID, player.PlayerID, player.MMR, matchID, timestamp.UTC(), player.RatingDeviation, player.Volatility, player.Mu, player.Sigma)
 	return err
 }
 
-func (db *DB) GetMmrHistory(playerID string) ([]int, []string, error) {
-	rows, err := db.db.Query("SELECT Mmr, Timestamp FROM mmr_history WHERE PlayerID = ? ORDER BY Timestamp", playerID)
+func (db *DB) GetMmrHistory(guildID, playerID string) ([]int, []string, error) {
+	rows, err := db.db.Query("SELECT Mmr, Timestamp FROM mmr_history WHERE GuildID = ? AND PlayerID = ? ORDER BY Timestamp", guildID, playerID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -246,53 +722,346 @@ func (db *DB) GetMmrHistory(playerID string) ([]int, []string, error) {
 
 func (db *DB) GetMatch(matchID int) (*Match, error) {
 	// Retrieve the match from the database
-	// Get Winner and Loser team player IDs
-	var winnerIDsStr, loserIDsStr string
-	err := db.db.QueryRow("SELECT Winner, Loser FROM matches WHERE MatchID = ?", matchID).Scan(&winnerIDsStr, &loserIDsStr)
+	var team1IDsStr, team2IDsStr string
+	var winningTeam sql.NullInt64
+	var status MatchStatus
+	var timestamp, reportedAt, confirmedAt sql.NullTime
+	var channelID sql.NullString
+	var lobbyID sql.NullInt64
+	var team1Score, team2Score sql.NullInt64
+	var mapName sql.NullString
+	var guildID string
+	err := db.db.QueryRow(`
+		SELECT GuildID, Team1, Team2, WinningTeam, Status, Timestamp, ReportedAt, ConfirmedAt, ChannelID, LobbyID, Team1Score, Team2Score, Map
+		FROM matches WHERE MatchID = ?
+	`, matchID).Scan(&guildID, &team1IDsStr, &team2IDsStr, &winningTeam, &status, &timestamp, &reportedAt, &confirmedAt, &channelID, &lobbyID, &team1Score, &team2Score, &mapName)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get players for Winner team
-	winnerPlayerIDs := strings.Split(winnerIDsStr, ",")
-	var winnerPlayers []*Player
-	for _, playerID := range winnerPlayerIDs {
-		player, err := db.GetPlayer(playerID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get player %s: %v", playerID, err)
-		}
-		winnerPlayers = append(winnerPlayers, player)
+	// Get players for Team 1
+	team1Players, err := getPlayersFromIDs(guildID, team1IDsStr, db)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get players for Loser team
-	loserPlayerIDs := strings.Split(loserIDsStr, ",")
-	var loserPlayers []*Player
-	for _, playerID := range loserPlayerIDs {
-		player, err := db.GetPlayer(playerID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get player %s: %v", playerID, err)
-		}
-		loserPlayers = append(loserPlayers, player)
+	// Get players for Team 2
+	team2Players, err := getPlayersFromIDs(guildID, team2IDsStr, db)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create the Match object
 	match := &Match{
-		MatchID: matchID,
-		Winner: &Team{
-			Players: winnerPlayers,
-		},
-		Loser: &Team{
-			Players: loserPlayers,
-		},
+		MatchID:     matchID,
+		GuildID:     guildID,
+		WinningTeam: int(winningTeam.Int64),
+		Draw:        winningTeam.Valid && winningTeam.Int64 == drawResult,
+		Status:      status,
+		Timestamp:   timestamp.Time,
+		ReportedAt:  reportedAt.Time,
+		ConfirmedAt: confirmedAt.Time,
+		ChannelID:   channelID.String,
+		LobbyID:     int(lobbyID.Int64),
+		Map:         mapName.String,
+		db:          db,
+	}
+	match.setTeams(&Team{Name: "Team 1", Players: team1Players}, &Team{Name: "Team 2", Players: team2Players})
+	if match.WinningTeam == 2 {
+		match.WinnerScore, match.LoserScore = int(team2Score.Int64), int(team1Score.Int64)
+	} else {
+		match.WinnerScore, match.LoserScore = int(team1Score.Int64), int(team2Score.Int64)
+	}
+
+	subs, err := db.GetSubstitutions(matchID)
+	if err != nil {
+		return nil, err
+	}
+	err = match.setSubstitutions(subs, func(playerID string) (*Player, error) {
+		return db.GetPlayer(guildID, playerID)
+	})
+	if err != nil {
+		return nil, err
 	}
 	return match, nil
 }
 
-func (db *DB) HasMatches() (bool, error) {
+// MatchRecord is a stored match result as player IDs, used to replay history.
+// Winner and Loser hold the final lineups, team 1 and team 2 for a draw; the
+// scores are 0 and the map empty when unknown.
+type MatchRecord struct {
+	MatchID     int
+	Winner      []string
+	Loser       []string
+	Draw        bool
+	WinnerScore int
+	LoserScore  int
+	Map         string
+	Timestamp   time.Time
+}
+
+// Retrieve the teams of a guild's last played matches, most recent first
+func (db *DB) GetRecentTeams(guildID string, limit int) ([][2][]string, error) {
+	rows, err := db.db.Query(`
+		SELECT Team1, Team2 FROM matches
+		WHERE GuildID = ? AND Status IN (?, ?, ?, ?, ?) AND Team1 IS NOT NULL
+		ORDER BY MatchID DESC LIMIT ?
+	`, guildID, MatchStatusLive, MatchStatusPending, MatchStatusConfirmed, MatchStatusDisputed, MatchStatusFinalized, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var teams [][2][]string
+	for rows.Next() {
+		var team1, team2 string
+		if err := rows.Scan(&team1, &team2); err != nil {
+			return nil, err
+		}
+		teams = append(teams, [2][]string{strings.Split(team1, ","), strings.Split(team2, ",")})
+	}
+	return teams, rows.Err()
+}
+
+// Retrieve every finalized match of a guild in the order it was played
+func (db *DB) GetMatchRecords(guildID string) ([]*MatchRecord, error) {
+	rows, err := db.db.Query(`
+		SELECT MatchID, COALESCE(Winner, Team1), COALESCE(Loser, Team2), Timestamp, COALESCE(WinningTeam = ?, FALSE),
+			COALESCE(CASE WHEN WinningTeam = 2 THEN Team2Score ELSE Team1Score END, 0),
+			COALESCE(CASE WHEN WinningTeam = 2 THEN Team1Score ELSE Team2Score END, 0),
+			COALESCE(Map, '')
+		FROM matches WHERE GuildID = ? AND Status = ? ORDER BY MatchID
+	`, drawResult, guildID, MatchStatusFinalized)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*MatchRecord
+	for rows.Next() {
+		var record MatchRecord
+		var winnerIDs, loserIDs string
+		var timestamp sql.NullTime
+		if err := rows.Scan(&record.MatchID, &winnerIDs, &loserIDs, &timestamp, &record.Draw, &record.WinnerScore, &record.LoserScore, &record.Map); err != nil {
+			return nil, err
+		}
+		record.Winner = strings.Split(winnerIDs, ",")
+		record.Loser = strings.Split(loserIDs, ",")
+		record.Timestamp = timestamp.Time
+		records = append(records, &record)
+	}
+	return records, rows.Err()
+}
+
+// Retrieve per-match stats for every match of a guild, keyed by match and player
+func (db *DB) GetAllPerformances(guildID string) (map[int]map[string]PlayerStats, error) {
+	rows, err := db.db.Query(`
+		SELECT p.MatchID, p.PlayerID, p.Kills, p.Assists, p.Deaths
+		FROM player_performances p JOIN matches m ON m.MatchID = p.MatchID
+		WHERE m.GuildID = ? ORDER BY p.PerformanceID
+	`, guildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	performances := make(map[int]map[string]PlayerStats)
+	for rows.Next() {
+		var matchID int
+		var playerID string
+		var stats PlayerStats
+		if err := rows.Scan(&matchID, &playerID, &stats.Kills, &stats.Assists, &stats.Deaths); err != nil {
+			return nil, err
+		}
+		if performances[matchID] == nil {
+			performances[matchID] = make(map[string]PlayerStats)
+		}
+		performances[matchID][playerID] = stats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	values, err := queryStatValues(db.db, "WHERE MatchID IN (SELECT MatchID FROM matches WHERE GuildID = ?)", guildID)
+	if err != nil {
+		return nil, err
+	}
+	for matchID := range performances {
+		attachStatValues(performances[matchID], values[matchID])
+	}
+	return performances, nil
+}
+
+// Retrieve when each player's MMR history entry for a match was recorded
+func (db *DB) GetMmrHistoryTimestamps(guildID string) (map[int]map[string]time.Time, error) {
+	rows, err := db.db.Query("SELECT MatchID, PlayerID, Timestamp FROM mmr_history WHERE GuildID = ?", guildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timestamps := make(map[int]map[string]time.Time)
+	for rows.Next() {
+		var matchID int
+		var playerID string
+		var timestamp time.Time
+		if err := rows.Scan(&matchID, &playerID, &timestamp); err != nil {
+			return nil, err
+		}
+		if timestamps[matchID] == nil {
+			timestamps[matchID] = make(map[string]time.Time)
+		}
+		timestamps[matchID][playerID] = timestamp
+	}
+	return timestamps, rows.Err()
+}
+
+// Retrieve the stats each player reported for a match, which are the ones
+// applied to their totals once the match is rated
+func (db *DB) GetRecordedPerformances(matchID int) (map[string]PlayerStats, error) {
+	rows, err := db.db.Query("SELECT PlayerID, Kills, Assists, Deaths FROM player_performances WHERE MatchID = ? ORDER BY PerformanceID", matchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	performances := make(map[string]PlayerStats)
+	for rows.Next() {
+		var playerID string
+		var stats PlayerStats
+		if err := rows.Scan(&playerID, &stats.Kills, &stats.Assists, &stats.Deaths); err != nil {
+			return nil, err
+		}
+		if _, ok := performances[playerID]; !ok {
+			performances[playerID] = stats
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	values, err := queryStatValues(db.db, "WHERE MatchID = ?", matchID)
+	if err != nil {
+		return nil, err
+	}
+	attachStatValues(performances, values[matchID])
+	return performances, nil
+}
+
+// MmrHistoryRow is a stored rating snapshot of a player after a match
+type MmrHistoryRow struct {
+	ID         int
+	MatchID    int
+	Mmr        int
+	Deviation  float64
+	Volatility float64
+	Mu         float64
+	Sigma      float64
+}
+
+// Retrieve a player's rating snapshots in the order they were recorded
+func (db *DB) GetMmrHistoryRows(guildID, playerID string) ([]MmrHistoryRow, error) {
+	rows, err := db.db.Query(`
+		SELECT ID, MatchID, Mmr, COALESCE(Deviation, 0), COALESCE(Volatility, 0), COALESCE(Mu, 0), COALESCE(Sigma, 0)
+		FROM mmr_history WHERE GuildID = ? AND PlayerID = ? ORDER BY ID
+	`, guildID, playerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []MmrHistoryRow
+	for rows.Next() {
+		var row MmrHistoryRow
+		if err := rows.Scan(&row.ID, &row.MatchID, &row.Mmr, &row.Deviation, &row.Volatility, &row.Mu, &row.Sigma); err != nil {
+			return nil, err
+		}
+		history = append(history, row)
+	}
+	return history, rows.Err()
+}
+
+// Mark a match as voided and store the reverted players with compensating history rows
+func (db *DB) VoidMatch(matchID int, players []*Player) error {
+	return db.settleRatings(matchID, MatchStatusVoided, players)
+}
+
+// Finalize a rated match, storing its players' new ratings and MMR history
+// in the same transaction as the status change
+func (db *DB) FinalizeMatch(matchID int, players []*Player) error {
+	return db.settleRatings(matchID, MatchStatusFinalized, players)
+}
+
+// settleRatings moves a match to status and stores its players' ratings and
+// MMR history in one transaction, so they change together or not at all
+func (db *DB) settleRatings(matchID int, status MatchStatus, players []*Player) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := transitionMatch(tx, matchID, status); err != nil {
+		return err
+	}
+
+	for _, player := range players {
+		if err := savePlayer(tx, player); err != nil {
+			return fmt.Errorf("failed to save player %s: %v", player.PlayerID, err)
+		}
+		if err := recordMmrHistory(tx, player, matchID, time.Now()); err != nil {
+			return fmt.Errorf("failed to record MMR history for player %s: %v", player.PlayerID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// MmrHistoryEntry is a single row of a rewritten MMR history
+type MmrHistoryEntry struct {
+	Player    Player
+	MatchID   int
+	Timestamp time.Time
+}
+
+// Replace a guild's player ratings and its whole MMR history in one transaction
+func (db *DB) ReplaceRatings(guildID string, players []*Player, history []MmrHistoryEntry) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM mmr_history WHERE GuildID = ?", guildID); err != nil {
+		return err
+	}
+	for _, entry := range history {
+		if err := recordMmrHistory(tx, &entry.Player, entry.MatchID, entry.Timestamp); err != nil {
+			return err
+		}
+	}
+	for _, player := range players {
+		if err := savePlayer(tx, player); err != nil {
+			return fmt.Errorf("failed to save player %s: %v", player.PlayerID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) HasMatches(guildID string) (bool, error) {
 	var count int
-	err := db.db.QueryRow("SELECT COUNT(*) FROM matches").Scan(&count)
+	err := db.db.QueryRow("SELECT COUNT(*) FROM matches WHERE GuildID = ?", guildID).Scan(&count)
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
+
+// Convert a zero time to NULL so unset timestamps are not stored as year 1
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// nullScore stores a round score as NULL when the match has none
+func nullScore(match *Match, score int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(score), Valid: match.HasScore()}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// Create a database from before per-guild ladders
+func createLegacyDB(t *testing.T) string {
+	dbName := filepath.Join(t.TempDir(), "legacy.db")
+	legacy, err := sql.Open("sqlite", dbName)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE players (PlayerID TEXT PRIMARY KEY, PlayerName TEXT, CoreMember INTEGER, Mmr INTEGER, GamesPlayed INTEGER, Wins INTEGER, Kills INTEGER, Assists INTEGER, Deaths INTEGER, Sniper BOOLEAN DEFAULT FALSE);
+		CREATE TABLE matches (MatchID INTEGER PRIMARY KEY AUTOINCREMENT, Winner TEXT, Loser TEXT);
+		CREATE TABLE mmr_history (ID INTEGER PRIMARY KEY AUTOINCREMENT, PlayerID TEXT, Mmr INTEGER, MatchID INTEGER, Timestamp DATETIME DEFAULT CURRENT_TIMESTAMP);
+		INSERT INTO players VALUES ('a', 'Alice', 1, 1016, 1, 1, 20, 3, 10, 0), ('b', 'Bob', 0, 984, 1, 0, 5, 1, 15, 1);
+		INSERT INTO matches (Winner, Loser) VALUES ('a', 'b');
+		INSERT INTO mmr_history (PlayerID, Mmr, MatchID) VALUES ('a', 1016, 1), ('b', 984, 1);
+		CREATE TABLE temp_teams (id INTEGER PRIMARY KEY, team1 TEXT, team2 TEXT, timestamp DATETIME DEFAULT CURRENT_TIMESTAMP);
+		INSERT INTO temp_teams (id, team1, team2) VALUES (1, 'a', 'b');
+	`)
+	legacy.Close()
+	if err != nil {
+		t.Fatalf("Error creating legacy schema: %v", err)
+	}
+	return dbName
+}
+
+func TestMigrateToGuilds(t *testing.T) {
+	dbName := createLegacyDB(t)
+	defer func(previous *Config) { config = previous }(config)
+	config = DefaultConfig()
+	config.LegacyGuildID = "main"
+	db, err := InitDB(dbName)
+	if err != nil {
+		t.Fatalf("Error migrating database: %v", err)
+	}
+	defer db.Close()
+
+	player, err := db.GetPlayer("main", "a")
+	if err != nil || player.PlayerName != "Alice" || player.MMR != 1016 || player.Kills != 20 || !player.CoreMember {
+		t.Fatalf("player was not migrated into the legacy guild: %+v (%v)", player, err)
+	}
+	if records, _ := db.GetMatchRecords("main"); len(records) != 1 {
+		t.Fatalf("expected the legacy match in the legacy guild, got %d", len(records))
+	}
+	if mmrs, _, _ := db.GetMmrHistory("main", "b"); len(mmrs) != 1 || mmrs[0] != 984 {
+		t.Fatalf("unexpected MMR history after migration: %v", mmrs)
+	}
+	if _, err := db.db.Exec("SELECT * FROM temp_teams"); err == nil {
+		t.Fatalf("expected the teams stored before lobbies to be dropped")
+	}
+
+	// The same user starts from scratch on another guild's ladder
+	if _, err := db.GetPlayer("scrim", "a"); err != sql.ErrNoRows {
+		t.Fatalf("expected no player in another guild, got %v", err)
+	}
+	if err := db.SavePlayer(NewPlayer("scrim", "a", "Alice")); err != nil {
+		t.Fatalf("Error saving player: %v", err)
+	}
+	if player, _ := db.GetPlayer("main", "a"); player.MMR != 1016 {
+		t.Fatalf("saving in another guild changed the legacy ladder: %+v", player)
+	}
+}
+
+func TestClaimLegacyData(t *testing.T) {
+	dbName := createLegacyDB(t)
+	defer func(previous *Config) { config = previous }(config)
+	config = DefaultConfig()
+
+	// Without LEGACY_GUILD_ID the bot still starts, keeping the players aside
+	db, err := InitDB(dbName)
+	if err != nil {
+		t.Fatalf("Error migrating database: %v", err)
+	}
+	defer db.Close()
+	if player, err := db.GetPlayer(unclaimedGuildID, "a"); err != nil || player.MMR != 1016 {
+		t.Fatalf("expected the player to wait for a guild, got %+v (%v)", player, err)
+	}
+
+	// A guild with a ladder of its own cannot take them over
+	db.SavePlayer(NewPlayer("scrim", "c", "Carol"))
+	if _, err := db.ClaimLegacyData("scrim"); err == nil {
+		t.Fatalf("expected claiming into a guild with players to fail")
+	}
+
+	claimed, err := db.ClaimLegacyData("main")
+	if err != nil || claimed != 2 {
+		t.Fatalf("expected two players to be claimed, got %d (%v)", claimed, err)
+	}
+	if player, err := db.GetPlayer("main", "a"); err != nil || player.MMR != 1016 {
+		t.Fatalf("player was not claimed: %+v (%v)", player, err)
+	}
+	if records, _ := db.GetMatchRecords("main"); len(records) != 1 {
+		t.Fatalf("expected the legacy match in the claiming guild, got %d", len(records))
+	}
+	if claimed, err := db.ClaimLegacyData("other"); err != nil || claimed != 0 {
+		t.Fatalf("expected nothing left to claim, got %d (%v)", claimed, err)
+	}
+}
+
+func TestGuildSettings(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := db.SetGuildSetting("scrim", "rating_system", "glicko2"); err != nil {
+		t.Fatalf("Error changing setting: %v", err)
+	}
+	if err := db.SetGuildSetting("scrim", "result_confirmations", "-1"); err == nil {
+		t.Fatalf("expected an invalid value to be rejected")
+	}
+
+	if rs, _ := db.GetRatingSystem("scrim"); rs.Name() != (&GlickoRatingSystem{}).Name() {
+		t.Fatalf("expected the scrim guild to use Glicko-2, got %s", rs.Name())
+	}
+	if rs, _ := db.GetRatingSystem("main"); rs.Name() != (&EloRatingSystem{}).Name() {
+		t.Fatalf("expected other guilds to keep the default, got %s", rs.Name())
+	}
+
+	if err := db.ResetGuildSetting("scrim", "rating_system"); err != nil {
+		t.Fatalf("Error resetting setting: %v", err)
+	}
+	if cfg, _ := db.GetGuildConfig("scrim"); cfg.RatingSystem != config.RatingSystem {
+		t.Fatalf("expected the bot-wide rating system after reset, got %s", cfg.RatingSystem)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/bwmarrin/discordgo"
+	"log"
 	"strconv"
 	"strings"
 )
@@ -38,6 +39,16 @@ func (ds *Discord) GetPlayersInVoiceChannel(guildID, voiceChannelID string) ([]s
 	return playerIDs, nil
 }
 
+// Check whether a member may run admin commands in the channel
+func isAdmin(s *discordgo.Session, channelID, userID string) bool {
+	permissions, err := s.UserChannelPermissions(userID, channelID)
+	if err != nil {
+		log.Printf("Error getting permissions for user %s: %v", userID, err)
+		return false
+	}
+	return permissions&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) != 0
+}
+
 func handleInteraction(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
 	switch i.Type {
 	case discordgo.InteractionMessageComponent:
@@ -76,7 +87,7 @@ func handleInteraction(s *discordgo.Session, i *discordgo.InteractionCreate, db
 
 			// Verify that the user was part of the match
 			found := false
-			for _, player := range append(match.Winner.Players, match.Loser.Players...) {
+			for _, player := range match.players() {
 				if player.PlayerID == userID {
 					found = true
 					break
@@ -93,20 +104,204 @@ func handleInteraction(s *discordgo.Session, i *discordgo.InteractionCreate, db
 				return
 			}
 
+			if !match.statsOpen() {
+				respondEphemeral(s, i.Interaction, fmt.Sprintf("Match %d is %s, stats can no longer be reported.", matchID, match.Status))
+				return
+			}
+
 			// Show modal to collect stats for the user
 			showPlayerStatsModal(s, i.Interaction, matchID, userID, db)
+		} else if strings.HasPrefix(data.CustomID, "confirm_result_") {
+			handleResultConfirmation(s, i, db)
+		} else if strings.HasPrefix(data.CustomID, "dispute_result_") {
+			handleResultDispute(s, i, db)
+		} else if strings.HasPrefix(data.CustomID, "report_score_") {
+			showMatchScoreModal(s, i, db)
+		} else if strings.HasPrefix(data.CustomID, "scoreboard_paste_") {
+			showScoreboardModal(s, i, db)
+		} else if strings.HasPrefix(data.CustomID, "scoreboard_confirm_") || strings.HasPrefix(data.CustomID, "scoreboard_cancel_") {
+			handleScoreboardButton(s, i, db)
+		} else if strings.HasPrefix(data.CustomID, "stats_page_") {
+			showStatPageModal(s, i, db)
+		} else if strings.HasPrefix(data.CustomID, "match_map_") {
+			handleMapSelect(s, i, db)
+		} else if strings.HasPrefix(data.CustomID, "team_vote_") {
+			handleTeamVote(s, i, db)
+		} else if strings.HasPrefix(data.CustomID, "draft_pick_") {
+			handleDraftPick(s, i, db)
+		} else if strings.HasPrefix(data.CustomID, "ready_check_") || strings.HasPrefix(data.CustomID, "ready_leave_") {
+			handleReadyCheck(s, i, db)
 		}
 	case discordgo.InteractionModalSubmit:
 		if strings.HasPrefix(i.ModalSubmitData().CustomID, "player_stats_modal_") {
 			// Process the submitted stats
 			handlePlayerStatsSubmission(s, i, db)
+		} else if strings.HasPrefix(i.ModalSubmitData().CustomID, "scoreboard_modal_") {
+			handleScoreboardSubmission(s, i, db)
+		} else if strings.HasPrefix(i.ModalSubmitData().CustomID, "stats_page_modal_") {
+			handleStatPageSubmission(s, i, db)
+		} else if strings.HasPrefix(i.ModalSubmitData().CustomID, "match_score_modal_") {
+			handleMatchScoreSubmission(s, i, db)
+		}
+	}
+}
+
+// Reply to an interaction with a message only the user can see
+func respondEphemeral(s *discordgo.Session, interaction *discordgo.Interaction, content string) {
+	s.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+}
+
+// Reply to an interaction with a message visible to the whole channel
+func respondPublic(s *discordgo.Session, interaction *discordgo.Interaction, content string) {
+	s.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+		},
+	})
+}
+
+// Handle the "Confirm" button on a reported result
+func handleResultConfirmation(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	matchID, err := strconv.Atoi(strings.TrimPrefix(i.MessageComponentData().CustomID, "confirm_result_"))
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Invalid match ID.")
+		return
+	}
+
+	finalized, count, err := ConfirmMatchResult(db, matchID, i.Member.User.ID)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Could not confirm: %v", err))
+		return
+	}
+
+	if finalized {
+		respondPublic(s, i.Interaction, fmt.Sprintf("Match %d confirmed. Ratings updated.", matchID))
+		return
+	}
+	match, err := db.GetMatch(matchID)
+	if err == nil && match.Status == MatchStatusConfirmed {
+		cfg, err := db.GetGuildConfig(match.GuildID)
+		if err == nil {
+			respondPublic(s, i.Interaction, fmt.Sprintf("Match %d confirmed. Ratings are applied once everyone has reported their stats, or in %s.", matchID, cfg.StatsDeadline))
+			return
+		}
+	}
+	respondPublic(s, i.Interaction, fmt.Sprintf("%s confirmed the result of match %d (%d confirmation(s) so far).", i.Member.User.Username, matchID, count))
+}
+
+// Handle the "Dispute" button on a reported result
+func handleResultDispute(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	matchID, err := strconv.Atoi(strings.TrimPrefix(i.MessageComponentData().CustomID, "dispute_result_"))
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Invalid match ID.")
+		return
+	}
+
+	if err := DisputeMatchResult(db, matchID, i.Member.User.ID); err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Could not dispute: %v", err))
+		return
+	}
+
+	respondPublic(s, i.Interaction, fmt.Sprintf("%s disputed the result of match %d. It is frozen until an admin uses `!confirm %d` or `!void %d`.", i.Member.User.Username, matchID, matchID, matchID))
+}
+
+// Handle the "Set score" button on a reported result by asking for the rounds
+func showMatchScoreModal(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	matchID, err := strconv.Atoi(strings.TrimPrefix(i.MessageComponentData().CustomID, "report_score_"))
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Invalid match ID.")
+		return
+	}
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Match not found.")
+		return
+	}
+	if !match.hasPlayer(i.Member.User.ID) && !isAdmin(s, i.ChannelID, i.Member.User.ID) {
+		respondEphemeral(s, i.Interaction, "You were not part of this match.")
+		return
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: fmt.Sprintf("match_score_modal_%d", matchID),
+			Title:    fmt.Sprintf("Score of match %d", matchID),
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:    "score",
+							Label:       "Rounds won-lost by the winners",
+							Style:       discordgo.TextInputShort,
+							Placeholder: "13-7",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+// Store the round score entered in the score modal
+func handleMatchScoreSubmission(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	data := i.ModalSubmitData()
+	matchID, err := strconv.Atoi(strings.TrimPrefix(data.CustomID, "match_score_modal_"))
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Invalid match ID.")
+		return
+	}
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Match not found.")
+		return
+	}
+	if !match.hasPlayer(i.Member.User.ID) && !isAdmin(s, i.ChannelID, i.Member.User.ID) {
+		respondEphemeral(s, i.Interaction, "You were not part of this match.")
+		return
+	}
+
+	var scoreStr string
+	for _, c := range data.Components {
+		for _, innerC := range c.(*discordgo.ActionsRow).Components {
+			if input := innerC.(*discordgo.TextInput); input.CustomID == "score" {
+				scoreStr = input.Value
+			}
 		}
 	}
+	winnerScore, loserScore, err := parseScore(strings.TrimSpace(scoreStr), match.Draw)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	// Players can set the score until the result is confirmed, admins can
+	// still correct it afterwards
+	setScore := db.SetMatchScore
+	if isAdmin(s, i.ChannelID, i.Member.User.ID) {
+		setScore = db.CorrectMatchScore
+	}
+	if err := setScore(matchID, winnerScore, loserScore); err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Could not store the score: %v", err))
+		return
+	}
+	content := fmt.Sprintf("%s set the score of match %d to %d-%d.", i.Member.User.Username, matchID, winnerScore, loserScore)
+	if match.Status == MatchStatusPending {
+		content += " Confirmations given before the score changed must be given again."
+	}
+	respondPublic(s, i.Interaction, content)
 }
 
 func showPlayerStatsModal(s *discordgo.Session, interaction *discordgo.Interaction, matchID int, playerID string, db *DB) {
 	// Fetch player info from the database
-	player, err := db.GetPlayer(playerID)
+	player, err := db.GetPlayer(interaction.GuildID, playerID)
 	if err != nil {
 		// Handle error
 		s.InteractionRespond(interaction, &discordgo.InteractionResponse{
@@ -119,12 +314,25 @@ func showPlayerStatsModal(s *discordgo.Session, interaction *discordgo.Interacti
 		return
 	}
 
+	// Stats reported before are filled in so they can be corrected
+	stats, reported, err := db.GetPerformance(matchID, playerID)
+	if err != nil {
+		respondEphemeral(s, interaction, "Error loading your stats.")
+		return
+	}
+	title := fmt.Sprintf("Report Your Stats (%s)", player.PlayerName)
+	value := func(n int) string { return "" }
+	if reported {
+		title = fmt.Sprintf("Edit Your Stats (%s)", player.PlayerName)
+		value = strconv.Itoa
+	}
+
 	// Show modal to the user to input their own stats
 	s.InteractionRespond(interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseModal,
 		Data: &discordgo.InteractionResponseData{
 			CustomID: fmt.Sprintf("player_stats_modal_%d_%s", matchID, playerID),
-			Title:    fmt.Sprintf("Report Your Stats (%s)", player.PlayerName),
+			Title:    title,
 			Components: []discordgo.MessageComponent{
 				discordgo.ActionsRow{
 					Components: []discordgo.MessageComponent{
@@ -133,6 +341,7 @@ func showPlayerStatsModal(s *discordgo.Session, interaction *discordgo.Interacti
 							Label:       "Kills",
 							Style:       discordgo.TextInputShort,
 							Placeholder: "Enter number of kills",
+							Value:       value(stats.Kills),
 							Required:    true,
 						},
 					},
@@ -144,6 +353,7 @@ func showPlayerStatsModal(s *discordgo.Session, interaction *discordgo.Interacti
 							Label:       "Assists",
 							Style:       discordgo.TextInputShort,
 							Placeholder: "Enter number of assists",
+							Value:       value(stats.Assists),
 							Required:    true,
 						},
 					},
@@ -155,6 +365,7 @@ func showPlayerStatsModal(s *discordgo.Session, interaction *discordgo.Interacti
 							Label:       "Deaths",
 							Style:       discordgo.TextInputShort,
 							Placeholder: "Enter number of deaths",
+							Value:       value(stats.Deaths),
 							Required:    true,
 						},
 					},
@@ -247,13 +458,27 @@ func handlePlayerStatsSubmission(s *discordgo.Session, i *discordgo.InteractionC
 		return
 	}
 
+	// Stats count towards the ratings, so they close once the match is rated
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Match not found.")
+		return
+	}
+	if !match.statsOpen() {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Match %d is %s, stats can no longer be reported.", matchID, match.Status))
+		return
+	}
+	// Extended stats reported on the other pages are kept
+	previous, edited, _ := db.GetPerformance(matchID, playerID)
+	stats := PlayerStats{Kills: kills, Assists: assists, Deaths: deaths, Extra: previous.Extra}
+	if err := match.checkStats(playerID, stats); err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Invalid stats: %v.", err))
+		return
+	}
+
 	// Save the stats for the player and match
-	err = db.SavePlayerPerformance(matchID, &Player{
-		PlayerID: playerID,
-		Kills:    kills,
-		Assists:  assists,
-		Deaths:   deaths,
-	})
+	before, _ := db.GetRecordedPerformances(matchID)
+	err = db.ReportPerformance(matchID, playerID, i.Member.User.ID, stats)
 	if err != nil {
 		// Handle error
 		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
@@ -266,12 +491,36 @@ func handlePlayerStatsSubmission(s *discordgo.Session, i *discordgo.InteractionC
 		return
 	}
 
+	// Stats that no longer add up are flagged for the admins
+	if after, err := db.GetRecordedPerformances(matchID); err == nil {
+		if warnings := newWarnings(match.statsWarnings(before), match.statsWarnings(after)); len(warnings) > 0 {
+			flagStats(s, db, match, fmt.Sprintf("<@%s> reported %s", playerID, describeStats(stats)), warnings)
+		}
+	}
+
+	// The last report of a confirmed match rates it
+	if match.Status == MatchStatusConfirmed {
+		finalized, err := settleMatch(db, matchID)
+		if err != nil {
+			log.Printf("Error rating match %d: %v", matchID, err)
+		}
+		if finalized != nil {
+			respondPublic(s, i.Interaction, fmt.Sprintf("All stats for match %d are in. Ratings updated.", matchID))
+			return
+		}
+	}
+
 	// Acknowledge the submission
+	acknowledgement := "Your stats have been recorded. Thank you!"
+	if edited {
+		acknowledgement = "Your stats have been updated. You can edit them until the match is rated."
+	}
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: "Your stats have been recorded. Thank you!",
-			Flags:   discordgo.MessageFlagsEphemeral,
+			Content:    acknowledgement + " Add ADR, headshots, multi-kills and more with the button below.",
+			Flags:      discordgo.MessageFlagsEphemeral,
+			Components: []discordgo.MessageComponent{statPageButton(matchID, playerID, 0)},
 		},
 	})
 }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Draft is a running captain draft where two captains pick their teams
+type Draft struct {
+	ID             int
+	GuildID        string
+	ChannelID      string
+	VoiceChannelID string
+	MessageID      string
+	Captains       [2]*Player
+	Teams          [2]*Team
+	// Pool holds the players nobody picked yet, strongest first
+	Pool     []*Player
+	Picks    int
+	Deadline time.Time
+	// Bench holds the players sitting out, recorded once the lobby is formed
+	Bench        []string
+	SessionStart time.Time
+	rs           RatingSystem
+}
+
+// Discord shows at most 25 options in a select menu, so a draft takes the two
+// captains and at most 25 players to pick from
+const maxDraftPlayers = 2 + 25
+
+// drafts holds the drafts that are still running, by ID
+var drafts = struct {
+	sync.Mutex
+	nextID int
+	drafts map[int]*Draft
+}{drafts: make(map[int]*Draft)}
+
+// newDraft sets up a draft with the captains leading the two teams
+func newDraft(captain1, captain2 *Player, pool []*Player, rs RatingSystem) *Draft {
+	d := &Draft{
+		Captains: [2]*Player{captain1, captain2},
+		Teams: [2]*Team{
+			{Name: "Team 1", Players: []*Player{captain1}},
+			{Name: "Team 2", Players: []*Player{captain2}},
+		},
+		Pool: append([]*Player{}, pool...),
+		rs:   rs,
+	}
+	sort.SliceStable(d.Pool, func(i, j int) bool {
+		return d.Pool[i].MMR > d.Pool[j].MMR
+	})
+	return d
+}
+
+// captainToPick is the team whose captain picks next, in snake order (ABBA...)
+func (d *Draft) captainToPick() int {
+	return (d.Picks + 1) / 2 % 2
+}
+
+// pick moves a player from the pool to the team of the captain whose turn it is.
+// The last player left joins the next team without waiting for a pick.
+func (d *Draft) pick(playerID string) error {
+	for i, player := range d.Pool {
+		if player.PlayerID != playerID {
+			continue
+		}
+		team := d.Teams[d.captainToPick()]
+		team.Players = append(team.Players, player)
+		d.Pool = append(d.Pool[:i], d.Pool[i+1:]...)
+		d.Picks++
+
+		if len(d.Pool) == 1 {
+			return d.pick(d.Pool[0].PlayerID)
+		}
+		return nil
+	}
+	return fmt.Errorf("player is not available")
+}
+
+// autoPick picks the highest rated player left for a captain who ran out of time
+func (d *Draft) autoPick() *Player {
+	player := d.Pool[0]
+	d.pick(player.PlayerID)
+	return player
+}
+
+func (d *Draft) done() bool {
+	return len(d.Pool) == 0
+}
+
+// split is the drafted teams with their predicted win chances
+func (d *Draft) split() *TeamSplit {
+	return &TeamSplit{Team1: d.Teams[0], Team2: d.Teams[1], Team1WinChance: d.rs.ExpectedScore(d.Teams[0], d.Teams[1]), RepeatedPairs: -1}
+}
+
+func (d *Draft) content() string {
+	captain := d.Captains[d.captainToPick()]
+	return fmt.Sprintf("**Captain draft**\nTeam 1 (captain %s): %s\nTeam 2 (captain %s): %s\n\n<@%s>, pick a player <t:%d:R> or the highest rated one is picked for you.",
+		d.Captains[0].PlayerName, getTeamNames(d.Teams[0]), d.Captains[1].PlayerName, getTeamNames(d.Teams[1]), captain.PlayerID, d.Deadline.Unix())
+}
+
+func (d *Draft) components() []discordgo.MessageComponent {
+	var options []discordgo.SelectMenuOption
+	for _, player := range d.Pool {
+		options = append(options, discordgo.SelectMenuOption{
+			Label:       player.PlayerName,
+			Value:       player.PlayerID,
+			Description: fmt.Sprintf("MMR %d", player.MMR),
+		})
+	}
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType:    discordgo.StringSelectMenu,
+					CustomID:    fmt.Sprintf("draft_pick_%d", d.ID),
+					Placeholder: "Pick a player",
+					Options:     options,
+				},
+			},
+		},
+	}
+}
+
+// Command to start a captain draft with the players in the caller's voice
+// channel. Captains are the two mentioned players or the two highest rated.
+// Players are picked like for !teams: beyond a full match, or beyond what the
+// pick menu can list, they sit out in rotation, and `-u` allows teams of
+// different sizes.
+func draftCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB, discordInstance *Discord) {
+	guildID := m.GuildID
+	voiceChannelID := getVoiceChannelIDForUser(s, guildID, m.Author.ID)
+	if voiceChannelID == "" {
+		s.ChannelMessageSend(m.ChannelID, "You need to be in a voice channel!")
+		return
+	}
+
+	// Captains chosen by mention, otherwise the two highest rated players
+	var captainIDs []string
+	allowUneven := false
+	for _, arg := range args[1:] {
+		if arg == "-u" {
+			allowUneven = true
+			continue
+		}
+		userID, ok := parseUserMention(arg)
+		if !ok {
+			s.ChannelMessageSend(m.ChannelID, "Usage: `!draft [-u]` or `!draft @captain1 @captain2 [-u]`.")
+			return
+		}
+		captainIDs = append(captainIDs, userID)
+	}
+	if len(captainIDs) != 0 && len(captainIDs) != 2 {
+		s.ChannelMessageSend(m.ChannelID, "Please mention exactly two captains, or none to use the two highest rated players.")
+		return
+	}
+
+	playerIDs, err := getVoiceChannelPlayerIDs(discordInstance, guildID, voiceChannelID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error fetching players in voice channel: %v", err))
+		return
+	}
+	cfg, err := db.GetGuildConfig(guildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading settings: %v", err))
+		return
+	}
+	size := cfg.QueueSize
+	if size > maxDraftPlayers {
+		size = maxDraftPlayers
+	}
+	selection, err := selectVoicePlayers(db, discordInstance, guildID, voiceChannelID, playerIDs, size, allowUneven, cfg, captainIDs...)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	players := selection.Players
+	if len(players) < 4 {
+		s.ChannelMessageSend(m.ChannelID, "A draft needs at least 4 players.")
+		return
+	}
+
+	sort.SliceStable(players, func(i, j int) bool {
+		return players[i].MMR > players[j].MMR
+	})
+	if len(captainIDs) == 0 {
+		captainIDs = []string{players[0].PlayerID, players[1].PlayerID}
+	}
+
+	var captains []*Player
+	var pool []*Player
+	for _, player := range players {
+		if player.PlayerID == captainIDs[0] || player.PlayerID == captainIDs[1] {
+			captains = append(captains, player)
+		} else {
+			pool = append(pool, player)
+		}
+	}
+	if len(captains) != 2 {
+		s.ChannelMessageSend(m.ChannelID, "Both captains must be in the voice channel.")
+		return
+	}
+
+	rs, err := NewRatingSystem(cfg.RatingSystem)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading rating system: %v", err))
+		return
+	}
+
+	if len(selection.Bench) > 0 {
+		if len(playerIDs) > maxDraftPlayers && cfg.QueueSize > maxDraftPlayers {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("A draft offers at most %d players to pick from, so only %d of the %d players in the channel play.", maxDraftPlayers-2, len(players), len(playerIDs)))
+		}
+		s.ChannelMessageSend(m.ChannelID, describeBench(selection.Bench, selection.SitOuts))
+	}
+	d := newDraft(captains[0], captains[1], pool, rs)
+	d.GuildID, d.ChannelID, d.VoiceChannelID = guildID, m.ChannelID, voiceChannelID
+	d.Bench, d.SessionStart = selection.BenchIDs, selection.SessionStart
+	startDraft(s, db, d, cfg.DraftPickTimeout)
+}
+
+// Post the draft and start the first pick timer
+func startDraft(s *discordgo.Session, db *DB, d *Draft, timeout time.Duration) {
+	drafts.Lock()
+	drafts.nextID++
+	d.ID = drafts.nextID
+	d.Deadline = time.Now().Add(timeout)
+	drafts.drafts[d.ID] = d
+	content, components := d.content(), d.components()
+	drafts.Unlock()
+
+	message, err := s.ChannelMessageSendComplex(d.ChannelID, &discordgo.MessageSend{
+		Content:    content,
+		Components: components,
+	})
+	if err != nil {
+		log.Printf("Error posting draft: %v", err)
+		drafts.Lock()
+		delete(drafts.drafts, d.ID)
+		drafts.Unlock()
+		return
+	}
+
+	drafts.Lock()
+	d.MessageID = message.ID
+	drafts.Unlock()
+	scheduleDraftPick(s, db, d.ID, 0, timeout)
+}
+
+// Auto-pick for the captain if pick number picks is still open when the timer runs out
+func scheduleDraftPick(s *discordgo.Session, db *DB, draftID, picks int, timeout time.Duration) {
+	time.AfterFunc(timeout, func() {
+		drafts.Lock()
+		d := drafts.drafts[draftID]
+		if d == nil || d.Picks != picks {
+			drafts.Unlock()
+			return
+		}
+		captain := d.Captains[d.captainToPick()]
+		player := d.autoPick()
+		d.Deadline = time.Now().Add(timeout)
+		drafts.Unlock()
+
+		s.ChannelMessageSend(d.ChannelID, fmt.Sprintf("%s ran out of time, %s was picked for them.", captain.PlayerName, player.PlayerName))
+		advanceDraft(s, db, d, timeout)
+	})
+}
+
+// Show the draft after a pick, or form the lobby once everyone is picked
+func advanceDraft(s *discordgo.Session, db *DB, d *Draft, timeout time.Duration) {
+	drafts.Lock()
+	// A quick second pick may already have finished the draft
+	if drafts.drafts[d.ID] != d {
+		drafts.Unlock()
+		return
+	}
+	if !d.done() {
+		picks := d.Picks
+		content, components := d.content(), d.components()
+		drafts.Unlock()
+
+		edit := discordgo.NewMessageEdit(d.ChannelID, d.MessageID).SetContent(content)
+		edit.Components = &components
+		if _, err := s.ChannelMessageEditComplex(edit); err != nil {
+			log.Printf("Error updating draft %d: %v", d.ID, err)
+		}
+		scheduleDraftPick(s, db, d.ID, picks, timeout)
+		return
+	}
+	delete(drafts.drafts, d.ID)
+	split := d.split()
+	drafts.Unlock()
+
+	content := fmt.Sprintf("**Captain draft finished**\nTeam 1: %s\nTeam 2: %s", getTeamNames(split.Team1), getTeamNames(split.Team2))
+	edit := discordgo.NewMessageEdit(d.ChannelID, d.MessageID).SetContent(content)
+	edit.Components = &[]discordgo.MessageComponent{}
+	if _, err := s.ChannelMessageEditComplex(edit); err != nil {
+		log.Printf("Error closing draft %d: %v", d.ID, err)
+	}
+
+	lobby, err := formLobby(db, d.GuildID, d.ChannelID, d.VoiceChannelID, split)
+	if err != nil {
+		s.ChannelMessageSend(d.ChannelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	recordRotation(db, lobby, d.Bench, d.SessionStart)
+	announceLobby(s, d.ChannelID, lobby, split)
+}
+
+// Handle a captain's pick from the draft select menu
+func handleDraftPick(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	data := i.MessageComponentData()
+	draftID, err := strconv.Atoi(strings.TrimPrefix(data.CustomID, "draft_pick_"))
+	if err != nil || len(data.Values) == 0 {
+		respondEphemeral(s, i.Interaction, "Invalid pick.")
+		return
+	}
+
+	cfg, err := db.GetGuildConfig(i.GuildID)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Error loading settings: %v", err))
+		return
+	}
+
+	drafts.Lock()
+	d := drafts.drafts[draftID]
+	if d == nil {
+		drafts.Unlock()
+		respondEphemeral(s, i.Interaction, "This draft is over.")
+		return
+	}
+	captain := d.Captains[d.captainToPick()]
+	if captain.PlayerID != i.Member.User.ID {
+		drafts.Unlock()
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("It is %s's turn to pick.", captain.PlayerName))
+		return
+	}
+	if err := d.pick(data.Values[0]); err != nil {
+		drafts.Unlock()
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Could not pick: %v", err))
+		return
+	}
+	d.Deadline = time.Now().Add(cfg.DraftPickTimeout)
+	drafts.Unlock()
+
+	// The message itself is updated by advanceDraft
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	advanceDraft(s, db, d, cfg.DraftPickTimeout)
+}
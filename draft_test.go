@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDraftSnakeOrder(t *testing.T) {
+	players := getTestPlayers([]string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"})
+	d := newDraft(players[0], players[1], players[2:], &EloRatingSystem{})
+
+	// Captains pick A, B, B, A, A, B, ...
+	expected := []int{0, 1, 1, 0, 0, 1, 1}
+	for pick, team := range expected {
+		if d.captainToPick() != team {
+			t.Fatalf("pick %d should be made by captain %d, got %d", pick+1, team+1, d.captainToPick()+1)
+		}
+		if pick == 0 {
+			if err := d.pick("j"); err != nil {
+				t.Fatalf("Error picking: %v", err)
+			}
+			continue
+		}
+		d.autoPick()
+	}
+
+	// The last player is assigned without a pick
+	if !d.done() {
+		t.Fatalf("expected the draft to be done, %d players left", len(d.Pool))
+	}
+	if got := d.Teams[0].GetPlayerIDs(); got != "a,j,e,f,i" {
+		t.Fatalf("unexpected team 1: %s", got)
+	}
+	if got := d.Teams[1].GetPlayerIDs(); got != "b,c,d,g,h" {
+		t.Fatalf("unexpected team 2: %s", got)
+	}
+	if err := d.pick("a"); err == nil {
+		t.Fatalf("expected an error picking a player twice")
+	}
+}
+
+func TestFinishedDraftIsNotAdvanced(t *testing.T) {
+	players := getTestPlayers([]string{"a", "b", "c", "d"})
+	d := newDraft(players[0], players[1], players[2:], &EloRatingSystem{})
+	d.pick("c")
+
+	// The draft is no longer running, so a late second pick must not form
+	// another lobby; it returns before touching the session or the database
+	advanceDraft(nil, nil, d, time.Minute)
+}
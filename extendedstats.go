@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// StatField is a stat beyond kills, assists and deaths. Its values are stored
+// by key, so a stat can be added here without changing the schema, and
+// imports or server logs can fill them in through PlayerStats.Extra.
+type StatField struct {
+	Key   string
+	Label string
+	// Decimal stats take fractions, the others are counts
+	Decimal bool
+	// Average stats are shown as the average per match in !stats, the others
+	// as the total
+	Average bool
+	// limit is the most a player can have in a match of the given rounds
+	// against the given number of opponents
+	limit func(rounds, opponents int) float64
+}
+
+func perRound(rounds, opponents int) float64 { return float64(rounds) }
+
+// multiKills is the limit of rounds with k kills, which needs k opponents
+func multiKills(k int) func(rounds, opponents int) float64 {
+	return func(rounds, opponents int) float64 {
+		if opponents < k {
+			return 0
+		}
+		return float64(rounds)
+	}
+}
+
+// extendedStats lists the extended stats in the order of the modal pages
+var extendedStats = []StatField{
+	{Key: "adr", Label: "ADR", Decimal: true, Average: true, limit: func(rounds, opponents int) float64 { return 100 * float64(opponents) }},
+	{Key: "hs_percent", Label: "Headshot %", Decimal: true, Average: true, limit: func(rounds, opponents int) float64 { return 100 }},
+	{Key: "mvps", Label: "MVPs", limit: perRound},
+	{Key: "utility_damage", Label: "Utility Damage", Average: true, limit: func(rounds, opponents int) float64 { return 100 * float64(rounds*opponents) }},
+	{Key: "entry_kills", Label: "Entry Kills", limit: perRound},
+	{Key: "2k", Label: "2K Rounds", limit: multiKills(2)},
+	{Key: "3k", Label: "3K Rounds", limit: multiKills(3)},
+	{Key: "4k", Label: "4K Rounds", limit: multiKills(4)},
+	{Key: "5k", Label: "5K Rounds", limit: multiKills(5)},
+	{Key: "clutches", Label: "Clutches Won", limit: perRound},
+}
+
+// Discord modals hold at most five inputs
+const modalInputs = 5
+
+// statPages splits the extended stats into the pages of the modal flow
+func statPages() [][]StatField {
+	var pages [][]StatField
+	for start := 0; start < len(extendedStats); start += modalInputs {
+		end := start + modalInputs
+		if end > len(extendedStats) {
+			end = len(extendedStats)
+		}
+		pages = append(pages, extendedStats[start:end])
+	}
+	return pages
+}
+
+func findStatField(key string) (*StatField, bool) {
+	for i := range extendedStats {
+		if extendedStats[i].Key == key {
+			return &extendedStats[i], true
+		}
+	}
+	return nil, false
+}
+
+// checkExtendedStats rejects unknown extended stats and values a player cannot
+// have had in a match of the given rounds against the given opponents
+func checkExtendedStats(extra map[string]float64, rounds, opponents int) error {
+	for key, value := range extra {
+		field, ok := findStatField(key)
+		if !ok {
+			return fmt.Errorf("unknown stat %q", key)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("%s must be a number", field.Label)
+		}
+		if value < 0 {
+			return fmt.Errorf("%s cannot be negative", field.Label)
+		}
+		if !field.Decimal && value != math.Trunc(value) {
+			return fmt.Errorf("%s must be a whole number", field.Label)
+		}
+		if limit := field.limit(rounds, opponents); value > limit {
+			return fmt.Errorf("%s of %g is not possible in %d rounds against %d players", field.Label, value, rounds, opponents)
+		}
+	}
+	return nil
+}
+
+// mergeStatValues returns the extended stats of base with those of update
+// taking precedence
+func mergeStatValues(base, update map[string]float64) map[string]float64 {
+	merged := make(map[string]float64)
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range update {
+		merged[key] = value
+	}
+	return merged
+}
+
+// Describe the extended stats that were reported, in the order of extendedStats
+func describeExtendedStats(extra map[string]float64) string {
+	var parts []string
+	for _, field := range extendedStats {
+		if value, ok := extra[field.Key]; ok {
+			parts = append(parts, fmt.Sprintf("%s %g", field.Label, value))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Replace the extended stats of a player's performance
+func saveStatValues(exec execer, matchID int, playerID string, extra map[string]float64) error {
+	if _, err := exec.Exec("DELETE FROM player_stat_values WHERE MatchID = ? AND PlayerID = ?", matchID, playerID); err != nil {
+		return err
+	}
+	for key, value := range extra {
+		_, err := exec.Exec("INSERT INTO player_stat_values (MatchID, PlayerID, Stat, Value) VALUES (?, ?, ?, ?)", matchID, playerID, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retrieve extended stats keyed by match and player
+func queryStatValues(q querier, where string, args ...interface{}) (map[int]map[string]map[string]float64, error) {
+	rows, err := q.Query("SELECT MatchID, PlayerID, Stat, Value FROM player_stat_values "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[int]map[string]map[string]float64)
+	for rows.Next() {
+		var matchID int
+		var playerID, key string
+		var value float64
+		if err := rows.Scan(&matchID, &playerID, &key, &value); err != nil {
+			return nil, err
+		}
+		if values[matchID] == nil {
+			values[matchID] = make(map[string]map[string]float64)
+		}
+		if values[matchID][playerID] == nil {
+			values[matchID][playerID] = make(map[string]float64)
+		}
+		values[matchID][playerID][key] = value
+	}
+	return values, rows.Err()
+}
+
+// attachStatValues adds the extended stats to the performances of a match
+func attachStatValues(performances map[string]PlayerStats, values map[string]map[string]float64) {
+	for playerID, stats := range performances {
+		if extra, ok := values[playerID]; ok {
+			stats.Extra = extra
+			performances[playerID] = stats
+		}
+	}
+}
+
+// ExtendedStatTotal sums a player's extended stat over their rated matches
+type ExtendedStatTotal struct {
+	Matches int
+	Total   float64
+}
+
+// Retrieve a player's extended stats summed over the rated matches of a guild
+func (db *DB) GetExtendedStatTotals(guildID, playerID string) (map[string]ExtendedStatTotal, error) {
+	rows, err := db.db.Query(`
+		SELECT v.Stat, COUNT(*), SUM(v.Value)
+		FROM player_stat_values v JOIN matches m ON m.MatchID = v.MatchID
+		WHERE m.GuildID = ? AND v.PlayerID = ? AND m.Status = ?
+		GROUP BY v.Stat
+	`, guildID, playerID, MatchStatusFinalized)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]ExtendedStatTotal)
+	for rows.Next() {
+		var key string
+		var total ExtendedStatTotal
+		if err := rows.Scan(&key, &total.Matches, &total.Total); err != nil {
+			return nil, err
+		}
+		totals[key] = total
+	}
+	return totals, rows.Err()
+}
+
+// Build the !stats fields of a player's extended stats
+func extendedStatFields(totals map[string]ExtendedStatTotal) []*discordgo.MessageEmbedField {
+	var fields []*discordgo.MessageEmbedField
+	for _, field := range extendedStats {
+		total, ok := totals[field.Key]
+		if !ok {
+			continue
+		}
+		value := fmt.Sprintf("%g", total.Total)
+		if field.Average {
+			value = fmt.Sprintf("%.1f", total.Total/float64(total.Matches))
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{Name: field.Label, Value: value, Inline: true})
+	}
+	return fields
+}
+
+// A button to open a page of extended stats after reporting the basic ones
+func statPageButton(matchID int, playerID string, page int) discordgo.ActionsRow {
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.Button{
+				Label:    fmt.Sprintf("More Stats (%d/%d)", page+1, len(statPages())),
+				CustomID: fmt.Sprintf("stats_page_%d_%s_%d", matchID, playerID, page),
+				Style:    discordgo.SecondaryButton,
+			},
+		},
+	}
+}
+
+// parseStatPageID reads the match, player and page of a stats page custom ID
+func parseStatPageID(customID, prefix string) (int, string, int, error) {
+	parts := strings.Split(strings.TrimPrefix(customID, prefix), "_")
+	if len(parts) != 3 {
+		return 0, "", 0, fmt.Errorf("invalid custom ID %q", customID)
+	}
+	matchID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", 0, err
+	}
+	page, err := strconv.Atoi(parts[2])
+	if err != nil || page < 0 || page >= len(statPages()) {
+		return 0, "", 0, fmt.Errorf("invalid page in %q", customID)
+	}
+	return matchID, parts[1], page, nil
+}
+
+// Handle the "More Stats" button by showing a page of extended stats,
+// filled in with the values reported so far
+func showStatPageModal(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	matchID, playerID, page, err := parseStatPageID(i.MessageComponentData().CustomID, "stats_page_")
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Invalid interaction data.")
+		return
+	}
+	if playerID != i.Member.User.ID {
+		respondEphemeral(s, i.Interaction, "You can only report your own stats.")
+		return
+	}
+	stats, reported, err := db.GetPerformance(matchID, playerID)
+	if err != nil || !reported {
+		respondEphemeral(s, i.Interaction, "Please report your kills, assists and deaths first.")
+		return
+	}
+
+	var rows []discordgo.MessageComponent
+	for _, field := range statPages()[page] {
+		value := ""
+		if v, ok := stats.Extra[field.Key]; ok {
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		rows = append(rows, discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.TextInput{
+					CustomID: field.Key,
+					Label:    field.Label,
+					Style:    discordgo.TextInputShort,
+					Value:    value,
+					Required: false,
+				},
+			},
+		})
+	}
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID:   fmt.Sprintf("stats_page_modal_%d_%s_%d", matchID, playerID, page),
+			Title:      fmt.Sprintf("More Stats (%d/%d)", page+1, len(statPages())),
+			Components: rows,
+		},
+	})
+}
+
+// Store a page of extended stats, offering the next page if there is one.
+// Leaving an input empty removes the stat.
+func handleStatPageSubmission(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	data := i.ModalSubmitData()
+	matchID, playerID, page, err := parseStatPageID(data.CustomID, "stats_page_modal_")
+	if err != nil || playerID != i.Member.User.ID {
+		respondEphemeral(s, i.Interaction, "Invalid interaction data.")
+		return
+	}
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Match not found.")
+		return
+	}
+	if !match.statsOpen() {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Match %d is %s, stats can no longer be reported.", matchID, match.Status))
+		return
+	}
+	stats, reported, err := db.GetPerformance(matchID, playerID)
+	if err != nil || !reported {
+		respondEphemeral(s, i.Interaction, "Please report your kills, assists and deaths first.")
+		return
+	}
+
+	extra := make(map[string]float64)
+	for key, value := range stats.Extra {
+		extra[key] = value
+	}
+	for _, c := range data.Components {
+		for _, innerC := range c.(*discordgo.ActionsRow).Components {
+			input := innerC.(*discordgo.TextInput)
+			field, ok := findStatField(input.CustomID)
+			if !ok {
+				continue
+			}
+			text := strings.TrimSuffix(strings.TrimSpace(input.Value), "%")
+			if text == "" {
+				delete(extra, field.Key)
+				continue
+			}
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				respondEphemeral(s, i.Interaction, fmt.Sprintf("Invalid input for %s.", field.Label))
+				return
+			}
+			extra[field.Key] = value
+		}
+	}
+	stats.Extra = extra
+	if err := match.checkStats(playerID, stats); err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Invalid stats: %v.", err))
+		return
+	}
+	if err := db.ReportPerformance(matchID, playerID, i.Member.User.ID, stats); err != nil {
+		respondEphemeral(s, i.Interaction, "Error saving your stats.")
+		return
+	}
+
+	response := &discordgo.InteractionResponseData{
+		Content: "Your extra stats have been recorded.",
+		Flags:   discordgo.MessageFlagsEphemeral,
+	}
+	if page+1 < len(statPages()) {
+		response.Components = []discordgo.MessageComponent{statPageButton(matchID, playerID, page+1)}
+	}
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: response,
+	})
+}
+
+// Retrieve the extended stats of a single performance
+func getStatValues(q querier, matchID int, playerID string) (map[string]float64, error) {
+	values, err := queryStatValues(q, "WHERE MatchID = ? AND PlayerID = ?", matchID, playerID)
+	if err != nil {
+		return nil, err
+	}
+	return values[matchID][playerID], nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStatPages(t *testing.T) {
+	seen := 0
+	for _, page := range statPages() {
+		if len(page) == 0 || len(page) > modalInputs {
+			t.Fatalf("expected pages of one to %d stats, got %d", modalInputs, len(page))
+		}
+		seen += len(page)
+	}
+	if seen != len(extendedStats) {
+		t.Fatalf("expected every stat on a page, got %d of %d", seen, len(extendedStats))
+	}
+}
+
+func TestCheckExtendedStats(t *testing.T) {
+	match := newTestMatch([]int{1000, 1000}, []int{1000, 1000})
+	match.WinnerScore, match.LoserScore = 13, 7
+
+	tests := []struct {
+		extra map[string]float64
+		valid bool
+	}{
+		{map[string]float64{"adr": 87.5, "hs_percent": 45, "2k": 3}, true},
+		{map[string]float64{"hs_percent": 120}, false},
+		{map[string]float64{"adr": -1}, false},
+		{map[string]float64{"mvps": 2.5}, false},
+		{map[string]float64{"3k": 1}, false},
+		{map[string]float64{"aces": 1}, false},
+		{map[string]float64{"adr": math.NaN()}, false},
+		{map[string]float64{"utility_damage": math.Inf(1)}, false},
+	}
+	for _, test := range tests {
+		err := match.checkStats("a", PlayerStats{Kills: 10, Deaths: 10, Extra: test.extra})
+		if (err == nil) != test.valid {
+			t.Errorf("checkStats(%v) = %v, expected valid %t", test.extra, err, test.valid)
+		}
+	}
+}
+
+func TestExtendedStats(t *testing.T) {
+	db := newTestDB(t)
+	matchIDs := []int{
+		createTestMatch(t, db, []string{"a"}, []string{"b"}),
+		createTestMatch(t, db, []string{"a"}, []string{"b"}),
+	}
+	for n, matchID := range matchIDs {
+		db.ReportMatchResult(matchID, 1)
+		stats := PlayerStats{Kills: 15, Deaths: 10, Extra: map[string]float64{"adr": 80 + 20*float64(n), "mvps": 4}}
+		if err := db.ReportPerformance(matchID, "a", "a", stats); err != nil {
+			t.Fatalf("Error reporting stats: %v", err)
+		}
+	}
+
+	// A second page replaces the extended stats but keeps the rest
+	stats, _, err := db.GetPerformance(matchIDs[1], "a")
+	if err != nil || stats.Extra["adr"] != 100 {
+		t.Fatalf("expected the reported ADR, got %v, %v", stats, err)
+	}
+	stats.Extra = map[string]float64{"adr": 100, "mvps": 6}
+	if err := db.ReportPerformance(matchIDs[1], "a", "a", stats); err != nil {
+		t.Fatalf("Error editing stats: %v", err)
+	}
+	if performances, _ := db.GetRecordedPerformances(matchIDs[1]); performances["a"].Kills != 15 || performances["a"].Extra["mvps"] != 6 {
+		t.Fatalf("expected the edited stats, got %v", performances)
+	}
+
+	// Only rated matches count, averaging ADR and adding up MVPs
+	if totals, _ := db.GetExtendedStatTotals(testGuildID, "a"); len(totals) != 0 {
+		t.Fatalf("expected no totals before the matches are rated, got %v", totals)
+	}
+	for _, matchID := range matchIDs {
+		if _, err := ForceConfirmMatch(db, matchID); err != nil {
+			t.Fatalf("Error confirming match: %v", err)
+		}
+	}
+	totals, err := db.GetExtendedStatTotals(testGuildID, "a")
+	if err != nil {
+		t.Fatalf("Error loading totals: %v", err)
+	}
+	fields := extendedStatFields(totals)
+	if len(fields) != 2 || fields[0].Name != "ADR" || fields[0].Value != "90.0" || fields[1].Value != "10" {
+		t.Fatalf("unexpected !stats fields: %v", fields)
+	}
+	if performances, _ := db.GetAllPerformances(testGuildID); performances[matchIDs[0]]["a"].Extra["adr"] != 80 {
+		t.Fatalf("expected extended stats with every performance, got %v", performances[matchIDs[0]])
+	}
+}
@@ -2,11 +2,15 @@ module discord-bot
 
 go 1.22
 
+require (
+	github.com/bwmarrin/discordgo v0.28.1
+	modernc.org/sqlite v1.33.1
+)
+
 require (
 	github.com/asdine/storm/v3 v3.2.1 // indirect
 	github.com/br0xen/boltbrowser v0.0.0-20230531143731-fcc13603daaf // indirect
 	github.com/br0xen/termbox-util v0.0.0-20170904143325-de1d4c83380e // indirect
-	github.com/bwmarrin/discordgo v0.28.1 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
@@ -24,7 +28,6 @@ require (
 	modernc.org/libc v1.55.3 // indirect
 	modernc.org/mathutil v1.6.0 // indirect
 	modernc.org/memory v1.8.0 // indirect
-	modernc.org/sqlite v1.33.1 // indirect
 	modernc.org/strutil v1.2.0 // indirect
 	modernc.org/token v1.1.0 // indirect
 )
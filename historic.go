@@ -20,10 +20,12 @@ type PlayerStats struct {
 	Kills   int `json:"kills"`
 	Assists int `json:"assists"`
 	Deaths  int `json:"deaths"`
+	// Extra holds the extended stats by key, see extendedStats
+	Extra map[string]float64 `json:"extra,omitempty"`
 }
 
-// Import historical data from a JSON file
-func ImportHistoricalData(filename string, db *DB, discord *Discord) {
+// Import historical data from a JSON file into a guild's ladder
+func ImportHistoricalData(filename, guildID string, db *DB, discord *Discord) {
 	// Open and read the JSON file
 	jsonFile, err := os.Open(filename)
 	if err != nil {
@@ -50,7 +52,7 @@ func ImportHistoricalData(filename string, db *DB, discord *Discord) {
 			fmt.Printf("Processing match: %s\n", gameID)
 
 			// Process the match data
-			err := processHistoricalMatchData(match, db, discord)
+			err := processHistoricalMatchData(match, guildID, db, discord)
 			if err != nil {
 				log.Printf("Error processing match %s: %v", gameID, err)
 			}
@@ -59,7 +61,7 @@ func ImportHistoricalData(filename string, db *DB, discord *Discord) {
 }
 
 // Process each match and save it to the database
-func processHistoricalMatchData(match MatchData, db *DB, discord *Discord) error {
+func processHistoricalMatchData(match MatchData, guildID string, db *DB, discord *Discord) error {
 	// Create Winner Team
 	winnerTeam := &Team{
 		Name:    "Winner",
@@ -72,40 +74,38 @@ func processHistoricalMatchData(match MatchData, db *DB, discord *Discord) error
 		Players: []*Player{},
 	}
 
+	// Per-match stats, added to the player totals when the match is saved
+	performances := make(map[string]PlayerStats)
+
 	// Process winner players
 	for playerID, stats := range match.Winner {
-		player, err := getOrCreatePlayer(playerID, db, discord)
+		player, err := getOrCreatePlayer(guildID, playerID, db, discord)
 		if err != nil {
 			return fmt.Errorf("error retrieving or creating player %s: %v", playerID, err)
 		}
 
-		// Update player stats
-		player.Kills += stats.Kills
-		player.Assists += stats.Assists
-		player.Deaths += stats.Deaths
+		performances[playerID] = stats
 		winnerTeam.Players = append(winnerTeam.Players, player)
 	}
 
 	// Process loser players
 	for playerID, stats := range match.Loser {
-		player, err := getOrCreatePlayer(playerID, db, discord)
+		player, err := getOrCreatePlayer(guildID, playerID, db, discord)
 		if err != nil {
 			return fmt.Errorf("error retrieving or creating player %s: %v", playerID, err)
 		}
 
-		// Update player stats
-		player.Kills += stats.Kills
-		player.Assists += stats.Assists
-		player.Deaths += stats.Deaths
-
+		performances[playerID] = stats
 		loserTeam.Players = append(loserTeam.Players, player)
 	}
 
 	// Create Match instance
 	matchInstance := &Match{
-		Winner: winnerTeam,
-		Loser:  loserTeam,
-		db:     db,
+		GuildID:      guildID,
+		Winner:       winnerTeam,
+		Loser:        loserTeam,
+		db:           db,
+		Performances: performances,
 	}
 
 	// Save the match and update MMR
@@ -118,9 +118,9 @@ func processHistoricalMatchData(match MatchData, db *DB, discord *Discord) error
 }
 
 // Helper function to get or create a player
-func getOrCreatePlayer(playerID string, db *DB, discord *Discord) (*Player, error) {
-	// Try to get the player from the database
-	player, err := db.GetPlayer(playerID)
+func getOrCreatePlayer(guildID, playerID string, db *DB, discord *Discord) (*Player, error) {
+	// Try to get the player from the guild's ladder
+	player, err := db.GetPlayer(guildID, playerID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// Player does not exist, create a new one
@@ -132,18 +132,7 @@ func getOrCreatePlayer(playerID string, db *DB, discord *Discord) (*Player, erro
 				playerName = playerID // Fallback to playerID if username is not found
 			}
 
-			player = &Player{
-				PlayerID:    playerID,
-				PlayerName:  playerName,
-				CoreMember:  false, // Adjust as necessary
-				MMR:         1000,  // Default starting MMR
-				GamesPlayed: 0,
-				Wins:        0,
-				Kills:       0,
-				Assists:     0,
-				Deaths:      0,
-				Sniper:      false,
-			}
+			player = NewPlayer(guildID, playerID, playerName)
 			// Save the new player to the database
 			err = db.SavePlayer(player)
 			if err != nil {
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"strings"
+	"time"
+)
+
+// MatchStatus is the stage of a match in its lifecycle
+type MatchStatus string
+
+const (
+	MatchStatusCreated   MatchStatus = "created"   // teams formed
+	MatchStatusLive      MatchStatus = "live"      // being played
+	MatchStatusPending   MatchStatus = "pending"   // result reported, waiting for confirmation
+	MatchStatusConfirmed MatchStatus = "confirmed" // result accepted, ready to be rated
+	MatchStatusDisputed  MatchStatus = "disputed"  // frozen for admin review
+	MatchStatusFinalized MatchStatus = "finalized" // rated and counted on the ladder
+	MatchStatusVoided    MatchStatus = "voided"    // discarded
+)
+
+// matchTransitions lists the statuses a match may move to from each status.
+// Every status change goes through transitionMatch, which enforces this table.
+var matchTransitions = map[MatchStatus][]MatchStatus{
+	MatchStatusCreated:   {MatchStatusLive, MatchStatusVoided},
+	MatchStatusLive:      {MatchStatusPending, MatchStatusVoided},
+	MatchStatusPending:   {MatchStatusConfirmed, MatchStatusDisputed, MatchStatusVoided},
+	MatchStatusDisputed:  {MatchStatusConfirmed, MatchStatusVoided},
+	MatchStatusConfirmed: {MatchStatusFinalized, MatchStatusVoided},
+	MatchStatusFinalized: {MatchStatusVoided},
+}
+
+func canTransition(from, to MatchStatus) bool {
+	for _, next := range matchTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	execer
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// transitionMatch moves a match to a new status if the lifecycle allows it.
+// The current status is checked in the UPDATE itself so concurrent button
+// clicks cannot apply the same transition twice.
+func transitionMatch(q querier, matchID int, to MatchStatus) error {
+	set := "Status = ?"
+	args := []interface{}{to}
+	if to == MatchStatusConfirmed {
+		// The stats deadline runs from the confirmation
+		set += ", ConfirmedAt = ?"
+		args = append(args, time.Now().UTC())
+	}
+	args = append(args, matchID)
+
+	var from []string
+	for status := range matchTransitions {
+		if canTransition(status, to) {
+			from = append(from, "?")
+			args = append(args, status)
+		}
+	}
+
+	result, err := q.Exec(fmt.Sprintf("UPDATE matches SET %s WHERE MatchID = ? AND Status IN (%s)", set, strings.Join(from, ", ")), args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	var current MatchStatus
+	if err := q.QueryRow("SELECT Status FROM matches WHERE MatchID = ?", matchID).Scan(&current); err != nil {
+		return err
+	}
+	return fmt.Errorf("match %d is %s and cannot become %s", matchID, current, to)
+}
+
+// TransitionMatch moves a match to a new status if the lifecycle allows it
+func (db *DB) TransitionMatch(matchID int, to MatchStatus) error {
+	return transitionMatch(db.db, matchID, to)
+}
+
+// WinningTeam of a match that ended in a draw
+const drawResult = 0
+
+// Report the winner of a match, or drawResult for a tie; the match goes live
+// first if nobody started it
+func (db *DB) ReportMatchResult(matchID, winningTeam int) error {
+	return db.ReportScoredMatchResult(matchID, winningTeam, 0, 0)
+}
+
+// Report the result of a match like ReportMatchResult together with its round
+// score, so the result is never stored without the score it was reported with.
+// A 0-0 score stores no score.
+func (db *DB) ReportScoredMatchResult(matchID, winningTeam, winnerScore, loserScore int) error {
+	if winningTeam != 1 && winningTeam != 2 && winningTeam != drawResult {
+		return fmt.Errorf("invalid winning team %d", winningTeam)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status MatchStatus
+	if err := tx.QueryRow("SELECT Status FROM matches WHERE MatchID = ?", matchID).Scan(&status); err != nil {
+		return err
+	}
+	if status == MatchStatusCreated {
+		if err := transitionMatch(tx, matchID, MatchStatusLive); err != nil {
+			return err
+		}
+	}
+	if err := transitionMatch(tx, matchID, MatchStatusPending); err != nil {
+		return err
+	}
+
+	hasScore := winnerScore+loserScore > 0
+	winner := sql.NullInt64{Int64: int64(winnerScore), Valid: hasScore}
+	loser := sql.NullInt64{Int64: int64(loserScore), Valid: hasScore}
+	_, err = tx.Exec(`
+		UPDATE matches SET
+			WinningTeam = ?,
+			Winner = CASE ? WHEN 1 THEN Team1 WHEN 2 THEN Team2 END,
+			Loser = CASE ? WHEN 1 THEN Team2 WHEN 2 THEN Team1 END,
+			Team1Score = CASE ? WHEN 2 THEN ? ELSE ? END,
+			Team2Score = CASE ? WHEN 2 THEN ? ELSE ? END,
+			ReportedAt = ?
+		WHERE MatchID = ?
+	`, winningTeam, winningTeam, winningTeam, winningTeam, loser, winner, winningTeam, winner, loser, time.Now().UTC(), matchID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Store the round score of a result waiting for confirmation. The margin of
+// victory can scale ratings, so a changed score drops the confirmations given
+// so far and the other side confirms the new score.
+func (db *DB) SetMatchScore(matchID, winnerScore, loserScore int) error {
+	return db.setMatchScore(matchID, winnerScore, loserScore, MatchStatusPending)
+}
+
+// CorrectMatchScore lets an admin change the round score of a reported result
+// until the match is finalized and its ratings are applied
+func (db *DB) CorrectMatchScore(matchID, winnerScore, loserScore int) error {
+	return db.setMatchScore(matchID, winnerScore, loserScore, MatchStatusPending, MatchStatusConfirmed, MatchStatusDisputed)
+}
+
+func (db *DB) setMatchScore(matchID, winnerScore, loserScore int, statuses ...MatchStatus) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status MatchStatus
+	var winningTeam, team1Score, team2Score sql.NullInt64
+	err = tx.QueryRow("SELECT Status, WinningTeam, Team1Score, Team2Score FROM matches WHERE MatchID = ?", matchID).
+		Scan(&status, &winningTeam, &team1Score, &team2Score)
+	if err != nil {
+		return err
+	}
+	if !winningTeam.Valid {
+		return fmt.Errorf("match %d has no result yet", matchID)
+	}
+	allowed := false
+	for _, s := range statuses {
+		allowed = allowed || s == status
+	}
+	if !allowed {
+		return fmt.Errorf("match %d is %s, its score can no longer be changed", matchID, status)
+	}
+
+	team1, team2 := winnerScore, loserScore
+	if winningTeam.Int64 == 2 {
+		team1, team2 = loserScore, winnerScore
+	}
+	if team1Score.Valid && team2Score.Valid && int(team1Score.Int64) == team1 && int(team2Score.Int64) == team2 {
+		return nil
+	}
+	if _, err := tx.Exec("UPDATE matches SET Team1Score = ?, Team2Score = ? WHERE MatchID = ?", team1, team2, matchID); err != nil {
+		return err
+	}
+	if status == MatchStatusPending {
+		if _, err := tx.Exec("DELETE FROM match_confirmations WHERE MatchID = ?", matchID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Record a player's confirmation of a result and return the players who
+// confirmed so far
+func (db *DB) AddMatchConfirmation(matchID int, playerID string) ([]string, error) {
+	_, err := db.db.Exec("INSERT OR IGNORE INTO match_confirmations (MatchID, PlayerID) VALUES (?, ?)", matchID, playerID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.db.Query("SELECT PlayerID FROM match_confirmations WHERE MatchID = ?", matchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var playerIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		playerIDs = append(playerIDs, id)
+	}
+	return playerIDs, rows.Err()
+}
+
+// UnconfirmedMatch is a pending result waiting for confirmation
+type UnconfirmedMatch struct {
+	MatchID    int
+	GuildID    string
+	ReportedAt time.Time
+}
+
+// Retrieve pending matches whose result was reported before the cutoff
+func (db *DB) GetUnconfirmedMatches(reportedBefore time.Time) ([]UnconfirmedMatch, error) {
+	rows, err := db.db.Query("SELECT MatchID, GuildID, ReportedAt FROM matches WHERE Status = ? AND ReportedAt <= ?", MatchStatusPending, reportedBefore.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []UnconfirmedMatch
+	for rows.Next() {
+		var match UnconfirmedMatch
+		var guildID sql.NullString
+		if err := rows.Scan(&match.MatchID, &guildID, &match.ReportedAt); err != nil {
+			return nil, err
+		}
+		match.GuildID = guildID.String
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
+
+// Number of losing players, or players of each team for a draw, that must
+// confirm a result before it is applied
+func requiredConfirmations(match *Match, cfg *Config) int {
+	required := cfg.ResultConfirmations
+	if required > len(match.Loser.Players) {
+		required = len(match.Loser.Players)
+	}
+	if match.Draw && required > len(match.Winner.Players) {
+		required = len(match.Winner.Players)
+	}
+	return required
+}
+
+func isPlayerInTeam(team *Team, playerID string) bool {
+	for _, player := range team.Players {
+		if player.PlayerID == playerID {
+			return true
+		}
+	}
+	return false
+}
+
+// countTeamConfirmations counts the players of a team among those who confirmed
+func countTeamConfirmations(team *Team, playerIDs []string) int {
+	count := 0
+	for _, playerID := range playerIDs {
+		if isPlayerInTeam(team, playerID) {
+			count++
+		}
+	}
+	return count
+}
+
+// ConfirmMatchResult records a confirmation from the losing side, or from
+// either side of a draw, and confirms the result once enough players did. A
+// draw has no losing side, so each team must confirm it; otherwise the team
+// that reported it could confirm its own report. The match is finalized right
+// away when every player already reported stats; it reports whether it was
+// finalized.
+func ConfirmMatchResult(db *DB, matchID int, playerID string) (bool, int, error) {
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		return false, 0, err
+	}
+	if match.Status != MatchStatusPending {
+		return false, 0, fmt.Errorf("match %d is %s, not waiting for confirmation", matchID, match.Status)
+	}
+	if match.Draw && !match.hasPlayer(playerID) {
+		return false, 0, fmt.Errorf("only players from this match can confirm the result")
+	}
+	if !match.Draw && !isPlayerInTeam(match.Loser, playerID) {
+		return false, 0, fmt.Errorf("only players from the losing team can confirm the result")
+	}
+
+	cfg, err := db.GetGuildConfig(match.GuildID)
+	if err != nil {
+		return false, 0, err
+	}
+	confirmed, err := db.AddMatchConfirmation(matchID, playerID)
+	if err != nil {
+		return false, 0, err
+	}
+	count := len(confirmed)
+	required := requiredConfirmations(match, cfg)
+	if countTeamConfirmations(match.Loser, confirmed) < required {
+		return false, count, nil
+	}
+	if match.Draw && countTeamConfirmations(match.Winner, confirmed) < required {
+		return false, count, nil
+	}
+
+	if err := db.TransitionMatch(matchID, MatchStatusConfirmed); err != nil {
+		return false, count, err
+	}
+	finalized, err := settleMatch(db, matchID)
+	return finalized != nil, count, err
+}
+
+// DisputeMatchResult freezes a reported result until an admin reviews it
+func DisputeMatchResult(db *DB, matchID int, playerID string) error {
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		return err
+	}
+	if !isPlayerInTeam(match.Winner, playerID) && !isPlayerInTeam(match.Loser, playerID) {
+		return fmt.Errorf("only players from this match can dispute the result")
+	}
+	return db.TransitionMatch(matchID, MatchStatusDisputed)
+}
+
+// ForceConfirmMatch accepts a pending or disputed result on behalf of an admin
+// and rates it right away with the stats reported so far
+func ForceConfirmMatch(db *DB, matchID int) (*Match, error) {
+	if err := db.TransitionMatch(matchID, MatchStatusConfirmed); err != nil {
+		return nil, err
+	}
+	return FinalizeMatch(db, matchID)
+}
+
+// FinalizeMatch applies the ratings of a confirmed match along with the stats
+// its players reported. Everything is loaded and rated before the ratings and
+// the finalized status are stored together, so a failure leaves the match
+// confirmed and it is rated on the next attempt.
+func FinalizeMatch(db *DB, matchID int) (*Match, error) {
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		return nil, err
+	}
+	if match.Status != MatchStatusConfirmed {
+		return nil, fmt.Errorf("match %d is %s and cannot become %s", matchID, match.Status, MatchStatusFinalized)
+	}
+	match.Performances, err = db.GetRecordedPerformances(matchID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get performances: %v", err)
+	}
+
+	rs, err := db.GetRatingSystem(match.GuildID)
+	if err != nil {
+		return nil, err
+	}
+	rateMatch(match, rs)
+	if err := db.FinalizeMatch(matchID, match.players()); err != nil {
+		return nil, err
+	}
+	match.Status = MatchStatusFinalized
+	return match, nil
+}
+
+// runResultTimeouts confirms results nobody confirmed or disputed in time, and
+// rates confirmed matches once their stats are in or the stats deadline passed
+func runResultTimeouts(s *discordgo.Session, db *DB) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Every guild has its own timeout, so look at all pending results
+		unconfirmed, err := db.GetUnconfirmedMatches(time.Now())
+		if err != nil {
+			log.Printf("Error checking unconfirmed matches: %v", err)
+			continue
+		}
+
+		for _, pending := range unconfirmed {
+			cfg, err := db.GetGuildConfig(pending.GuildID)
+			if err != nil {
+				log.Printf("Error loading settings of guild %s: %v", pending.GuildID, err)
+				continue
+			}
+			if time.Since(pending.ReportedAt) < cfg.ResultConfirmTimeout {
+				continue
+			}
+
+			matchID := pending.MatchID
+			if err := db.TransitionMatch(matchID, MatchStatusConfirmed); err != nil {
+				log.Printf("Error auto-confirming match %d: %v", matchID, err)
+				continue
+			}
+			if match, err := db.GetMatch(matchID); err == nil && match.ChannelID != "" {
+				s.ChannelMessageSend(match.ChannelID, fmt.Sprintf("Match %d was not disputed in time and has been confirmed.", matchID))
+			}
+		}
+
+		awaiting, err := db.GetMatchesAwaitingStats()
+		if err != nil {
+			log.Printf("Error checking matches awaiting stats: %v", err)
+			continue
+		}
+		for _, matchID := range awaiting {
+			match, err := settleMatch(db, matchID)
+			if err != nil {
+				log.Printf("Error rating match %d: %v", matchID, err)
+				continue
+			}
+			if match != nil && match.ChannelID != "" {
+				announceRatedMatch(s, match.ChannelID, match)
+			}
+		}
+	}
+}
+
+// Announce that a match was rated, naming the players who reported no stats
+func announceRatedMatch(s *discordgo.Session, channelID string, match *Match) {
+	content := fmt.Sprintf("Match %d has been rated. Ratings updated.", match.MatchID)
+	if missing := match.missingStats(match.Performances); len(missing) > 0 {
+		content += fmt.Sprintf("\nNo stats were reported by %s.", mentionPlayers(missing))
+	}
+	s.ChannelMessageSend(channelID, content)
+}
+
+// Post the reported result with buttons to confirm or dispute it
+func sendResultConfirmationPrompt(s *discordgo.Session, channelID string, match *Match, cfg *Config) {
+	winningTeam, losingTeam := match.Winner, match.Loser
+	score := ""
+	if match.HasScore() {
+		score = fmt.Sprintf(" %d-%d", match.WinnerScore, match.LoserScore)
+	}
+	if match.Map != "" {
+		score += " on " + match.Map
+	}
+	content := fmt.Sprintf("Match %d reported: Team %d won%s!\nWinners: %s\nLosers: %s\n%d player(s) from the losing team must confirm. The result is confirmed automatically after %s unless disputed.",
+		match.MatchID, match.WinningTeam, score, getTeamNames(winningTeam), getTeamNames(losingTeam), requiredConfirmations(match, cfg), cfg.ResultConfirmTimeout)
+	if match.Draw {
+		content = fmt.Sprintf("Match %d reported as a draw%s.\nTeam 1: %s\nTeam 2: %s\n%d player(s) from each team must confirm. The result is confirmed automatically after %s unless disputed.",
+			match.MatchID, score, getTeamNames(winningTeam), getTeamNames(losingTeam), requiredConfirmations(match, cfg), cfg.ResultConfirmTimeout)
+	}
+
+	buttons := []discordgo.MessageComponent{
+		discordgo.Button{
+			Label:    "Confirm",
+			CustomID: fmt.Sprintf("confirm_result_%d", match.MatchID),
+			Style:    discordgo.SuccessButton,
+		},
+		discordgo.Button{
+			Label:    "Dispute",
+			CustomID: fmt.Sprintf("dispute_result_%d", match.MatchID),
+			Style:    discordgo.DangerButton,
+		},
+	}
+	if !match.HasScore() {
+		buttons = append(buttons, discordgo.Button{
+			Label:    "Set score",
+			CustomID: fmt.Sprintf("report_score_%d", match.MatchID),
+			Style:    discordgo.SecondaryButton,
+		})
+	}
+	components := []discordgo.MessageComponent{discordgo.ActionsRow{Components: buttons}}
+	if match.Map == "" {
+		components = append(components, mapSelectMenu(match.MatchID))
+	}
+	s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:    content,
+		Components: components,
+	})
+}
@@ -9,6 +9,20 @@ import (
 )
 
 func main() {
+	// Load configuration; guilds can override it with !settings
+	config = LoadConfig()
+	if _, err := NewRatingSystem(config.RatingSystem); err != nil {
+		log.Fatalf("Error selecting rating system: %v", err)
+	}
+
+	// Subcommands run against the database without connecting to Discord
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplayCLI(os.Args[2:]); err != nil {
+			log.Fatalf("Error replaying matches: %v", err)
+		}
+		return
+	}
+
 	// Initialize the database
 	db, err := InitDB("match_data.db")
 	if err != nil {
@@ -40,16 +54,29 @@ func main() {
 	// Create a Discord instance from the session
 	discordInstance := NewDiscord(dg)
 
-	hasMatches, err := db.HasMatches()
+	// Players kept from before per-guild ladders belong to the bot's only guild
+	if len(dg.State.Guilds) == 1 {
+		guildID := dg.State.Guilds[0].ID
+		if claimed, err := db.ClaimLegacyData(guildID); err != nil {
+			log.Printf("Error claiming existing players: %v", err)
+		} else if claimed > 0 {
+			fmt.Printf("Moved %d existing players into guild %s.\n", claimed, guildID)
+		}
+	}
+
+	// Historical data belongs to the guild the bot was first deployed in
+	hasMatches, err := db.HasMatches(config.LegacyGuildID)
 	if err != nil {
 		log.Fatalf("Error checking for existing matches: %v", err)
 	}
 
-	if !hasMatches {
+	if config.LegacyGuildID == "" {
+		fmt.Println("LEGACY_GUILD_ID is not set. Skipping historical data import.")
+	} else if !hasMatches {
 		// Import historical data if no matches exist
 		fmt.Println("No existing matches found. Importing historical data...")
 		// Replace "historical_data.json" with the path to your historical data file
-		ImportHistoricalData("historical_data.json", db, discordInstance)
+		ImportHistoricalData("historical_data.json", config.LegacyGuildID, db, discordInstance)
 		fmt.Println("Historical data import completed.")
 	} else {
 		fmt.Println("Existing matches found. Skipping historical data import.")
@@ -65,6 +92,9 @@ func main() {
 		handleInteraction(s, i, db)
 	})
 
+	// Apply results nobody confirmed or disputed in time
+	go runResultTimeouts(dg, db)
+
 	// Keep the program running
 	select {}
 }
@@ -85,14 +115,52 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate, db *DB, d
 	switch command {
 	case "!teams":
 		handleTeamsCommand(s, m, args, db, discordInstance)
+	case "!draft":
+		draftCommand(s, m, args, db, discordInstance)
+	case "!join":
+		joinQueueCommand(s, m, db)
+	case "!leave":
+		leaveQueueCommand(s, m, db)
+	case "!queue":
+		queueCommand(s, m, db)
+	case "!bench":
+		benchCommand(s, m, args, db)
+	case "!sub":
+		substituteCommand(s, m, args, db, discordInstance)
 	case "!win":
 		handleWinCommand(s, m, args, db)
+	case "!draw":
+		handleDrawCommand(s, m, args, db)
 	//case "!end":
 	//	handleEndSessionCommand(s, m, args, db)
 	case "!stats":
 		playerStatsCommand(s, m, args, db, discordInstance)
+	case "!start":
+		startMatchCommand(s, m, args, db)
+	case "!lobbies":
+		lobbiesCommand(s, m, db)
+	case "!confirm":
+		confirmMatchCommand(s, m, args, db)
+	case "!void":
+		voidMatchCommand(s, m, args, db)
+	case "!replay":
+		replayCommand(s, m, args, db)
+	case "!claimladder":
+		claimLadderCommand(s, m, db)
+	case "!sniper":
+		sniperCommand(s, m, args, db, discordInstance)
+	case "!settings":
+		settingsCommand(s, m, args, db)
+	case "!scoreboard":
+		scoreboardCommand(s, m, args, db)
+	case "!statslog":
+		statsLogCommand(s, m, args, db)
+	case "!maps":
+		mapsCommand(s, m, args, db)
+	case "!synergy":
+		synergyCommand(s, m, args, db)
 	case "!elograph":
 		playerID := m.Author.ID
-		eloGraphCommand(s, m.ChannelID, playerID, db)
+		eloGraphCommand(s, m.ChannelID, m.GuildID, playerID, db)
 	}
 }
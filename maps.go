@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The maps that can be recorded for a match
+var mapPool = []string{"ancient", "anubis", "dust2", "inferno", "mirage", "nuke", "overpass", "train", "vertigo"}
+
+// Games a player needs on a map to be named its best player in !maps
+const mapMinGames = 3
+
+// parseMapName recognizes a map of the pool, with or without the de_ prefix
+func parseMapName(arg string) (string, bool) {
+	name := strings.TrimPrefix(strings.ToLower(arg), "de_")
+	for _, mapName := range mapPool {
+		if name == mapName {
+			return mapName, true
+		}
+	}
+	return "", false
+}
+
+// Store the map of a result waiting for confirmation. Once the other side
+// has confirmed, only an admin can change it, see CorrectMatchMap.
+func (db *DB) SetMatchMap(matchID int, mapName string) error {
+	return db.setMatchMap(matchID, mapName, MatchStatusPending)
+}
+
+// CorrectMatchMap lets an admin change the map of a reported result until the
+// match is finalized
+func (db *DB) CorrectMatchMap(matchID int, mapName string) error {
+	return db.setMatchMap(matchID, mapName, MatchStatusPending, MatchStatusConfirmed, MatchStatusDisputed)
+}
+
+func (db *DB) setMatchMap(matchID int, mapName string, statuses ...MatchStatus) error {
+	args := []interface{}{mapName, matchID}
+	var placeholders []string
+	for _, status := range statuses {
+		placeholders = append(placeholders, "?")
+		args = append(args, status)
+	}
+	result, err := db.db.Exec(fmt.Sprintf(`
+		UPDATE matches SET Map = ?
+		WHERE MatchID = ? AND WinningTeam IS NOT NULL AND Status IN (%s)
+	`, strings.Join(placeholders, ", ")), args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("match %d has no result whose map can be changed", matchID)
+	}
+	return nil
+}
+
+// MapRecord is a player's record on one map. Kills and deaths only cover the
+// matches the player reported stats for.
+type MapRecord struct {
+	Games   int
+	Wins    int
+	Draws   int
+	Kills   int
+	Assists int
+	Deaths  int
+}
+
+// WinRate is the share of games won, counting draws as half
+func (r *MapRecord) WinRate() float64 {
+	if r.Games == 0 {
+		return 0
+	}
+	return (float64(r.Wins) + float64(r.Draws)/2) / float64(r.Games)
+}
+
+// KD is the kill to death ratio
+func (r *MapRecord) KD() float64 {
+	if r.Deaths == 0 {
+		return float64(r.Kills)
+	}
+	return float64(r.Kills) / float64(r.Deaths)
+}
+
+// MapRecords holds every player's record per map, by player ID and map
+type MapRecords map[string]map[string]*MapRecord
+
+func (m MapRecords) record(playerID, mapName string) *MapRecord {
+	if m[playerID] == nil {
+		m[playerID] = make(map[string]*MapRecord)
+	}
+	if m[playerID][mapName] == nil {
+		m[playerID][mapName] = &MapRecord{}
+	}
+	return m[playerID][mapName]
+}
+
+// BuildMapRecords collects the records of finished matches with a known map.
+// Players who were substituted count for the team they played for.
+func BuildMapRecords(records []*MatchRecord, performances map[int]map[string]PlayerStats, substitutions map[int][]Substitution) MapRecords {
+	m := make(MapRecords)
+	for _, record := range records {
+		if record.Map == "" {
+			continue
+		}
+		winner, loser := append([]string{}, record.Winner...), append([]string{}, record.Loser...)
+		for _, chain := range (&Match{Substitutions: substitutions[record.MatchID]}).substitutionChains() {
+			for _, sub := range chain {
+				if containsString(winner, chain[len(chain)-1].InPlayerID) {
+					winner = append(winner, sub.OutPlayerID)
+				} else {
+					loser = append(loser, sub.OutPlayerID)
+				}
+			}
+		}
+
+		for t, team := range [][]string{winner, loser} {
+			for _, playerID := range team {
+				r := m.record(playerID, record.Map)
+				r.Games++
+				switch {
+				case record.Draw:
+					r.Draws++
+				case t == 0:
+					r.Wins++
+				}
+				stats := performances[record.MatchID][playerID]
+				r.Kills += stats.Kills
+				r.Assists += stats.Assists
+				r.Deaths += stats.Deaths
+			}
+		}
+	}
+	return m
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Retrieve the per-map records of every player of a guild
+func (db *DB) GetMapRecords(guildID string) (MapRecords, error) {
+	records, err := db.GetMatchRecords(guildID)
+	if err != nil {
+		return nil, err
+	}
+	performances, err := db.GetAllPerformances(guildID)
+	if err != nil {
+		return nil, err
+	}
+	substitutions, err := db.GetAllSubstitutions(guildID)
+	if err != nil {
+		return nil, err
+	}
+	return BuildMapRecords(records, performances, substitutions), nil
+}
+
+// Describe a record as win rate and K/D for embeds
+func describeMapRecord(r *MapRecord) string {
+	description := fmt.Sprintf("%.0f%% won in %d games (%d-%d", 100*r.WinRate(), r.Games, r.Wins, r.Games-r.Wins-r.Draws)
+	if r.Draws > 0 {
+		description += fmt.Sprintf("-%d", r.Draws)
+	}
+	return description + fmt.Sprintf("), K/D %.2f", r.KD())
+}
+
+// Build the !stats embed of a player's record on one map
+func mapStatsEmbed(player *Player, mapName string, r *MapRecord) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{Title: fmt.Sprintf("Stats for %s on %s", player.PlayerName, mapName), Color: 0x00ff00}
+	if r == nil {
+		embed.Description = fmt.Sprintf("No matches on %s recorded yet.", mapName)
+		return embed
+	}
+	embed.Fields = []*discordgo.MessageEmbedField{
+		{Name: "Games Played", Value: fmt.Sprintf("%d", r.Games), Inline: true},
+		{Name: "Wins", Value: fmt.Sprintf("%d", r.Wins), Inline: true},
+		{Name: "Win Rate", Value: fmt.Sprintf("%.0f%%", 100*r.WinRate()), Inline: true},
+		{Name: "Kills", Value: fmt.Sprintf("%d", r.Kills), Inline: true},
+		{Name: "Assists", Value: fmt.Sprintf("%d", r.Assists), Inline: true},
+		{Name: "Deaths", Value: fmt.Sprintf("%d", r.Deaths), Inline: true},
+		{Name: "K/D", Value: fmt.Sprintf("%.2f", r.KD()), Inline: true},
+	}
+	if r.Draws > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Draws", Value: fmt.Sprintf("%d", r.Draws), Inline: true})
+	}
+	return embed
+}
+
+// Command to show the guild's maps with their best players, or a player's
+// record on every map with `!maps @user`
+func mapsCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	records, err := db.GetMapRecords(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading maps: %v", err))
+		return
+	}
+
+	if len(args) > 1 {
+		playerID, ok := parseUserMention(args[1])
+		if !ok {
+			s.ChannelMessageSend(m.ChannelID, "Invalid user mention. Please mention a user like @username.")
+			return
+		}
+		player, err := db.GetPlayer(m.GuildID, playerID)
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Player <@%s> has not played on this server yet.", playerID))
+			return
+		}
+		embed := &discordgo.MessageEmbed{Title: fmt.Sprintf("Maps of %s", player.PlayerName), Color: 0x00ff00}
+		for _, mapName := range mapPool {
+			if r := records[playerID][mapName]; r != nil {
+				embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: mapName, Value: describeMapRecord(r)})
+			}
+		}
+		if len(embed.Fields) == 0 {
+			embed.Description = "No matches with a recorded map yet."
+		}
+		s.ChannelMessageSendEmbed(m.ChannelID, embed)
+		return
+	}
+
+	playerIDs := make([]string, 0, len(records))
+	for playerID := range records {
+		playerIDs = append(playerIDs, playerID)
+	}
+	sort.Strings(playerIDs)
+
+	embed := &discordgo.MessageEmbed{Title: "Maps", Color: 0x00ff00}
+	for _, mapName := range mapPool {
+		played := false
+		var best *MapRecord
+		var bestID string
+		for _, playerID := range playerIDs {
+			r := records[playerID][mapName]
+			if r == nil {
+				continue
+			}
+			played = true
+			if r.Games >= mapMinGames && (best == nil || r.WinRate() > best.WinRate()) {
+				best, bestID = r, playerID
+			}
+		}
+		if !played {
+			continue
+		}
+		value := fmt.Sprintf("Nobody has played it %d times yet", mapMinGames)
+		if best != nil {
+			value = fmt.Sprintf("Best: <@%s>, %s", bestID, describeMapRecord(best))
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: mapName, Value: value})
+	}
+	if len(embed.Fields) == 0 {
+		embed.Description = "No matches with a recorded map yet. Add the map when reporting, e.g. `!win team1 mirage 13-9`."
+	}
+	s.ChannelMessageSendEmbed(m.ChannelID, embed)
+}
+
+// A select menu to pick the map of a reported match
+func mapSelectMenu(matchID int) discordgo.ActionsRow {
+	var options []discordgo.SelectMenuOption
+	for _, mapName := range mapPool {
+		options = append(options, discordgo.SelectMenuOption{Label: mapName, Value: mapName})
+	}
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.SelectMenu{
+				MenuType:    discordgo.StringSelectMenu,
+				CustomID:    fmt.Sprintf("match_map_%d", matchID),
+				Placeholder: "Map played",
+				Options:     options,
+			},
+		},
+	}
+}
+
+// Store the map picked in the map menu of a reported result
+func handleMapSelect(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	data := i.MessageComponentData()
+	matchID, err := strconv.Atoi(strings.TrimPrefix(data.CustomID, "match_map_"))
+	if err != nil || len(data.Values) == 0 {
+		respondEphemeral(s, i.Interaction, "Invalid match ID.")
+		return
+	}
+	mapName, ok := parseMapName(data.Values[0])
+	if !ok {
+		respondEphemeral(s, i.Interaction, "Unknown map.")
+		return
+	}
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Match not found.")
+		return
+	}
+	admin := isAdmin(s, i.ChannelID, i.Member.User.ID)
+	if !match.hasPlayer(i.Member.User.ID) && !admin {
+		respondEphemeral(s, i.Interaction, "You were not part of this match.")
+		return
+	}
+	// Players can set the map until the result is confirmed, admins can
+	// still correct it afterwards
+	setMap := db.SetMatchMap
+	if admin {
+		setMap = db.CorrectMatchMap
+	}
+	if err := setMap(matchID, mapName); err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Could not store the map: %v", err))
+		return
+	}
+	respondPublic(s, i.Interaction, fmt.Sprintf("%s set the map of match %d to %s.", i.Member.User.Username, matchID, mapName))
+}
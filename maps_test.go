@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestMapRecords(t *testing.T) {
+	if name, ok := parseMapName("de_Mirage"); !ok || name != "mirage" {
+		t.Fatalf("expected de_Mirage to be recognized, got %q, %v", name, ok)
+	}
+	if _, ok := parseMapName("13-9"); ok {
+		t.Fatalf("expected a score not to be taken for a map")
+	}
+
+	// The map is stored with the result and kept in the match records
+	db := newTestDB(t)
+	matchID := createTestMatch(t, db, []string{"a", "b"}, []string{"c", "d"})
+	if err := db.ReportMatchResult(matchID, 1); err != nil {
+		t.Fatalf("Error reporting result: %v", err)
+	}
+	if err := db.SetMatchMap(matchID, "mirage"); err != nil {
+		t.Fatalf("Error storing map: %v", err)
+	}
+	if match, _ := db.GetMatch(matchID); match.Map != "mirage" {
+		t.Fatalf("expected the match to be on mirage, got %q", match.Map)
+	}
+
+	// Once confirmed only admins can change the map
+	if err := db.TransitionMatch(matchID, MatchStatusConfirmed); err != nil {
+		t.Fatalf("Error confirming match: %v", err)
+	}
+	if err := db.SetMatchMap(matchID, "nuke"); err == nil {
+		t.Fatalf("expected an error changing the map of a confirmed match")
+	}
+	if err := db.CorrectMatchMap(matchID, "mirage"); err != nil {
+		t.Fatalf("Error correcting map: %v", err)
+	}
+	if _, err := FinalizeMatch(db, matchID); err != nil {
+		t.Fatalf("Error finalizing match: %v", err)
+	}
+	stored, err := db.GetMapRecords(testGuildID)
+	if err != nil || stored["a"]["mirage"].Wins != 1 || stored["c"]["mirage"].Games != 1 || stored["c"]["mirage"].Wins != 0 {
+		t.Fatalf("unexpected map records: %v, %v", stored, err)
+	}
+
+	// e subbed in for b; both count for the winning team
+	records := []*MatchRecord{
+		{MatchID: 1, Winner: []string{"a", "e"}, Loser: []string{"c", "d"}, Map: "mirage"},
+		{MatchID: 2, Winner: []string{"c", "d"}, Loser: []string{"a", "b"}, Map: "mirage"},
+		{MatchID: 3, Winner: []string{"a", "b"}, Loser: []string{"c", "d"}, Map: "nuke", Draw: true},
+		{MatchID: 4, Winner: []string{"a", "b"}, Loser: []string{"c", "d"}},
+	}
+	performances := map[int]map[string]PlayerStats{
+		1: {"a": {Kills: 20, Deaths: 10}},
+		2: {"a": {Kills: 10, Deaths: 20}},
+	}
+	substitutions := map[int][]Substitution{1: {{OutPlayerID: "b", InPlayerID: "e"}}}
+	m := BuildMapRecords(records, performances, substitutions)
+
+	a := m["a"]["mirage"]
+	if a.Games != 2 || a.Wins != 1 || a.Kills != 30 || a.Deaths != 30 || a.KD() != 1 || a.WinRate() != 0.5 {
+		t.Errorf("unexpected record of a on mirage: %+v", a)
+	}
+	if b := m["b"]["mirage"]; b == nil || b.Games != 2 || b.Wins != 1 {
+		t.Errorf("expected the substituted b to be credited with the win, got %+v", b)
+	}
+	if d := m["d"]["nuke"]; d.Draws != 1 || d.WinRate() != 0.5 {
+		t.Errorf("expected a draw on nuke, got %+v", d)
+	}
+	if len(m["a"]) != 2 {
+		t.Errorf("expected matches without a map to be left out, got %v", m["a"])
+	}
+}
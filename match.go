@@ -1,22 +1,53 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Match struct {
 	db          *DB
+	GuildID     string
 	Winner      *Team
 	Loser       *Team
 	WinningTeam int
-	MatchID     int
+	// Draw is set for tied matches; Winner then holds team 1 and Loser team 2
+	Draw       bool
+	MatchID    int
+	Timestamp  time.Time
+	Status     MatchStatus
+	ReportedAt time.Time
+	// ConfirmedAt is when the result was accepted, which starts the stats deadline
+	ConfirmedAt time.Time
+	ChannelID   string
+	LobbyID     int
+	// Rounds won by each side, both 0 when no score was recorded
+	WinnerScore int
+	LoserScore  int
+	// Map is the map the match was played on, empty when not recorded
+	Map string
+
+	// Stats each player recorded in this match, keyed by player ID
+	Performances map[string]PlayerStats
+
+	// Substitutions lists the players swapped during the match, in order
+	Substitutions []Substitution
+	// Substituted holds the players who were subbed out, by ID
+	Substituted map[string]*Player
 }
 
-// Save the match and update player stats
+// Save a finished match and update player stats right away, without
+// going through result confirmation (used for imported matches)
 func (m *Match) SaveMatch(db *DB) (int, error) {
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now()
+	}
+
 	// Save the match to the database
 	matchID, err := db.SaveMatch(m)
 	if err != nil {
@@ -25,10 +56,14 @@ func (m *Match) SaveMatch(db *DB) (int, error) {
 	m.MatchID = matchID
 
 	// Update MMR for players
-	updateMmr(m)
+	rs, err := db.GetRatingSystem(m.GuildID)
+	if err != nil {
+		return matchID, err
+	}
+	updateMmr(m, rs)
 
 	// Save player stats to the database
-	err = savePlayerStats(append(m.Winner.Players, m.Loser.Players...), db)
+	err = savePlayerStats(m.players(), db)
 	if err != nil {
 		return matchID, err
 	}
@@ -36,9 +71,182 @@ func (m *Match) SaveMatch(db *DB) (int, error) {
 	return matchID, nil
 }
 
-// Store teams temporarily in the database
-func (m *Match) StoreTeams(db *DB) error {
-	return db.StoreTeams(m.Winner, m.Loser)
+// setTeams assigns Winner and Loser from the two sides of the match.
+// Until a result is reported Winner holds team 1 and Loser team 2.
+func (m *Match) setTeams(team1, team2 *Team) {
+	if m.WinningTeam == 2 {
+		m.Winner, m.Loser = team2, team1
+	} else {
+		m.Winner, m.Loser = team1, team2
+	}
+}
+
+// HasScore reports whether the round score of the match is known
+func (m *Match) HasScore() bool {
+	return m.WinnerScore+m.LoserScore > 0
+}
+
+// TotalRounds is the number of rounds played, 0 when no score was recorded
+func (m *Match) TotalRounds() int {
+	return m.WinnerScore + m.LoserScore
+}
+
+// resultScores are the actual scores of the two sides: 1 and 0 for a win,
+// half a point each for a draw
+func (m *Match) resultScores() (float64, float64) {
+	if m.Draw {
+		return 0.5, 0.5
+	}
+	return 1, 0
+}
+
+// parseScore reads a round score such as 13-7 and returns the winner's
+// rounds first, whichever order it was written in. A draw needs equal rounds.
+func parseScore(arg string, draw bool) (int, int, error) {
+	parts := strings.FieldsFunc(arg, func(r rune) bool { return r == '-' || r == ':' })
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid score %q, expected e.g. 13-7", arg)
+	}
+	a, err1 := strconv.Atoi(parts[0])
+	b, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || a < 0 || b < 0 {
+		return 0, 0, fmt.Errorf("invalid score %q, expected e.g. 13-7", arg)
+	}
+	if draw && a != b {
+		return 0, 0, fmt.Errorf("a draw needs equal rounds, got %d-%d", a, b)
+	}
+	if !draw && a == b {
+		return 0, 0, fmt.Errorf("a score of %d-%d has no winner, use `!draw` for ties", a, b)
+	}
+	if a < b {
+		a, b = b, a
+	}
+	return a, b, nil
+}
+
+// Teams returns the two sides of the match in the order they were formed
+func (m *Match) Teams() (*Team, *Team) {
+	if m.WinningTeam == 2 {
+		return m.Loser, m.Winner
+	}
+	return m.Winner, m.Loser
+}
+
+// VoidMatch reverts everything Match.SaveMatch applied for a reported match:
+// MMR, wins, games played and the recorded K/A/D. Compensating MMR history
+// rows are written so the history still adds up, and the teams are stored
+// again under a new match so the correct result can be reported. Matches
+// that were never finalized had nothing applied and are only marked voided.
+func VoidMatch(db *DB, matchID int, guildID string) (*Match, error) {
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		return nil, err
+	}
+	if match.GuildID != guildID {
+		return nil, sql.ErrNoRows
+	}
+	if !canTransition(match.Status, MatchStatusVoided) {
+		return nil, fmt.Errorf("match %d is already voided", matchID)
+	}
+
+	if match.Status != MatchStatusFinalized {
+		if err := db.TransitionMatch(matchID, MatchStatusVoided); err != nil {
+			return nil, err
+		}
+		match.Status = MatchStatusVoided
+		return match, restoreMatchTeams(db, match)
+	}
+
+	performances, err := db.GetRecordedPerformances(matchID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get performances: %v", err)
+	}
+
+	players := match.players()
+	for _, player := range players {
+		if err := revertRatingChange(db, player, matchID); err != nil {
+			return nil, err
+		}
+		stats := performances[player.PlayerID]
+		player.Kills -= stats.Kills
+		player.Assists -= stats.Assists
+		player.Deaths -= stats.Deaths
+		player.GamesPlayed--
+	}
+	if !match.Draw {
+		for _, player := range match.lineup(match.Winner) {
+			player.Wins--
+		}
+	}
+
+	if err := db.VoidMatch(matchID, players); err != nil {
+		return nil, err
+	}
+	match.Status = MatchStatusVoided
+
+	return match, restoreMatchTeams(db, match)
+}
+
+// Put the teams of a voided match back into its lobby so the right result can be reported
+func restoreMatchTeams(db *DB, match *Match) error {
+	team1, team2 := match.Teams()
+	newMatchID, err := db.CreateMatch(match.GuildID, team1, team2, match.ChannelID)
+	if err != nil {
+		return fmt.Errorf("match voided but failed to restore teams: %v", err)
+	}
+
+	lobby := &Lobby{GuildID: match.GuildID, ChannelID: match.ChannelID, Team1: team1, Team2: team2, MatchID: newMatchID}
+	if stored, err := db.GetLobby(match.LobbyID); err == nil {
+		lobby.LobbyID = stored.LobbyID
+		lobby.GuildID = stored.GuildID
+		lobby.ChannelID = stored.ChannelID
+		lobby.VoiceChannelID = stored.VoiceChannelID
+	}
+	if err := NewTeamStorage(db, 48*time.Hour).StoreTeams(lobby); err != nil {
+		return fmt.Errorf("match voided but failed to restore teams: %v", err)
+	}
+	match.LobbyID = lobby.LobbyID
+	return nil
+}
+
+// revertRatingChange subtracts the rating change a match caused from the player.
+// Later matches are kept, so only the MMR and mu deltas are undone; the
+// uncertainty values are restored only when the match was the player's last.
+func revertRatingChange(db *DB, player *Player, matchID int) error {
+	history, err := db.GetMmrHistoryRows(player.GuildID, player.PlayerID)
+	if err != nil {
+		return fmt.Errorf("failed to get MMR history for %s: %v", player.PlayerID, err)
+	}
+
+	for i, row := range history {
+		if row.MatchID != matchID {
+			continue
+		}
+
+		before := MmrHistoryRow{Mmr: defaultMMR, Deviation: defaultRatingDeviation, Volatility: defaultVolatility}
+		if i > 0 {
+			before = history[i-1]
+		}
+
+		player.MMR -= row.Mmr - before.Mmr
+		if row.Sigma > 0 {
+			beforeMu := before.Mu
+			if before.Sigma <= 0 {
+				beforeMu = float64(before.Mmr)
+			}
+			player.Mu -= row.Mu - beforeMu
+		}
+
+		if i == len(history)-1 {
+			player.RatingDeviation = before.Deviation
+			player.Volatility = before.Volatility
+			player.Sigma = before.Sigma
+		}
+		return nil
+	}
+
+	// Nothing was recorded for this match, so there is no rating change to undo
+	return nil
 }
 
 // Prepare stats for the match (e.g., for displaying or saving)
@@ -89,11 +297,11 @@ func getPlayerStat(player *Player, stat string) int {
 }
 
 // Helper function to get players from IDs
-func getPlayersFromIDs(ids string, db *DB) ([]*Player, error) {
+func getPlayersFromIDs(guildID, ids string, db *DB) ([]*Player, error) {
 	playerIDs := strings.Split(ids, ",")
 	players := []*Player{}
 	for _, id := range playerIDs {
-		player, err := db.GetPlayer(id)
+		player, err := db.GetPlayer(guildID, id)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get player %s: %v", id, err)
 		}
@@ -102,7 +310,7 @@ func getPlayersFromIDs(ids string, db *DB) ([]*Player, error) {
 	return players, nil
 }
 
-func sendMatchReportPrompt(s *discordgo.Session, channelID string, matchID int) {
+func sendMatchReportPrompt(s *discordgo.Session, channelID string, matchID int, cfg *Config) {
 	components := []discordgo.MessageComponent{
 		discordgo.ActionsRow{
 			Components: []discordgo.MessageComponent{
@@ -116,7 +324,7 @@ func sendMatchReportPrompt(s *discordgo.Session, channelID string, matchID int)
 	}
 
 	s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
-		Content:    "Click the button below to report your match stats.",
+		Content:    fmt.Sprintf("Click the button below to report your match stats, or paste the whole scoreboard with `!scoreboard %d`. Ratings are applied once everyone has reported, or %s after the result is confirmed.", matchID, cfg.StatsDeadline),
 		Components: components,
 	})
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVoidMatch(t *testing.T) {
+	db := newTestDB(t)
+	saveTestMatch(t, db, []string{"a", "b"}, []string{"c", "d"})
+	before, _ := db.GetPlayer(testGuildID, "a")
+
+	match := saveTestMatch(t, db, []string{"a", "c"}, []string{"b", "d"})
+	if _, err := VoidMatch(db, match.MatchID, testGuildID); err != nil {
+		t.Fatalf("Error voiding match: %v", err)
+	}
+
+	after, _ := db.GetPlayer(testGuildID, "a")
+	if after.MMR != before.MMR || after.Wins != before.Wins || after.GamesPlayed != before.GamesPlayed || after.Kills != before.Kills {
+		t.Fatalf("void did not restore player: before %+v, after %+v", before, after)
+	}
+
+	// The compensating row brings the history back to the previous rating
+	mmrs, _, _ := db.GetMmrHistory(testGuildID, "a")
+	if len(mmrs) != 3 || mmrs[2] != before.MMR {
+		t.Fatalf("unexpected MMR history after void: %v", mmrs)
+	}
+
+	// The teams are stored again for the correct result
+	lobby, err := NewTeamStorage(db, time.Hour).FindLobby(testGuildID, "", "")
+	if err != nil || lobby.Team1.GetPlayerIDs() != "a,c" || lobby.Team2.GetPlayerIDs() != "b,d" {
+		t.Fatalf("teams were not restored: %+v %v", lobby, err)
+	}
+	if restored, err := db.GetMatch(lobby.MatchID); err != nil || restored.Status != MatchStatusCreated {
+		t.Fatalf("expected a new match for the restored teams, got %+v (%v)", restored, err)
+	}
+
+	// Voided matches are skipped by replays and cannot be voided twice
+	records, _ := db.GetMatchRecords(testGuildID)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 rated match, got %d", len(records))
+	}
+	if _, err := VoidMatch(db, match.MatchID, testGuildID); err == nil {
+		t.Fatalf("expected an error voiding a match twice")
+	}
+}
+
+// Create a match for the given teams the way !teams does
+func createTestMatch(t *testing.T, db *DB, team1IDs, team2IDs []string) int {
+	getTeam := func(playerIDs []string) *Team {
+		team := &Team{}
+		for _, playerID := range playerIDs {
+			player := NewPlayer(testGuildID, playerID, playerID)
+			if err := db.SavePlayer(player); err != nil {
+				t.Fatalf("Error saving player: %v", err)
+			}
+			team.Players = append(team.Players, player)
+		}
+		return team
+	}
+
+	matchID, err := db.CreateMatch(testGuildID, getTeam(team1IDs), getTeam(team2IDs), "channel")
+	if err != nil {
+		t.Fatalf("Error creating match: %v", err)
+	}
+	return matchID
+}
+
+func TestMatchLifecycleConfirmation(t *testing.T) {
+	db := newTestDB(t)
+	matchID := createTestMatch(t, db, []string{"a", "b", "c"}, []string{"d", "e", "f"})
+
+	if err := db.ReportMatchResult(matchID, 2); err != nil {
+		t.Fatalf("Error reporting result: %v", err)
+	}
+
+	// Winners cannot confirm their own win
+	if _, _, err := ConfirmMatchResult(db, matchID, "d"); err == nil {
+		t.Fatalf("expected winners to be unable to confirm")
+	}
+
+	finalized, count, err := ConfirmMatchResult(db, matchID, "a")
+	if err != nil || finalized || count != 1 {
+		t.Fatalf("first confirmation: finalized %v, count %d, err %v", finalized, count, err)
+	}
+	if player, _ := db.GetPlayer(testGuildID, "d"); player.GamesPlayed != 0 {
+		t.Fatalf("ratings must not change before the result is confirmed")
+	}
+
+	// The confirmed result waits for the stats of every player
+	finalized, _, err = ConfirmMatchResult(db, matchID, "b")
+	if err != nil || finalized {
+		t.Fatalf("second confirmation should wait for stats: %v, %v", finalized, err)
+	}
+	for _, playerID := range []string{"a", "b", "c", "d", "e", "f"} {
+		if err := db.ReportPerformance(matchID, playerID, playerID, PlayerStats{Kills: 10, Assists: 2, Deaths: 10}); err != nil {
+			t.Fatalf("Error reporting stats: %v", err)
+		}
+	}
+	if finalized, err := settleMatch(db, matchID); err != nil || finalized == nil {
+		t.Fatalf("the last stats should finalize: %v, %v", finalized, err)
+	}
+
+	match, _ := db.GetMatch(matchID)
+	if match.Status != MatchStatusFinalized || match.Winner.GetPlayerIDs() != "d,e,f" {
+		t.Fatalf("unexpected match after confirmation: %+v", match)
+	}
+	if match.Winner.Players[0].Wins != 1 || match.Loser.Players[0].GamesPlayed != 1 || match.Winner.Players[0].Kills != 10 {
+		t.Fatalf("ratings and stats were not applied on finalization")
+	}
+
+	// A finalized match cannot be finalized again
+	if _, err := FinalizeMatch(db, matchID); err == nil {
+		t.Fatalf("expected an error finalizing twice")
+	}
+}
+
+func TestMatchLifecycleDispute(t *testing.T) {
+	db := newTestDB(t)
+	matchID := createTestMatch(t, db, []string{"a"}, []string{"b"})
+
+	if err := db.ReportMatchResult(matchID, 1); err != nil {
+		t.Fatalf("Error reporting result: %v", err)
+	}
+	if err := DisputeMatchResult(db, matchID, "b"); err != nil {
+		t.Fatalf("Error disputing result: %v", err)
+	}
+
+	// Disputed matches are frozen for players and only admins can accept them
+	if _, _, err := ConfirmMatchResult(db, matchID, "b"); err == nil {
+		t.Fatalf("expected disputed match to reject confirmations")
+	}
+	if _, err := ForceConfirmMatch(db, matchID); err != nil {
+		t.Fatalf("Error confirming disputed match: %v", err)
+	}
+	if match, _ := db.GetMatch(matchID); match.Status != MatchStatusFinalized {
+		t.Fatalf("expected finalized match, got %s", match.Status)
+	}
+}
+
+func TestParseScore(t *testing.T) {
+	for arg, expected := range map[string][2]int{"13-7": {13, 7}, "7:13": {13, 7}, "16-14": {16, 14}} {
+		winner, loser, err := parseScore(arg, false)
+		if err != nil || winner != expected[0] || loser != expected[1] {
+			t.Errorf("parseScore(%q) = %d, %d, %v", arg, winner, loser, err)
+		}
+	}
+	for _, arg := range []string{"13-13", "13", "a-b", "13-7-1"} {
+		if _, _, err := parseScore(arg, false); err == nil {
+			t.Errorf("expected parseScore(%q) to fail", arg)
+		}
+	}
+
+	// Draws need equal rounds
+	if winner, loser, err := parseScore("12-12", true); err != nil || winner != 12 || loser != 12 {
+		t.Errorf("parseScore(12-12) = %d, %d, %v for a draw", winner, loser, err)
+	}
+	if _, _, err := parseScore("13-7", true); err == nil {
+		t.Errorf("expected a draw with a winner to fail")
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	db := newTestDB(t)
+	matchID := createTestMatch(t, db, []string{"a", "b"}, []string{"c", "d"})
+
+	// Scores can only be stored once a result is reported
+	if err := db.SetMatchScore(matchID, 13, 7); err == nil {
+		t.Fatalf("expected an error storing a score without a result")
+	}
+	if err := db.ReportMatchResult(matchID, 2); err != nil {
+		t.Fatalf("Error reporting result: %v", err)
+	}
+	if match, _ := db.GetMatch(matchID); match.HasScore() {
+		t.Fatalf("expected no score before one is set, got %d-%d", match.WinnerScore, match.LoserScore)
+	}
+	if err := db.SetMatchScore(matchID, 13, 7); err != nil {
+		t.Fatalf("Error storing score: %v", err)
+	}
+	match, _ := db.GetMatch(matchID)
+	if match.WinnerScore != 13 || match.LoserScore != 7 || match.TotalRounds() != 20 {
+		t.Fatalf("expected team 2 to have won 13-7, got %d-%d", match.WinnerScore, match.LoserScore)
+	}
+
+	// A changed score has to be confirmed again
+	if _, err := db.AddMatchConfirmation(matchID, "a"); err != nil {
+		t.Fatalf("Error confirming match: %v", err)
+	}
+	if err := db.SetMatchScore(matchID, 13, 8); err != nil {
+		t.Fatalf("Error changing score: %v", err)
+	}
+	if confirmed, _ := db.AddMatchConfirmation(matchID, "b"); len(confirmed) != 1 {
+		t.Fatalf("expected the confirmations to be cleared by the new score, got %v", confirmed)
+	}
+	if err := db.SetMatchScore(matchID, 13, 7); err != nil {
+		t.Fatalf("Error changing score: %v", err)
+	}
+
+	// Once confirmed only admins can correct the score
+	if err := db.TransitionMatch(matchID, MatchStatusConfirmed); err != nil {
+		t.Fatalf("Error confirming match: %v", err)
+	}
+	if err := db.SetMatchScore(matchID, 13, 0); err == nil {
+		t.Fatalf("expected an error changing the score of a confirmed match")
+	}
+	if err := db.CorrectMatchScore(matchID, 13, 7); err != nil {
+		t.Fatalf("Error correcting score: %v", err)
+	}
+	if _, err := FinalizeMatch(db, matchID); err != nil {
+		t.Fatalf("Error finalizing match: %v", err)
+	}
+	records, err := db.GetMatchRecords(testGuildID)
+	if err != nil || len(records) != 1 || records[0].WinnerScore != 13 || records[0].LoserScore != 7 {
+		t.Fatalf("expected the replay record to carry the score, got %+v, %v", records, err)
+	}
+
+	// The score is locked once ratings are applied
+	if err := db.CorrectMatchScore(matchID, 13, 11); err == nil {
+		t.Fatalf("expected an error changing the score of a finalized match")
+	}
+}
+
+func TestReportScoredMatchResult(t *testing.T) {
+	db := newTestDB(t)
+	matchID := createTestMatch(t, db, []string{"a", "b"}, []string{"c", "d"})
+
+	if err := db.ReportScoredMatchResult(matchID, 2, 13, 4); err != nil {
+		t.Fatalf("Error reporting result: %v", err)
+	}
+	match, _ := db.GetMatch(matchID)
+	if match.Status != MatchStatusPending || match.WinningTeam != 2 || match.WinnerScore != 13 || match.LoserScore != 4 {
+		t.Fatalf("expected a pending 13-4 win of team 2, got %+v", match)
+	}
+	var team1Score int
+	db.db.QueryRow("SELECT Team1Score FROM matches WHERE MatchID = ?", matchID).Scan(&team1Score)
+	if team1Score != 4 {
+		t.Fatalf("expected team 1 to have 4 rounds, got %d", team1Score)
+	}
+}
+
+func TestDrawMatch(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.SetGuildSetting(testGuildID, "stats_deadline", "0s"); err != nil {
+		t.Fatalf("Error changing setting: %v", err)
+	}
+	matchID := createTestMatch(t, db, []string{"a", "b"}, []string{"c", "d"})
+
+	if err := db.ReportMatchResult(matchID, drawResult); err != nil {
+		t.Fatalf("Error reporting draw: %v", err)
+	}
+	if err := db.SetMatchScore(matchID, 12, 12); err != nil {
+		t.Fatalf("Error storing score: %v", err)
+	}
+
+	// No team won, so players from either side may confirm, but one team
+	// alone cannot confirm a draw it may have reported itself
+	for _, playerID := range []string{"a", "b"} {
+		if _, _, err := ConfirmMatchResult(db, matchID, playerID); err != nil {
+			t.Fatalf("Error confirming draw as %s: %v", playerID, err)
+		}
+	}
+	if match, _ := db.GetMatch(matchID); match.Status != MatchStatusPending {
+		t.Fatalf("expected the draw to wait for the other team, got %s", match.Status)
+	}
+	for _, playerID := range []string{"c", "d"} {
+		if _, _, err := ConfirmMatchResult(db, matchID, playerID); err != nil {
+			t.Fatalf("Error confirming draw as %s: %v", playerID, err)
+		}
+	}
+	match, _ := db.GetMatch(matchID)
+	if match.Status != MatchStatusFinalized || !match.Draw || match.TotalRounds() != 24 {
+		t.Fatalf("expected a finalized 12-12 draw, got %+v", match)
+	}
+	var winner sql.NullString
+	db.db.QueryRow("SELECT Winner FROM matches WHERE MatchID = ?", matchID).Scan(&winner)
+	if winner.Valid {
+		t.Fatalf("expected no winner to be stored for a draw, got %q", winner.String)
+	}
+
+	// Equal teams stay level, the game counts but is not a win
+	for _, player := range match.players() {
+		if player.MMR != defaultMMR || player.GamesPlayed != 1 || player.Wins != 0 {
+			t.Errorf("unexpected state of %s after a draw: %+v", player.PlayerID, player)
+		}
+	}
+	records, err := db.GetMatchRecords(testGuildID)
+	if err != nil || len(records) != 1 || !records[0].Draw || strings.Join(records[0].Winner, ",") != "a,b" {
+		t.Fatalf("expected a draw record between the two teams, got %+v, %v", records, err)
+	}
+}
@@ -3,19 +3,75 @@ package main
 import (
 	"log"
 	"math"
+	"time"
 )
 
 // Mmr update process using the Match, Team, and Player entities
-func updateMmr(match *Match) {
-	// Calculate MMR changes for both the winner and loser teams
-	calculateMMRChanges(match)
+func updateMmr(match *Match, rs RatingSystem) {
+	// Let the guild's rating system rate the match, then apply the changes
+	rateMatch(match, rs)
 
 	// Record the MMR changes for each player in both teams
-	for _, player := range match.Winner.Players {
+	for _, player := range match.players() {
 		recordMmrChange(player, match.MatchID, match.db)
 	}
-	for _, player := range match.Loser.Players {
-		recordMmrChange(player, match.MatchID, match.db)
+}
+
+// rateMatch adds the match stats to the players' totals and applies the
+// rating changes calculated by rs. It is shared by live matches and replays
+// so both produce identical ratings.
+func rateMatch(match *Match, rs RatingSystem) {
+	applyPerformances(match)
+	applyRatingChanges(match, rateWithSubstitutions(match, rs))
+}
+
+// applyPerformances adds each player's stats from this match to their totals
+func applyPerformances(match *Match) {
+	for _, player := range match.players() {
+		stats := match.Performances[player.PlayerID]
+		player.Kills += stats.Kills
+		player.Assists += stats.Assists
+		player.Deaths += stats.Deaths
+	}
+}
+
+// applyRatingChanges updates ratings and game counters of the match players
+func applyRatingChanges(match *Match, changes []RatingChange) {
+	byPlayer := make(map[string]RatingChange, len(changes))
+	for _, change := range changes {
+		byPlayer[change.PlayerID] = change
+	}
+
+	playedAt := match.Timestamp
+	if playedAt.IsZero() {
+		playedAt = time.Now()
+	}
+
+	apply := func(player *Player) {
+		change := byPlayer[player.PlayerID]
+		player.MMR += change.MMRDelta
+		if change.Deviation > 0 {
+			player.RatingDeviation = change.Deviation
+		}
+		if change.Volatility > 0 {
+			player.Volatility = change.Volatility
+		}
+		if change.Sigma > 0 {
+			player.Mu = change.Mu
+			player.Sigma = change.Sigma
+		}
+		player.LastPlayed = playedAt
+		player.GamesPlayed++
+	}
+
+	for _, player := range match.lineup(match.Winner) {
+		apply(player)
+		if !match.Draw {
+			player.Wins++
+		}
+	}
+	for _, player := range match.lineup(match.Loser) {
+		apply(player)
 	}
 }
 
@@ -31,37 +87,58 @@ func savePlayerStats(players []*Player, db *DB) error {
 	return nil
 }
 
-// Calculate MMR changes for both teams based on match result
-func calculateMMRChanges(match *Match) {
+// EloRatingSystem is the default rating system: team-average Elo with a
+// games-played K-factor ladder and KDA based adjustments
+type EloRatingSystem struct {
+	RatingOptions
+}
+
+func (e *EloRatingSystem) Name() string {
+	return "elo"
+}
+
+// RateMatch calculates MMR changes for both teams based on match result
+func (e *EloRatingSystem) RateMatch(match *Match) []RatingChange {
 	team1MMR := match.Winner.calculateTeamMmr()
 	team2MMR := match.Loser.calculateTeamMmr()
-	team1KDAAvg := match.Winner.calculateTeamKDA()
-	team2KDAAvg := match.Loser.calculateTeamKDA()
+	team1KDAAvg := match.teamKDA(match.Winner)
+	team2KDAAvg := match.teamKDA(match.Loser)
+
+	var changes []RatingChange
+	winnerScore, loserScore := match.resultScores()
 
-	// Process winners (actualScore = 1.0 for winners)
+	// Decisive results keep the ladder's historic expectation; a draw is
+	// measured against each team's own chance to win, so the underdog gains
+	winnerExpected := calculateExpectedScore(team2MMR, team1MMR)
+	loserExpected := calculateExpectedScore(team1MMR, team2MMR)
+	if match.Draw {
+		winnerExpected, loserExpected = loserExpected, winnerExpected
+	}
+
+	// Process winners (actualScore = 1.0 for winners, 0.5 in a draw)
 	for _, player := range match.Winner.Players {
 		kFactor := calculateKFactor(player)
-		expectedScore := calculateExpectedScore(team2MMR, team1MMR)
-		playerKDA := player.CalculateKda()
-		kdaFactor := calculateKDAFactor(player, playerKDA)
+		playerKDA, kdaFactor := playerKDAFactor(match, player)
 
-		MMRChange := calculateContextualMmrAdjustment(team1KDAAvg, playerKDA, expectedScore, 1.0, kdaFactor, kFactor)
-		player.MMR += MMRChange
-		player.Wins++
-		player.GamesPlayed++
+		MMRChange := calculateContextualMmrAdjustment(team1KDAAvg, playerKDA, winnerExpected, winnerScore, kdaFactor, kFactor)
+		changes = append(changes, RatingChange{PlayerID: player.PlayerID, MMRDelta: MMRChange})
 	}
 
-	// Process losers (actualScore = 0.0 for losers)
+	// Process losers (actualScore = 0.0 for losers, 0.5 in a draw)
 	for _, player := range match.Loser.Players {
 		kFactor := calculateKFactor(player)
-		expectedScore := calculateExpectedScore(team1MMR, team2MMR)
-		playerKDA := player.CalculateKda()
-		kdaFactor := calculateKDAFactor(player, playerKDA)
+		playerKDA, kdaFactor := playerKDAFactor(match, player)
 
-		MMRChange := calculateContextualMmrAdjustment(team2KDAAvg, playerKDA, expectedScore, 0.0, kdaFactor, kFactor)
-		player.MMR += MMRChange
-		player.GamesPlayed++
+		MMRChange := calculateContextualMmrAdjustment(team2KDAAvg, playerKDA, loserExpected, loserScore, kdaFactor, kFactor)
+		changes = append(changes, RatingChange{PlayerID: player.PlayerID, MMRDelta: MMRChange})
 	}
+
+	return e.scaleByMargin(match, changes)
+}
+
+// ExpectedScore compares average team MMR
+func (e *EloRatingSystem) ExpectedScore(team, opponent *Team) float64 {
+	return calculateExpectedScore(team.calculateTeamMmr(), opponent.calculateTeamMmr())
 }
 
 // Calculate expected score based on MMR difference between teams
@@ -91,7 +168,7 @@ func calculateContextualMmrAdjustment(teamKDAAvg, playerKDA, expectedScore, actu
 
 // Record MMR change for a player in the history table
 func recordMmrChange(player *Player, matchID int, db *DB) {
-	err := db.RecordMmrHistory(player.PlayerID, player.MMR, matchID)
+	err := db.RecordMmrHistory(player, matchID)
 	if err != nil {
 		log.Printf("Error recording MMR history for player %s: %v", player.PlayerID, err)
 	}
@@ -111,14 +188,212 @@ func calculateKFactor(player *Player) int {
 	}
 }
 
-// Function to calculate KDA factor based on games played
+// KDA factor of players who reported no stats for a match
+const neutralKDAFactor = 1.0
+
+// playerKDAFactor returns the player's KDA in the match and the factor it
+// gives. Without reported stats the factor is neutral rather than based on
+// the player's lifetime KDA.
+func playerKDAFactor(match *Match, player *Player) (float64, float64) {
+	kda, reported := match.playerKDA(player)
+	if !reported {
+		return kda, neutralKDAFactor
+	}
+	return kda, calculateKDAFactor(player, kda)
+}
+
+// Function to calculate KDA factor based on games played. The factor never
+// drops below 0.5, so a match without kills still moves the rating.
 func calculateKDAFactor(player *Player, kda float64) float64 {
 	switch {
 	case player.GamesPlayed < 5:
 		return math.Max(0.5, kda/4)
 	case player.GamesPlayed <= 10:
-		return math.Min(kda/2, 1.2)
+		return math.Max(0.5, math.Min(kda/2, 1.2))
 	default:
-		return math.Min(kda/2, 1.5)
+		return math.Max(0.5, math.Min(kda/2, 1.5))
+	}
+}
+
+// Glicko-2 system constants, see http://www.glicko.net/glicko/glicko2.pdf
+const (
+	glickoScale        = 173.7178
+	glickoBaseRating   = 1500.0
+	glickoTau          = 0.5
+	glickoEpsilon      = 0.000001
+	glickoRatingPeriod = 7 * 24 * time.Hour
+)
+
+// GlickoRatingSystem rates matches with Glicko-2. Each player is rated
+// against the opposing team as a single composite opponent, and rating
+// deviation grows for every rating period (week) a player sits out.
+type GlickoRatingSystem struct {
+	RatingOptions
+}
+
+func (g *GlickoRatingSystem) Name() string {
+	return "glicko2"
+}
+
+func (g *GlickoRatingSystem) RateMatch(match *Match) []RatingChange {
+	playedAt := match.Timestamp
+	if playedAt.IsZero() {
+		playedAt = time.Now()
 	}
+
+	winnerOpponent := glickoTeamRating(match.Loser, playedAt)
+	loserOpponent := glickoTeamRating(match.Winner, playedAt)
+
+	winnerScore, loserScore := match.resultScores()
+	var changes []RatingChange
+	for _, player := range match.Winner.Players {
+		changes = append(changes, glickoRatingChange(player, playedAt, glickoResult{opponent: winnerOpponent, score: winnerScore}))
+	}
+	for _, player := range match.Loser.Players {
+		changes = append(changes, glickoRatingChange(player, playedAt, glickoResult{opponent: loserOpponent, score: loserScore}))
+	}
+	return g.scaleByMargin(match, changes)
+}
+
+// ExpectedScore compares the composite team ratings, discounted by their deviations
+func (g *GlickoRatingSystem) ExpectedScore(team, opponent *Team) float64 {
+	now := time.Now()
+	teamRating := glickoTeamRating(team, now)
+	opponentRating := glickoTeamRating(opponent, now)
+	phi := math.Sqrt(teamRating.phi*teamRating.phi + opponentRating.phi*opponentRating.phi)
+	return glickoE(teamRating.mu, opponentRating.mu, phi)
+}
+
+// glickoRating is a rating on the internal Glicko-2 scale
+type glickoRating struct {
+	mu    float64
+	phi   float64
+	sigma float64
+}
+
+// glickoResult is a single game outcome against an opponent
+type glickoResult struct {
+	opponent glickoRating
+	score    float64
+}
+
+// Convert a player to the Glicko-2 scale, inflating the deviation for inactivity
+func toGlickoRating(player *Player, at time.Time) glickoRating {
+	rd := player.RatingDeviation
+	if rd <= 0 {
+		rd = defaultRatingDeviation
+	}
+	vol := player.Volatility
+	if vol <= 0 {
+		vol = defaultVolatility
+	}
+
+	rating := glickoRating{
+		mu:    (float64(player.MMR) - glickoBaseRating) / glickoScale,
+		phi:   rd / glickoScale,
+		sigma: vol,
+	}
+
+	// Uncertainty grows for each rating period the player did not play
+	maxPhi := defaultRatingDeviation / glickoScale
+	if !player.LastPlayed.IsZero() && at.After(player.LastPlayed) {
+		periods := int(at.Sub(player.LastPlayed) / glickoRatingPeriod)
+		for i := 0; i < periods && rating.phi < maxPhi; i++ {
+			rating.phi = math.Sqrt(rating.phi*rating.phi + rating.sigma*rating.sigma)
+		}
+		rating.phi = math.Min(rating.phi, maxPhi)
+	}
+	return rating
+}
+
+// Combine a team into one opponent: average rating, root mean square deviation
+func glickoTeamRating(team *Team, at time.Time) glickoRating {
+	var combined glickoRating
+	for _, player := range team.Players {
+		rating := toGlickoRating(player, at)
+		combined.mu += rating.mu
+		combined.phi += rating.phi * rating.phi
+	}
+	n := float64(len(team.Players))
+	combined.mu /= n
+	combined.phi = math.Sqrt(combined.phi / n)
+	return combined
+}
+
+func glickoRatingChange(player *Player, at time.Time, results ...glickoResult) RatingChange {
+	updated := glicko2Update(toGlickoRating(player, at), results)
+	newMMR := int(math.Round(updated.mu*glickoScale + glickoBaseRating))
+	return RatingChange{
+		PlayerID:   player.PlayerID,
+		MMRDelta:   newMMR - player.MMR,
+		Deviation:  updated.phi * glickoScale,
+		Volatility: updated.sigma,
+	}
+}
+
+func glickoG(phi float64) float64 {
+	return 1.0 / math.Sqrt(1.0+3.0*phi*phi/(math.Pi*math.Pi))
+}
+
+func glickoE(mu, opponentMu, opponentPhi float64) float64 {
+	return 1.0 / (1.0 + math.Exp(-glickoG(opponentPhi)*(mu-opponentMu)))
+}
+
+// glicko2Update applies one rating period of results (steps 3-8 of the Glicko-2 paper)
+func glicko2Update(rating glickoRating, results []glickoResult) glickoRating {
+	if len(results) == 0 {
+		phi := math.Sqrt(rating.phi*rating.phi + rating.sigma*rating.sigma)
+		return glickoRating{mu: rating.mu, phi: phi, sigma: rating.sigma}
+	}
+
+	// Estimated variance and improvement based on game outcomes
+	var vInv, deltaSum float64
+	for _, result := range results {
+		g := glickoG(result.opponent.phi)
+		e := glickoE(rating.mu, result.opponent.mu, result.opponent.phi)
+		vInv += g * g * e * (1 - e)
+		deltaSum += g * (result.score - e)
+	}
+	v := 1.0 / vInv
+	delta := v * deltaSum
+
+	// New volatility using the Illinois algorithm
+	phi2 := rating.phi * rating.phi
+	a := math.Log(rating.sigma * rating.sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		return ex*(delta*delta-phi2-v-ex)/(2*math.Pow(phi2+v+ex, 2)) - (x-a)/(glickoTau*glickoTau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi2+v {
+		B = math.Log(delta*delta - phi2 - v)
+	} else {
+		k := 1.0
+		for f(a-k*glickoTau) < 0 {
+			k++
+		}
+		B = a - k*glickoTau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > glickoEpsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	sigma := math.Exp(A / 2)
+
+	// New deviation and rating
+	phiStar := math.Sqrt(phi2 + sigma*sigma)
+	phi := 1.0 / math.Sqrt(1.0/(phiStar*phiStar)+1.0/v)
+	mu := rating.mu + phi*phi*deltaSum
+
+	return glickoRating{mu: mu, phi: phi, sigma: sigma}
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func newTestMatch(winnerMMR, loserMMR []int) *Match {
+	winner := &Team{Name: "Winner"}
+	for i, mmr := range winnerMMR {
+		winner.Players = append(winner.Players, &Player{PlayerID: string(rune('a' + i)), MMR: mmr, GamesPlayed: 20, Kills: 20, Deaths: 20})
+	}
+	loser := &Team{Name: "Loser"}
+	for i, mmr := range loserMMR {
+		loser.Players = append(loser.Players, &Player{PlayerID: string(rune('A' + i)), MMR: mmr, GamesPlayed: 20, Kills: 20, Deaths: 20})
+	}
+	return &Match{Winner: winner, Loser: loser}
+}
+
+func TestEloRatingSystemRateMatch(t *testing.T) {
+	match := newTestMatch([]int{1000, 1000}, []int{1000, 1000})
+
+	changes := (&EloRatingSystem{}).RateMatch(match)
+	if len(changes) != 4 {
+		t.Fatalf("expected 4 rating changes, got %d", len(changes))
+	}
+
+	for _, change := range changes {
+		isWinner := change.PlayerID == "a" || change.PlayerID == "b"
+		if isWinner && change.MMRDelta <= 0 {
+			t.Errorf("winner %s should gain MMR, got %d", change.PlayerID, change.MMRDelta)
+		}
+		if !isWinner && change.MMRDelta >= 0 {
+			t.Errorf("loser %s should lose MMR, got %d", change.PlayerID, change.MMRDelta)
+		}
+	}
+
+	// Rating a match must not touch the players themselves
+	if match.Winner.Players[0].MMR != 1000 || match.Winner.Players[0].GamesPlayed != 20 {
+		t.Errorf("RateMatch modified the players")
+	}
+}
+
+func TestEloKDAFactor(t *testing.T) {
+	loss := func(performances map[string]PlayerStats) int {
+		match := newTestMatch([]int{1000}, []int{1000})
+		match.Loser.Players[0].Kills = 60
+		match.Performances = performances
+		return (&EloRatingSystem{}).RateMatch(match)[1].MMRDelta
+	}
+
+	// Missing stats are neutral instead of falling back to the lifetime KDA
+	if delta := loss(nil); delta != -10 {
+		t.Errorf("expected a loss without stats to cost 10, got %d", delta)
+	}
+	// A match without kills or assists still costs rating
+	if delta := loss(map[string]PlayerStats{"A": {Deaths: 16}}); delta >= 0 {
+		t.Errorf("expected a 0/0/16 loss to cost rating, got %d", delta)
+	}
+}
+
+func TestApplyRatingChanges(t *testing.T) {
+	match := newTestMatch([]int{1000}, []int{1000})
+
+	applyRatingChanges(match, []RatingChange{
+		{PlayerID: "a", MMRDelta: 12},
+		{PlayerID: "A", MMRDelta: -12},
+	})
+
+	winner, loser := match.Winner.Players[0], match.Loser.Players[0]
+	if winner.MMR != 1012 || winner.Wins != 1 || winner.GamesPlayed != 21 {
+		t.Errorf("unexpected winner state: %+v", winner)
+	}
+	if loser.MMR != 988 || loser.Wins != 0 || loser.GamesPlayed != 21 {
+		t.Errorf("unexpected loser state: %+v", loser)
+	}
+}
+
+func TestNewRatingSystem(t *testing.T) {
+	rs, err := NewRatingSystem("Elo")
+	if err != nil || rs.Name() != "elo" {
+		t.Fatalf("expected elo rating system, got %v, %v", rs, err)
+	}
+	if _, err := NewRatingSystem("chess.com"); err == nil {
+		t.Fatalf("expected error for unknown rating system")
+	}
+}
+
+func TestGlicko2UpdatePaperExample(t *testing.T) {
+	// Worked example from the Glicko-2 paper by Mark Glickman
+	player := glickoRating{mu: 0, phi: 200 / glickoScale, sigma: 0.06}
+	results := []glickoResult{
+		{opponent: glickoRating{mu: (1400 - glickoBaseRating) / glickoScale, phi: 30 / glickoScale}, score: 1},
+		{opponent: glickoRating{mu: (1550 - glickoBaseRating) / glickoScale, phi: 100 / glickoScale}, score: 0},
+		{opponent: glickoRating{mu: (1700 - glickoBaseRating) / glickoScale, phi: 300 / glickoScale}, score: 0},
+	}
+
+	updated := glicko2Update(player, results)
+
+	rating := updated.mu*glickoScale + glickoBaseRating
+	rd := updated.phi * glickoScale
+	if math.Abs(rating-1464.06) > 0.01 || math.Abs(rd-151.52) > 0.01 || math.Abs(updated.sigma-0.05999) > 0.00001 {
+		t.Fatalf("unexpected Glicko-2 result: rating %.2f, RD %.2f, volatility %.5f", rating, rd, updated.sigma)
+	}
+}
+
+func TestGlickoDeviationGrowsWithInactivity(t *testing.T) {
+	now := time.Now()
+	active := &Player{MMR: 1000, RatingDeviation: 60, Volatility: 0.06, LastPlayed: now.Add(-24 * time.Hour)}
+	absent := &Player{MMR: 1000, RatingDeviation: 60, Volatility: 0.06, LastPlayed: now.Add(-8 * glickoRatingPeriod)}
+
+	if toGlickoRating(absent, now).phi <= toGlickoRating(active, now).phi {
+		t.Fatalf("deviation should grow for players who skipped rating periods")
+	}
+
+	// Playing a match shrinks the deviation again
+	match := newTestMatch([]int{1000, 1000}, []int{1000, 1000})
+	match.Timestamp = now
+	for _, change := range (&GlickoRatingSystem{}).RateMatch(match) {
+		if change.Deviation <= 0 || change.Deviation >= defaultRatingDeviation {
+			t.Errorf("expected deviation to shrink from the default, got %.2f", change.Deviation)
+		}
+	}
+}
+
+func TestOpenSkillRateMatch(t *testing.T) {
+	match := newTestMatch([]int{1000, 1000, 1000, 1000, 1000}, []int{1000, 1000, 1000, 1000, 1000})
+	winners := make(map[string]bool)
+	for _, player := range match.Winner.Players {
+		winners[player.PlayerID] = true
+	}
+
+	for _, change := range (&OpenSkillRatingSystem{}).RateMatch(match) {
+		isWinner := winners[change.PlayerID]
+		if isWinner && change.Mu <= 1000 {
+			t.Errorf("winner %s should gain mu, got %.2f", change.PlayerID, change.Mu)
+		}
+		if !isWinner && change.Mu >= 1000 {
+			t.Errorf("loser %s should lose mu, got %.2f", change.PlayerID, change.Mu)
+		}
+		if change.Sigma >= openSkillSigma {
+			t.Errorf("sigma should shrink after a match, got %.2f", change.Sigma)
+		}
+	}
+}
+
+func TestOpenSkillUnevenTeams(t *testing.T) {
+	rs := &OpenSkillRatingSystem{}
+	five := newTestMatch([]int{1000, 1000, 1000, 1000, 1000}, []int{1000, 1000, 1000, 1000})
+
+	// The bigger team is favoured, so beating the smaller one earns less
+	if p := rs.ExpectedScore(five.Winner, five.Loser); p <= 0.5 {
+		t.Fatalf("expected the 5-player team to be favoured, got %.2f", p)
+	}
+
+	evenMatch := newTestMatch([]int{1000, 1000, 1000, 1000, 1000}, []int{1000, 1000, 1000, 1000, 1000})
+	unevenGain := rs.RateMatch(five)[0].Mu - 1000
+	evenGain := rs.RateMatch(evenMatch)[0].Mu - 1000
+	if unevenGain >= evenGain {
+		t.Fatalf("winning 5v4 should gain less than 5v5: %.2f vs %.2f", unevenGain, evenGain)
+	}
+}
+
+func TestMarginOfVictory(t *testing.T) {
+	delta := func(rs RatingSystem, winnerScore, loserScore int) int {
+		match := newTestMatch([]int{1000}, []int{1000})
+		match.WinnerScore, match.LoserScore = winnerScore, loserScore
+		return rs.RateMatch(match)[0].MMRDelta
+	}
+
+	plain := &EloRatingSystem{}
+	full := delta(plain, 0, 0)
+	if delta(plain, 13, 2) != full || delta(plain, 13, 11) != full {
+		t.Fatalf("expected scores to be ignored without the option")
+	}
+
+	rs, err := NewRatingSystem("elo", RatingOptions{MarginOfVictory: true})
+	if err != nil {
+		t.Fatalf("Error creating rating system: %v", err)
+	}
+	close, blowout := delta(rs, 13, 11), delta(rs, 13, 2)
+	if delta(rs, 0, 0) != full {
+		t.Errorf("expected a match without a score to be rated in full, got %d", delta(rs, 0, 0))
+	}
+	if !(close < full && full < blowout) {
+		t.Errorf("expected 13-11 < unscored < 13-2, got %d, %d and %d", close, full, blowout)
+	}
+	if delta(rs, 13, 7) != full {
+		t.Errorf("expected the baseline margin to be rated in full, got %d", delta(rs, 13, 7))
+	}
+
+	// OpenSkill moves the mean less for a close game as well
+	os, _ := NewRatingSystem("openskill", RatingOptions{MarginOfVictory: true})
+	closeMatch, blowoutMatch := newTestMatch([]int{1000}, []int{1000}), newTestMatch([]int{1000}, []int{1000})
+	closeMatch.WinnerScore, closeMatch.LoserScore = 13, 11
+	blowoutMatch.WinnerScore, blowoutMatch.LoserScore = 13, 2
+	if os.RateMatch(closeMatch)[0].Mu >= os.RateMatch(blowoutMatch)[0].Mu {
+		t.Errorf("expected a blowout to raise the winner's mean more than a close game")
+	}
+}
+
+func TestDrawRatings(t *testing.T) {
+	// In a draw the lower rated team gains and the favourite loses
+	for _, name := range []string{"elo", "glicko2", "openskill"} {
+		rs, _ := NewRatingSystem(name)
+		match := newTestMatch([]int{1200, 1200}, []int{1000, 1000})
+		match.Draw = true
+		for _, change := range rs.RateMatch(match) {
+			favourite := change.PlayerID == "a" || change.PlayerID == "b"
+			moved := float64(change.MMRDelta)
+			if change.Sigma > 0 {
+				moved = change.Mu - 1200
+				if !favourite {
+					moved = change.Mu - 1000
+				}
+			}
+			if favourite && moved >= 0 || !favourite && moved <= 0 {
+				t.Errorf("%s: unexpected change for %s in a draw: %+v", name, change.PlayerID, change)
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+)
+
+// Weng-Lin (OpenSkill) parameters. The model defaults (mu 25, sigma 25/3)
+// are scaled so a new player's mu equals the default MMR.
+const (
+	openSkillScale = float64(defaultMMR) / 25
+	openSkillMu    = 25 * openSkillScale
+	openSkillSigma = openSkillMu / 3
+	openSkillBeta  = openSkillSigma / 2
+	openSkillTau   = openSkillMu / 300
+	openSkillKappa = 0.0001
+)
+
+// OpenSkillRatingSystem rates matches with the Weng-Lin Plackett-Luce model.
+// Teams are rated as the sum of their players, so 5v5 and uneven teams are
+// handled by the model itself and each player's share of the update is
+// proportional to their own uncertainty.
+type OpenSkillRatingSystem struct {
+	RatingOptions
+}
+
+func (o *OpenSkillRatingSystem) Name() string {
+	return "openskill"
+}
+
+// openSkillTeam holds the summed skill of a team and its finishing rank
+type openSkillTeam struct {
+	players []*Player
+	mu      float64
+	sigmaSq float64
+	rank    int
+}
+
+func (o *OpenSkillRatingSystem) RateMatch(match *Match) []RatingChange {
+	loserRank := 1
+	if match.Draw {
+		loserRank = 0
+	}
+	teams := []*openSkillTeam{
+		newOpenSkillTeam(match.Winner, 0),
+		newOpenSkillTeam(match.Loser, loserRank),
+	}
+	return o.scaleByMargin(match, openSkillUpdate(teams))
+}
+
+// ExpectedScore is the probability that team's performance exceeds opponent's
+func (o *OpenSkillRatingSystem) ExpectedScore(team, opponent *Team) float64 {
+	a := newOpenSkillTeam(team, 0)
+	b := newOpenSkillTeam(opponent, 0)
+	n := float64(len(a.players) + len(b.players))
+	return normalCDF((a.mu - b.mu) / math.Sqrt(n*openSkillBeta*openSkillBeta+a.sigmaSq+b.sigmaSq))
+}
+
+// openSkillRating returns the player's mu and sigma, seeding them from MMR for new players
+func openSkillRating(player *Player) (float64, float64) {
+	mu, sigma := player.Mu, player.Sigma
+	if sigma <= 0 {
+		mu = float64(player.MMR)
+		sigma = openSkillSigma
+	}
+	return mu, sigma
+}
+
+func newOpenSkillTeam(team *Team, rank int) *openSkillTeam {
+	t := &openSkillTeam{players: team.Players, rank: rank}
+	for _, player := range team.Players {
+		mu, sigma := openSkillRating(player)
+		t.mu += mu
+		t.sigmaSq += sigma*sigma + openSkillTau*openSkillTau
+	}
+	return t
+}
+
+// openSkillUpdate applies the Plackett-Luce update to teams ordered by rank
+// (lower is better, equal ranks are a draw)
+func openSkillUpdate(teams []*openSkillTeam) []RatingChange {
+	var c float64
+	for _, team := range teams {
+		c += team.sigmaSq + openSkillBeta*openSkillBeta
+	}
+	c = math.Sqrt(c)
+
+	// Sum of exp(mu/c) over every team ranked at or below q, and the tie counts
+	sumQ := make([]float64, len(teams))
+	tied := make([]float64, len(teams))
+	for q, teamQ := range teams {
+		for _, team := range teams {
+			if team.rank >= teamQ.rank {
+				sumQ[q] += math.Exp(team.mu / c)
+			}
+			if team.rank == teamQ.rank {
+				tied[q]++
+			}
+		}
+	}
+
+	var changes []RatingChange
+	for i, team := range teams {
+		expI := math.Exp(team.mu / c)
+		var omega, delta float64
+		for q, teamQ := range teams {
+			if teamQ.rank > team.rank {
+				continue
+			}
+			quotient := expI / sumQ[q]
+			if q == i {
+				omega += (1 - quotient) / tied[q]
+			} else {
+				omega -= quotient / tied[q]
+			}
+			delta += quotient * (1 - quotient) / tied[q]
+		}
+		gamma := math.Sqrt(team.sigmaSq) / c
+		omega *= team.sigmaSq / c
+		delta *= gamma * team.sigmaSq / (c * c)
+
+		for _, player := range team.players {
+			mu, sigma := openSkillRating(player)
+			sigmaSq := sigma*sigma + openSkillTau*openSkillTau
+			newMu := mu + sigmaSq/team.sigmaSq*omega
+			newSigma := math.Sqrt(sigmaSq * math.Max(1-sigmaSq/team.sigmaSq*delta, openSkillKappa))
+			changes = append(changes, RatingChange{
+				PlayerID: player.PlayerID,
+				MMRDelta: int(math.Round(newMu)) - player.MMR,
+				Mu:       newMu,
+				Sigma:    newSigma,
+			})
+		}
+	}
+	return changes
+}
+
+// Standard normal cumulative distribution function
+func normalCDF(x float64) float64 {
+	return 0.5 * math.Erfc(-x/math.Sqrt2)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KDA is the kills plus assists per death of a single match
+func (s PlayerStats) KDA() float64 {
+	return float64(s.Kills+s.Assists) / math.Max(1.0, float64(s.Deaths))
+}
+
+// PerformanceEdit is an entry of the audit trail of reported stats
+type PerformanceEdit struct {
+	PlayerID string
+	EditorID string
+	// Previous is nil for the first report of a player
+	Previous  *PlayerStats
+	Stats     PlayerStats
+	Timestamp time.Time
+}
+
+// Store the stats a player reported for a match, replacing an earlier report
+// so every player has a single performance per match. Stats can only change
+// until the match is rated; every change is kept in the audit trail.
+func (db *DB) ReportPerformance(matchID int, playerID, editorID string, stats PlayerStats) error {
+	return db.ReportPerformances(matchID, editorID, map[string]PlayerStats{playerID: stats})
+}
+
+// Store the stats of several players of a match at once like
+// ReportPerformance does for one. Stats a player cannot have had in the match
+// are rejected.
+func (db *DB) ReportPerformances(matchID int, editorID string, performances map[string]PlayerStats) error {
+	return db.reportPerformances(matchID, editorID, performances, false)
+}
+
+// MergePerformances stores stats that cover only part of a performance, such
+// as a scoreboard's, like ReportPerformances. Extended stats missing from the
+// new stats keep the values reported before.
+func (db *DB) MergePerformances(matchID int, editorID string, performances map[string]PlayerStats) error {
+	return db.reportPerformances(matchID, editorID, performances, true)
+}
+
+func (db *DB) reportPerformances(matchID int, editorID string, performances map[string]PlayerStats, merge bool) error {
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status MatchStatus
+	if err := tx.QueryRow("SELECT Status FROM matches WHERE MatchID = ?", matchID).Scan(&status); err != nil {
+		return err
+	}
+	if !(&Match{Status: status}).statsOpen() {
+		return fmt.Errorf("match %d is %s, stats can no longer be changed", matchID, status)
+	}
+
+	playerIDs := make([]string, 0, len(performances))
+	for playerID := range performances {
+		playerIDs = append(playerIDs, playerID)
+	}
+	sort.Strings(playerIDs)
+	for _, playerID := range playerIDs {
+		stats := performances[playerID]
+		if merge {
+			// Read what is stored now, so corrections made in the meantime are kept
+			prev, _, err := getPerformance(tx, matchID, playerID)
+			if err != nil {
+				return err
+			}
+			stats.Extra = mergeStatValues(prev.Extra, stats.Extra)
+		}
+		if err := match.checkStats(playerID, stats); err != nil {
+			return err
+		}
+		if err := reportPerformance(tx, matchID, playerID, editorID, stats); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func reportPerformance(q querier, matchID int, playerID, editorID string, stats PlayerStats) error {
+	var previous sql.NullString
+	prev, found, err := getPerformance(q, matchID, playerID)
+	if err != nil {
+		return err
+	}
+	if found {
+		data, _ := json.Marshal(prev)
+		previous = sql.NullString{String: string(data), Valid: true}
+	}
+
+	if err := upsertPerformance(q, matchID, playerID, stats); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(stats)
+	_, err = q.Exec(`
+		INSERT INTO performance_edits (MatchID, PlayerID, EditorID, Previous, Stats, Timestamp)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, matchID, playerID, editorID, previous, string(data), time.Now().UTC())
+	return err
+}
+
+func upsertPerformance(exec execer, matchID int, playerID string, stats PlayerStats) error {
+	_, err := exec.Exec(`
+		INSERT INTO player_performances (MatchID, PlayerID, Kills, Assists, Deaths)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(MatchID, PlayerID) DO UPDATE SET
+			Kills = excluded.Kills,
+			Assists = excluded.Assists,
+			Deaths = excluded.Deaths
+	`, matchID, playerID, stats.Kills, stats.Assists, stats.Deaths)
+	if err != nil {
+		return err
+	}
+	return saveStatValues(exec, matchID, playerID, stats.Extra)
+}
+
+// Retrieve the stats a player reported for a match, if any
+func (db *DB) GetPerformance(matchID int, playerID string) (PlayerStats, bool, error) {
+	return getPerformance(db.db, matchID, playerID)
+}
+
+func getPerformance(q querier, matchID int, playerID string) (PlayerStats, bool, error) {
+	var stats PlayerStats
+	err := q.QueryRow("SELECT Kills, Assists, Deaths FROM player_performances WHERE MatchID = ? AND PlayerID = ?", matchID, playerID).
+		Scan(&stats.Kills, &stats.Assists, &stats.Deaths)
+	if err == sql.ErrNoRows {
+		return stats, false, nil
+	}
+	if err != nil {
+		return stats, false, err
+	}
+	stats.Extra, err = getStatValues(q, matchID, playerID)
+	return stats, err == nil, err
+}
+
+// Retrieve the audit trail of the stats reported for a match, oldest first
+func (db *DB) GetPerformanceEdits(matchID int) ([]PerformanceEdit, error) {
+	rows, err := db.db.Query("SELECT PlayerID, EditorID, Previous, Stats, Timestamp FROM performance_edits WHERE MatchID = ? ORDER BY EditID", matchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edits []PerformanceEdit
+	for rows.Next() {
+		var edit PerformanceEdit
+		var previous sql.NullString
+		var stats string
+		var timestamp sql.NullTime
+		if err := rows.Scan(&edit.PlayerID, &edit.EditorID, &previous, &stats, &timestamp); err != nil {
+			return nil, err
+		}
+		if previous.Valid {
+			edit.Previous = &PlayerStats{}
+			if err := json.Unmarshal([]byte(previous.String), edit.Previous); err != nil {
+				return nil, err
+			}
+		}
+		if err := json.Unmarshal([]byte(stats), &edit.Stats); err != nil {
+			return nil, err
+		}
+		edit.Timestamp = timestamp.Time
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
+
+// Players could once report stats for a match several times. Before every
+// player is limited to one performance per match, the extra rows go to the
+// audit trail; a rated match keeps its first row, which is the one its totals
+// counted, and other matches keep the latest report.
+func (db *DB) migratePerformances() error {
+	var exists int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'player_performances_unique'").Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT p.MatchID, p.PlayerID, p.Kills, p.Assists, p.Deaths FROM player_performances p
+		JOIN (SELECT MatchID, PlayerID FROM player_performances GROUP BY MatchID, PlayerID HAVING COUNT(*) > 1) d
+			ON d.MatchID = p.MatchID AND d.PlayerID = p.PlayerID
+		ORDER BY p.PerformanceID
+	`)
+	if err != nil {
+		return err
+	}
+	type duplicate struct {
+		matchID  int
+		playerID string
+		stats    PlayerStats
+	}
+	var duplicates []duplicate
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.matchID, &d.playerID, &d.stats.Kills, &d.stats.Assists, &d.stats.Deaths); err != nil {
+			rows.Close()
+			return err
+		}
+		duplicates = append(duplicates, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, d := range duplicates {
+		data, _ := json.Marshal(d.stats)
+		_, err := tx.Exec("INSERT INTO performance_edits (MatchID, PlayerID, EditorID, Stats) VALUES (?, ?, ?, ?)", d.matchID, d.playerID, d.playerID, string(data))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM player_performances WHERE PerformanceID NOT IN (
+			SELECT CASE WHEN m.Status IN (?, ?) THEN MIN(p.PerformanceID) ELSE MAX(p.PerformanceID) END
+			FROM player_performances p LEFT JOIN matches m ON m.MatchID = p.MatchID
+			GROUP BY p.MatchID, p.PlayerID
+		)
+	`, MatchStatusFinalized, MatchStatusVoided)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("CREATE UNIQUE INDEX player_performances_unique ON player_performances (MatchID, PlayerID)"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// statsOpen reports whether players can still report stats: from the result
+// report until the match is rated
+func (m *Match) statsOpen() bool {
+	return m.Status == MatchStatusPending || m.Status == MatchStatusConfirmed || m.Status == MatchStatusDisputed
+}
+
+// Retrieve the confirmed matches whose ratings wait for reported stats
+func (db *DB) GetMatchesAwaitingStats() ([]int, error) {
+	rows, err := db.db.Query("SELECT MatchID FROM matches WHERE Status = ?", MatchStatusConfirmed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matchIDs []int
+	for rows.Next() {
+		var matchID int
+		if err := rows.Scan(&matchID); err != nil {
+			return nil, err
+		}
+		matchIDs = append(matchIDs, matchID)
+	}
+	return matchIDs, rows.Err()
+}
+
+// playerKDA is the player's KDA in this match; reported is false when they
+// reported no stats, which leaves the KDA at 0
+func (m *Match) playerKDA(player *Player) (kda float64, reported bool) {
+	stats, ok := m.Performances[player.PlayerID]
+	if !ok {
+		return 0, false
+	}
+	return stats.KDA(), true
+}
+
+// teamKDA is the average KDA in this match of the team's players who
+// reported stats
+func (m *Match) teamKDA(team *Team) float64 {
+	total, reported := 0.0, 0
+	for _, player := range team.Players {
+		if kda, ok := m.playerKDA(player); ok {
+			total += kda
+			reported++
+		}
+	}
+	if reported == 0 {
+		return 0
+	}
+	return total / float64(reported)
+}
+
+// missingStats returns the players of the match who have not reported stats
+func (m *Match) missingStats(performances map[string]PlayerStats) []*Player {
+	var missing []*Player
+	for _, player := range m.players() {
+		if _, ok := performances[player.PlayerID]; !ok {
+			missing = append(missing, player)
+		}
+	}
+	return missing
+}
+
+// settleMatch rates a confirmed match once every player reported stats that
+// raise no warnings, or the guild's stats deadline has passed since the
+// result was confirmed.
+// It returns the finalized match, or nil while stats are still awaited.
+func settleMatch(db *DB, matchID int) (*Match, error) {
+	match, err := db.GetMatch(matchID)
+	if err != nil {
+		return nil, err
+	}
+	if match.Status != MatchStatusConfirmed {
+		return nil, fmt.Errorf("match %d is %s, not confirmed", matchID, match.Status)
+	}
+	cfg, err := db.GetGuildConfig(match.GuildID)
+	if err != nil {
+		return nil, err
+	}
+	performances, err := db.GetRecordedPerformances(matchID)
+	if err != nil {
+		return nil, err
+	}
+	// Flagged stats also wait for the deadline so they can be corrected
+	complete := len(match.missingStats(performances)) == 0 && len(match.statsWarnings(performances)) == 0
+	if !complete && time.Since(match.ConfirmedAt) < cfg.StatsDeadline {
+		return nil, nil
+	}
+	return FinalizeMatch(db, matchID)
+}
+
+// Mention the players, e.g. to list who still has to report stats
+func mentionPlayers(players []*Player) string {
+	var mentions []string
+	for _, player := range players {
+		mentions = append(mentions, fmt.Sprintf("<@%s>", player.PlayerID))
+	}
+	return strings.Join(mentions, ", ")
+}
+
+// Describe reported stats as K/A/D followed by any extended stats
+func describeStats(stats PlayerStats) string {
+	description := fmt.Sprintf("%d/%d/%d", stats.Kills, stats.Assists, stats.Deaths)
+	if extra := describeExtendedStats(stats.Extra); extra != "" {
+		description += " (" + extra + ")"
+	}
+	return description
+}
+
+// Command to show the audit trail of the stats reported for a match:
+// `!statslog <matchID>`
+func statsLogCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	if len(args) < 2 {
+		s.ChannelMessageSend(m.ChannelID, "Please specify the match ID, e.g. `!statslog 42`.")
+		return
+	}
+	matchID, err := strconv.Atoi(args[1])
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Invalid match ID.")
+		return
+	}
+	if match, err := db.GetMatch(matchID); err != nil || match.GuildID != m.GuildID {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d not found.", matchID))
+		return
+	}
+
+	edits, err := db.GetPerformanceEdits(matchID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading the stats log: %v", err))
+		return
+	}
+	if len(edits) == 0 {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("No stats were reported for match %d.", matchID))
+		return
+	}
+
+	var lines []string
+	for _, edit := range edits {
+		change := "reported " + describeStats(edit.Stats)
+		if edit.Previous != nil {
+			change = fmt.Sprintf("changed %s to %s", describeStats(*edit.Previous), describeStats(edit.Stats))
+		}
+		by := ""
+		if edit.EditorID != edit.PlayerID {
+			by = fmt.Sprintf(" by <@%s>", edit.EditorID)
+		}
+		when := ""
+		if !edit.Timestamp.IsZero() {
+			when = edit.Timestamp.Format("2006-01-02 15:04") + " "
+		}
+		lines = append(lines, fmt.Sprintf("%s<@%s> %s%s", when, edit.PlayerID, change, by))
+	}
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Stats log of match %d", matchID),
+		Description: strings.Join(lines, "\n"),
+		Color:       0x00ff00,
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsDeadline(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.SetGuildSetting(testGuildID, "stats_deadline", "1h"); err != nil {
+		t.Fatalf("Error changing setting: %v", err)
+	}
+	matchID := createTestMatch(t, db, []string{"a", "b"}, []string{"c", "d"})
+	if err := db.ReportMatchResult(matchID, 1); err != nil {
+		t.Fatalf("Error reporting result: %v", err)
+	}
+
+	// A second report replaces the first
+	db.ReportPerformance(matchID, "a", "a", PlayerStats{Kills: 5, Assists: 1, Deaths: 9})
+	db.ReportPerformance(matchID, "a", "a", PlayerStats{Kills: 25, Assists: 4, Deaths: 12})
+	if performances, _ := db.GetRecordedPerformances(matchID); len(performances) != 1 || performances["a"].Kills != 25 {
+		t.Fatalf("expected a single performance with the latest stats, got %v", performances)
+	}
+
+	for _, playerID := range []string{"c", "d"} {
+		if _, _, err := ConfirmMatchResult(db, matchID, playerID); err != nil {
+			t.Fatalf("Error confirming: %v", err)
+		}
+	}
+	if finalized, err := settleMatch(db, matchID); err != nil || finalized != nil {
+		t.Fatalf("expected the match to wait for the missing stats, got %v, %v", finalized, err)
+	}
+	if a, _ := db.GetPlayer(testGuildID, "a"); a.GamesPlayed != 0 {
+		t.Fatalf("ratings must not change before the stats are in")
+	}
+
+	// Once the deadline passes the match is rated with the stats reported so far
+	db.db.Exec("UPDATE matches SET ConfirmedAt = ? WHERE MatchID = ?", time.Now().Add(-2*time.Hour).UTC(), matchID)
+	finalized, err := settleMatch(db, matchID)
+	if err != nil || finalized == nil {
+		t.Fatalf("expected the match to be rated after the deadline, got %v, %v", finalized, err)
+	}
+	if missing := finalized.missingStats(finalized.Performances); len(missing) != 3 {
+		t.Fatalf("expected three players without stats, got %d", len(missing))
+	}
+	a, _ := db.GetPlayer(testGuildID, "a")
+	b, _ := db.GetPlayer(testGuildID, "b")
+	if a.Kills != 25 || a.Assists != 4 || a.Deaths != 12 || b.Kills != 0 || b.GamesPlayed != 1 {
+		t.Fatalf("expected lifetime totals to be the reported stats, got %+v and %+v", a, b)
+	}
+}
+
+func TestMatchKDADrivesRating(t *testing.T) {
+	rate := func(stats PlayerStats) int {
+		match := newTestMatch([]int{1000, 1000}, []int{1000, 1000})
+		match.Performances = map[string]PlayerStats{"a": stats}
+		for _, change := range (&EloRatingSystem{}).RateMatch(match) {
+			if change.PlayerID == "a" {
+				return change.MMRDelta
+			}
+		}
+		return 0
+	}
+
+	// The players' lifetime stats are identical, only this match differs
+	if good, poor := rate(PlayerStats{Kills: 30, Assists: 5, Deaths: 10}), rate(PlayerStats{Kills: 5, Deaths: 20}); good <= poor {
+		t.Fatalf("expected a strong match to earn more than a weak one, got %d and %d", good, poor)
+	}
+}
+
+func TestEditPerformance(t *testing.T) {
+	db := newTestDB(t)
+	matchID := createTestMatch(t, db, []string{"a", "b"}, []string{"c", "d"})
+
+	// Stats open with the result report
+	if err := db.ReportPerformance(matchID, "a", "a", PlayerStats{Kills: 1}); err == nil {
+		t.Fatalf("expected stats to be rejected before a result is reported")
+	}
+	db.ReportMatchResult(matchID, 1)
+	if err := db.ReportPerformance(matchID, "a", "a", PlayerStats{Kills: 12, Assists: 3, Deaths: 8}); err != nil {
+		t.Fatalf("Error reporting stats: %v", err)
+	}
+	if err := db.ReportPerformance(matchID, "a", "admin", PlayerStats{Kills: 21, Assists: 3, Deaths: 8}); err != nil {
+		t.Fatalf("Error editing stats: %v", err)
+	}
+	if stats, ok, _ := db.GetPerformance(matchID, "a"); !ok || stats.Kills != 21 {
+		t.Fatalf("expected the edited stats, got %+v, %v", stats, ok)
+	}
+
+	edits, err := db.GetPerformanceEdits(matchID)
+	if err != nil || len(edits) != 2 {
+		t.Fatalf("expected two audit entries, got %v, %v", edits, err)
+	}
+	if edits[0].Previous != nil || edits[1].Previous == nil || edits[1].Previous.Kills != 12 || edits[1].Stats.Kills != 21 || edits[1].EditorID != "admin" {
+		t.Fatalf("unexpected audit trail: %+v", edits)
+	}
+
+	// The edit window closes once the match is rated
+	if _, err := ForceConfirmMatch(db, matchID); err != nil {
+		t.Fatalf("Error confirming match: %v", err)
+	}
+	if err := db.ReportPerformance(matchID, "a", "a", PlayerStats{Kills: 40}); err == nil {
+		t.Fatalf("expected stats of a rated match to be locked")
+	}
+	if a, _ := db.GetPlayer(testGuildID, "a"); a.Kills != 21 {
+		t.Fatalf("expected the edited stats in the totals, got %d kills", a.Kills)
+	}
+}
+
+func TestMigratePerformances(t *testing.T) {
+	db := newTestDB(t)
+	rated := createTestMatch(t, db, []string{"a"}, []string{"b"})
+	open := createTestMatch(t, db, []string{"a"}, []string{"b"})
+	db.ReportMatchResult(rated, 1)
+	ForceConfirmMatch(db, rated)
+	db.ReportMatchResult(open, 1)
+
+	// Rows from before the unique index, when every click added a row
+	if _, err := db.db.Exec("DROP INDEX player_performances_unique"); err != nil {
+		t.Fatalf("Error dropping index: %v", err)
+	}
+	for _, matchID := range []int{rated, open} {
+		for kills := 1; kills <= 3; kills++ {
+			db.db.Exec("INSERT INTO player_performances (MatchID, PlayerID, Kills, Assists, Deaths) VALUES (?, 'a', ?, 0, 0)", matchID, kills)
+		}
+	}
+	if err := db.migratePerformances(); err != nil {
+		t.Fatalf("Error migrating: %v", err)
+	}
+
+	// The rated match keeps the row its totals counted, the open one the latest report
+	if stats, _, _ := db.GetPerformance(rated, "a"); stats.Kills != 1 {
+		t.Errorf("expected the first row of the rated match, got %d kills", stats.Kills)
+	}
+	if stats, _, _ := db.GetPerformance(open, "a"); stats.Kills != 3 {
+		t.Errorf("expected the latest row of the open match, got %d kills", stats.Kills)
+	}
+	if edits, _ := db.GetPerformanceEdits(open); len(edits) != 3 {
+		t.Errorf("expected every duplicate in the audit trail, got %d", len(edits))
+	}
+	if err := db.SavePlayerPerformance(open, "a", PlayerStats{Kills: 9}); err != nil {
+		t.Fatalf("Error saving performance: %v", err)
+	}
+	var rows int
+	db.db.QueryRow("SELECT COUNT(*) FROM player_performances WHERE MatchID = ? AND PlayerID = 'a'", open).Scan(&rows)
+	if rows != 1 {
+		t.Fatalf("expected one performance per player and match, got %d", rows)
+	}
+}
+
+func TestFinalizeFailureKeepsMatchConfirmed(t *testing.T) {
+	db := newTestDB(t)
+	matchID := createTestMatch(t, db, []string{"a"}, []string{"b"})
+	db.ReportMatchResult(matchID, 1)
+	db.ReportPerformance(matchID, "a", "a", PlayerStats{Kills: 12, Deaths: 8})
+
+	// A stored value that cannot be read makes loading the stats fail
+	db.db.Exec("INSERT INTO player_stat_values (MatchID, PlayerID, Stat, Value) VALUES (?, 'a', 'adr', NULL)", matchID)
+	if _, err := ForceConfirmMatch(db, matchID); err == nil {
+		t.Fatalf("expected finalizing to fail")
+	}
+	if match, _ := db.GetMatch(matchID); match.Status != MatchStatusConfirmed {
+		t.Fatalf("expected the match to stay confirmed, got %s", match.Status)
+	}
+	if a, _ := db.GetPlayer(testGuildID, "a"); a.GamesPlayed != 0 {
+		t.Fatalf("ratings must not change when finalizing fails")
+	}
+
+	// Once the stats are fixed the match is rated on the next attempt
+	db.db.Exec("DELETE FROM player_stat_values WHERE MatchID = ?", matchID)
+	if _, err := FinalizeMatch(db, matchID); err != nil {
+		t.Fatalf("Error finalizing match: %v", err)
+	}
+	if a, _ := db.GetPlayer(testGuildID, "a"); a.GamesPlayed != 1 || a.Kills != 12 {
+		t.Fatalf("expected the match to be rated, got %+v", a)
+	}
+}
@@ -2,9 +2,18 @@ package main
 
 import (
 	"math"
+	"time"
+)
+
+// Starting values for new players
+const (
+	defaultMMR             = 1000
+	defaultRatingDeviation = 350
+	defaultVolatility      = 0.06
 )
 
 type Player struct {
+	GuildID     string
 	PlayerID    string
 	PlayerName  string
 	CoreMember  bool
@@ -17,10 +26,31 @@ type Player struct {
 	Percentile  float64
 	KDA         float64
 	Sniper      bool
+
+	// Glicko-2 rating uncertainty
+	RatingDeviation float64
+	Volatility      float64
+	LastPlayed      time.Time
+
+	// OpenSkill skill estimate and its uncertainty, on the MMR scale
+	Mu    float64
+	Sigma float64
 }
 
-func (p *Player) GetPlayer(playerID string, db *DB) (*Player, error) {
-	return db.GetPlayer(playerID)
+// NewPlayer creates a player on a guild's ladder with the default starting rating
+func NewPlayer(guildID, playerID, playerName string) *Player {
+	return &Player{
+		GuildID:         guildID,
+		PlayerID:        playerID,
+		PlayerName:      playerName,
+		MMR:             defaultMMR,
+		RatingDeviation: defaultRatingDeviation,
+		Volatility:      defaultVolatility,
+	}
+}
+
+func (p *Player) GetPlayer(guildID, playerID string, db *DB) (*Player, error) {
+	return db.GetPlayer(guildID, playerID)
 }
 
 func (p *Player) SavePlayer(player *Player, db *DB) error {
@@ -31,6 +61,12 @@ func (p *Player) CalculateKda() float64 {
 	return float64(p.Kills+p.Assists) / math.Max(1.0, float64(p.Deaths))
 }
 
+// ConservativeRating is the skill the player is very likely above (mu - 3 sigma)
+func (p *Player) ConservativeRating() int {
+	mu, sigma := openSkillRating(p)
+	return int(math.Round(mu - 3*sigma))
+}
+
 func (p *Player) SaveStats(db *DB) error {
 	return db.SavePlayer(p)
 }
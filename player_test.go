@@ -21,44 +21,32 @@ func getRandomPlayers(playerIDs []string, num int) []string {
 }
 
 func TestSelectPlayersForGameWithRandomRealPlayers(t *testing.T) {
-	initDB()
-
-	// Get all players from the database
-	//allPlayerIDs, err := getPlayersFromDB()
-	//if err != nil {
-	//	t.Fatalf("Error fetching players from DB: %v", err)
-	//}
-
-	// Pick 10 random players
-	//playerIDs := getRandomPlayers(allPlayerIDs, 10)
-
-	commentatorID := "108220450194092032" // Assuming this is your commentator ID
-
 	var playerIDs = []string{"149587719725514752", "91586668531814400", "380370600746680320", "245963484783837184", "359428429256589313", "692045889522499615", "185708633575784449", "414137584235708437", "416909299915161600", "170206898426085378"}
 
 	// Call the function to select players for the game
-	team1, team2, err := selectPlayersForGame(playerIDs, true, commentatorID)
+	split, err := BalanceTeams(getTestPlayers(playerIDs), &EloRatingSystem{}, BalanceOptions{})
 	if err != nil {
 		t.Fatalf("Error selecting players: %v", err)
 	}
+	team1, team2 := split.Team1, split.Team2
 
 	// Check if the teams were created correctly
-	if len(team1) == 0 || len(team2) == 0 {
-		t.Fatalf("Teams should not be empty. Team1: %d, Team2: %d", len(team1), len(team2))
+	if len(team1.Players) == 0 || len(team2.Players) == 0 {
+		t.Fatalf("Teams should not be empty. Team1: %d, Team2: %d", len(team1.Players), len(team2.Players))
 	}
 
 	// Ensure the number of players in both teams adds up to 10
-	if len(team1)+len(team2) != 10 {
-		t.Fatalf("Expected 10 players but got %d in total", len(team1)+len(team2))
+	if len(team1.Players)+len(team2.Players) != 10 {
+		t.Fatalf("Expected 10 players but got %d in total", len(team1.Players)+len(team2.Players))
 	}
 
 	// Optional: Verify that MMR differences between teams are minimized
-	team1ELO := calculateTeamELO(team1)
-	team2ELO := calculateTeamELO(team2)
+	team1ELO := team1.calculateTeamMmr()
+	team2ELO := team2.calculateTeamMmr()
 
 	// Log the names of players in each team
-	logTeamNames("Team 1", team1ELO, team1)
-	logTeamNames("Team 2", team2ELO, team2)
+	logTeamNames("Team 1", team1ELO, team1.Players)
+	logTeamNames("Team 2", team2ELO, team2.Players)
 
 	eloDiff := abs(team1ELO - team2ELO)
 	if eloDiff > 100 {
@@ -72,7 +60,7 @@ func TestSelectPlayersForGameWithRandomRealPlayers(t *testing.T) {
 func logTeamNames(teamName string, teamElo int, team []*Player) {
 	log.Printf("%s, average elo (%d):", teamName, teamElo)
 	for _, player := range team {
-		log.Printf("Player: %s (MMR: %d)", player.PlayerName, player.ELO)
+		log.Printf("Player: %s (MMR: %d)", player.PlayerName, player.MMR)
 	}
 }
 
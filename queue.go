@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadyCheck asks the first players of a channel's queue to confirm they can play
+type ReadyCheck struct {
+	ID        int
+	GuildID   string
+	ChannelID string
+	MessageID string
+	// Size is how many players the check needs, the guild's queue size
+	Size      int
+	PlayerIDs []string
+	Ready     map[string]bool
+	Deadline  time.Time
+	// Round counts the deadlines the check went through, so stale timers are ignored
+	Round int
+}
+
+// readyChecks holds the running ready checks by ID, at most one per channel.
+// Unlike the queue they are not stored: a restart drops them while the
+// players stay queued, and !queue or the next !join starts a new check.
+var readyChecks = struct {
+	sync.Mutex
+	nextID    int
+	checks    map[int]*ReadyCheck
+	byChannel map[string]int
+}{checks: make(map[int]*ReadyCheck), byChannel: make(map[string]int)}
+
+// fill pulls queued players into the check until it is full
+func (c *ReadyCheck) fill(queue []string) {
+	for _, playerID := range queue {
+		if len(c.PlayerIDs) >= c.Size {
+			return
+		}
+		if !c.has(playerID) {
+			c.PlayerIDs = append(c.PlayerIDs, playerID)
+		}
+	}
+}
+
+func (c *ReadyCheck) has(playerID string) bool {
+	for _, id := range c.PlayerIDs {
+		if id == playerID {
+			return true
+		}
+	}
+	return false
+}
+
+// drop removes a player from the check, reporting whether they were in it
+func (c *ReadyCheck) drop(playerID string) bool {
+	for i, id := range c.PlayerIDs {
+		if id == playerID {
+			c.PlayerIDs = append(c.PlayerIDs[:i], c.PlayerIDs[i+1:]...)
+			delete(c.Ready, playerID)
+			return true
+		}
+	}
+	return false
+}
+
+// notReady lists the players who have not accepted yet
+func (c *ReadyCheck) notReady() []string {
+	var playerIDs []string
+	for _, playerID := range c.PlayerIDs {
+		if !c.Ready[playerID] {
+			playerIDs = append(playerIDs, playerID)
+		}
+	}
+	return playerIDs
+}
+
+// done reports whether the check is full and everyone accepted
+func (c *ReadyCheck) done() bool {
+	return len(c.PlayerIDs) == c.Size && len(c.notReady()) == 0
+}
+
+func (c *ReadyCheck) content() string {
+	var lines []string
+	for _, playerID := range c.PlayerIDs {
+		mark := "⏳"
+		if c.Ready[playerID] {
+			mark = "✅"
+		}
+		lines = append(lines, fmt.Sprintf("%s <@%s>", mark, playerID))
+	}
+	return fmt.Sprintf("**Ready check** (%d/%d ready)\n%s\n\nAccept <t:%d:R> or you are removed from the queue.",
+		len(c.PlayerIDs)-len(c.notReady()), c.Size, strings.Join(lines, "\n"), c.Deadline.Unix())
+}
+
+func (c *ReadyCheck) components(closed bool) []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Ready",
+					CustomID: fmt.Sprintf("ready_check_%d", c.ID),
+					Style:    discordgo.SuccessButton,
+					Disabled: closed,
+				},
+				discordgo.Button{
+					Label:    "Leave queue",
+					CustomID: fmt.Sprintf("ready_leave_%d", c.ID),
+					Style:    discordgo.DangerButton,
+					Disabled: closed,
+				},
+			},
+		},
+	}
+}
+
+// Command to join the queue of the channel
+func joinQueueCommand(s *discordgo.Session, m *discordgo.MessageCreate, db *DB) {
+	cfg, err := db.GetGuildConfig(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading settings: %v", err))
+		return
+	}
+	joined, err := db.JoinQueue(m.GuildID, m.ChannelID, m.Author.ID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error joining the queue: %v", err))
+		return
+	}
+	if !joined {
+		s.ChannelMessageSend(m.ChannelID, "You are already in the queue.")
+		return
+	}
+	queue, err := db.GetQueue(m.ChannelID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading the queue: %v", err))
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s joined the queue (%d/%d).", m.Author.Username, len(queue), cfg.QueueSize))
+	checkQueue(s, db, m.GuildID, m.ChannelID, cfg)
+}
+
+// Command to leave the queue of the channel
+func leaveQueueCommand(s *discordgo.Session, m *discordgo.MessageCreate, db *DB) {
+	left, err := db.LeaveQueue(m.ChannelID, m.Author.ID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error leaving the queue: %v", err))
+		return
+	}
+	if !left {
+		s.ChannelMessageSend(m.ChannelID, "You are not in the queue.")
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s left the queue.", m.Author.Username))
+	dropFromReadyCheck(s, db, m.ChannelID, m.Author.ID)
+}
+
+// Command to show the queue of the channel
+func queueCommand(s *discordgo.Session, m *discordgo.MessageCreate, db *DB) {
+	cfg, err := db.GetGuildConfig(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading settings: %v", err))
+		return
+	}
+	queue, err := db.GetQueue(m.ChannelID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading the queue: %v", err))
+		return
+	}
+	if len(queue) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "The queue is empty. Use `!join` to join it.")
+		return
+	}
+
+	readyChecks.Lock()
+	check := readyChecks.checks[readyChecks.byChannel[m.ChannelID]]
+	var lines []string
+	for position, playerID := range queue {
+		line := fmt.Sprintf("%d. <@%s>", position+1, playerID)
+		if check != nil && check.has(playerID) {
+			line += " (in ready check)"
+		}
+		lines = append(lines, line)
+	}
+	readyChecks.Unlock()
+
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Queue (%d/%d)", len(queue), cfg.QueueSize),
+		Description: strings.Join(lines, "\n"),
+		Color:       0x00ff00,
+	})
+
+	// A full queue without a check lost it to a restart
+	checkQueue(s, db, m.GuildID, m.ChannelID, cfg)
+}
+
+// Start a ready check once enough players are queued, or top up a running
+// check that lost players
+func checkQueue(s *discordgo.Session, db *DB, guildID, channelID string, cfg *Config) {
+	queue, err := db.GetQueue(channelID)
+	if err != nil {
+		log.Printf("Error loading queue of channel %s: %v", channelID, err)
+		return
+	}
+
+	readyChecks.Lock()
+	if checkID, ok := readyChecks.byChannel[channelID]; ok {
+		check := readyChecks.checks[checkID]
+		before := len(check.PlayerIDs)
+		check.fill(queue)
+		changed := len(check.PlayerIDs) != before
+		content, components := check.content(), check.components(false)
+		readyChecks.Unlock()
+		if changed {
+			editReadyCheck(s, check, content, components)
+		}
+		return
+	}
+	if len(queue) < cfg.QueueSize {
+		readyChecks.Unlock()
+		return
+	}
+
+	readyChecks.nextID++
+	check := &ReadyCheck{
+		ID:        readyChecks.nextID,
+		GuildID:   guildID,
+		ChannelID: channelID,
+		Size:      cfg.QueueSize,
+		Ready:     make(map[string]bool),
+		Deadline:  time.Now().Add(cfg.ReadyCheckTimeout),
+	}
+	check.fill(queue)
+	readyChecks.checks[check.ID] = check
+	readyChecks.byChannel[channelID] = check.ID
+	content, components := check.content(), check.components(false)
+	readyChecks.Unlock()
+
+	message, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:    content,
+		Components: components,
+	})
+	if err != nil {
+		log.Printf("Error posting ready check: %v", err)
+		readyChecks.Lock()
+		delete(readyChecks.checks, check.ID)
+		delete(readyChecks.byChannel, channelID)
+		readyChecks.Unlock()
+		return
+	}
+
+	readyChecks.Lock()
+	check.MessageID = message.ID
+	readyChecks.Unlock()
+	scheduleReadyCheck(s, db, check.ID, 0, cfg.ReadyCheckTimeout)
+}
+
+func editReadyCheck(s *discordgo.Session, check *ReadyCheck, content string, components []discordgo.MessageComponent) {
+	if check.MessageID == "" {
+		return
+	}
+	edit := discordgo.NewMessageEdit(check.ChannelID, check.MessageID).SetContent(content)
+	edit.Components = &components
+	if _, err := s.ChannelMessageEditComplex(edit); err != nil {
+		log.Printf("Error updating ready check %d: %v", check.ID, err)
+	}
+}
+
+// Remove a player who left the queue from the channel's ready check and pull in the next one
+func dropFromReadyCheck(s *discordgo.Session, db *DB, channelID, playerID string) {
+	queue, err := db.GetQueue(channelID)
+	if err != nil {
+		log.Printf("Error loading queue of channel %s: %v", channelID, err)
+	}
+
+	readyChecks.Lock()
+	check := readyChecks.checks[readyChecks.byChannel[channelID]]
+	if check == nil || !check.drop(playerID) {
+		readyChecks.Unlock()
+		return
+	}
+	check.fill(queue)
+	content, components := check.content(), check.components(false)
+	readyChecks.Unlock()
+	editReadyCheck(s, check, content, components)
+}
+
+// When round of the check is still running at the deadline, remove the players
+// who did not accept and pull in the next ones, or cancel the check if the
+// queue ran dry
+func scheduleReadyCheck(s *discordgo.Session, db *DB, checkID, round int, timeout time.Duration) {
+	time.AfterFunc(timeout, func() {
+		readyChecks.Lock()
+		check := readyChecks.checks[checkID]
+		if check == nil || check.Round != round {
+			readyChecks.Unlock()
+			return
+		}
+		missing := check.notReady()
+		for _, playerID := range missing {
+			check.drop(playerID)
+		}
+		readyChecks.Unlock()
+
+		if _, err := db.LeaveQueue(check.ChannelID, missing...); err != nil {
+			log.Printf("Error removing players from the queue: %v", err)
+		}
+		var mentions []string
+		for _, playerID := range missing {
+			mentions = append(mentions, fmt.Sprintf("<@%s>", playerID))
+		}
+		if len(mentions) > 0 {
+			s.ChannelMessageSend(check.ChannelID, fmt.Sprintf("%s did not accept in time and left the queue.", strings.Join(mentions, ", ")))
+		}
+
+		queue, err := db.GetQueue(check.ChannelID)
+		if err != nil {
+			log.Printf("Error loading queue of channel %s: %v", check.ChannelID, err)
+		}
+
+		readyChecks.Lock()
+		check.fill(queue)
+		if len(check.PlayerIDs) < check.Size {
+			delete(readyChecks.checks, checkID)
+			delete(readyChecks.byChannel, check.ChannelID)
+			content := fmt.Sprintf("**Ready check cancelled**, %d/%d players left in the queue. It starts again once the queue is full.", len(queue), check.Size)
+			readyChecks.Unlock()
+			editReadyCheck(s, check, content, check.components(true))
+			return
+		}
+		check.Round++
+		check.Deadline = time.Now().Add(timeout)
+		next := check.Round
+		content, components := check.content(), check.components(false)
+		readyChecks.Unlock()
+
+		editReadyCheck(s, check, content, components)
+		scheduleReadyCheck(s, db, checkID, next, timeout)
+	})
+}
+
+// Handle the "Ready" and "Leave queue" buttons of a ready check
+func handleReadyCheck(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	customID := i.MessageComponentData().CustomID
+	leave := strings.HasPrefix(customID, "ready_leave_")
+	checkID, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(customID, "ready_leave_"), "ready_check_"))
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Invalid ready check.")
+		return
+	}
+	userID := i.Member.User.ID
+
+	readyChecks.Lock()
+	check := readyChecks.checks[checkID]
+	if check == nil {
+		readyChecks.Unlock()
+		respondEphemeral(s, i.Interaction, "This ready check is over.")
+		return
+	}
+	if !check.has(userID) {
+		readyChecks.Unlock()
+		respondEphemeral(s, i.Interaction, "You are not part of this ready check.")
+		return
+	}
+	if leave {
+		readyChecks.Unlock()
+		if _, err := db.LeaveQueue(check.ChannelID, userID); err != nil {
+			respondEphemeral(s, i.Interaction, fmt.Sprintf("Error leaving the queue: %v", err))
+			return
+		}
+		respondPublic(s, i.Interaction, fmt.Sprintf("%s left the queue.", i.Member.User.Username))
+		dropFromReadyCheck(s, db, check.ChannelID, userID)
+		return
+	}
+
+	check.Ready[userID] = true
+	done := check.done()
+	if done {
+		delete(readyChecks.checks, checkID)
+		delete(readyChecks.byChannel, check.ChannelID)
+	}
+	content, components := check.content(), check.components(done)
+	playerIDs := append([]string{}, check.PlayerIDs...)
+	readyChecks.Unlock()
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: components,
+		},
+	})
+	if done {
+		formQueueLobby(s, db, check.GuildID, check.ChannelID, playerIDs)
+	}
+}
+
+// Form balanced teams from the players of a passed ready check and take them
+// out of the queue. They stay queued until their lobby is stored, so a failure
+// does not cost them their place.
+func formQueueLobby(s *discordgo.Session, db *DB, guildID, channelID string, playerIDs []string) {
+	players, err := loadPlayers(db, NewDiscord(s), guildID, playerIDs)
+	if err != nil {
+		s.ChannelMessageSend(channelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	cfg, err := db.GetGuildConfig(guildID)
+	if err != nil {
+		s.ChannelMessageSend(channelID, fmt.Sprintf("Error loading settings: %v", err))
+		return
+	}
+	rs, err := NewRatingSystem(cfg.RatingSystem)
+	if err != nil {
+		s.ChannelMessageSend(channelID, fmt.Sprintf("Error loading rating system: %v", err))
+		return
+	}
+	var opts BalanceOptions
+	if err := loadBalanceSettings(db, guildID, cfg, &opts); err != nil {
+		s.ChannelMessageSend(channelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	split, err := BalanceTeams(players, rs, opts)
+	if err != nil {
+		s.ChannelMessageSend(channelID, fmt.Sprintf("Error balancing teams: %v", err))
+		return
+	}
+
+	lobby, err := formLobby(db, guildID, channelID, "", split)
+	if err != nil {
+		s.ChannelMessageSend(channelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	if _, err := db.LeaveQueue(channelID, playerIDs...); err != nil {
+		log.Printf("Error removing players from the queue: %v", err)
+	}
+	s.ChannelMessageSend(channelID, "Everyone is ready!")
+	announceLobby(s, channelID, lobby, split)
+
+	// Enough players may still be queued for the next game
+	checkQueue(s, db, guildID, channelID, cfg)
+}
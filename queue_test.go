@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueueAndReadyCheck(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, playerID := range []string{"a", "b", "c", "d", "e", "f"} {
+		if joined, err := db.JoinQueue(testGuildID, "channel", playerID); err != nil || !joined {
+			t.Fatalf("expected %s to join the queue, got %v, %v", playerID, joined, err)
+		}
+	}
+	if joined, _ := db.JoinQueue(testGuildID, "channel", "a"); joined {
+		t.Fatalf("expected joining twice to be ignored")
+	}
+	db.JoinQueue(testGuildID, "other", "a")
+
+	queue, err := db.GetQueue("channel")
+	if err != nil {
+		t.Fatalf("Error loading queue: %v", err)
+	}
+	if !reflect.DeepEqual(queue, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Fatalf("expected the queue in join order, got %v", queue)
+	}
+
+	// The first four are asked; b accepts, c leaves and e is pulled in
+	check := &ReadyCheck{Size: 4, Ready: make(map[string]bool)}
+	check.fill(queue)
+	if !reflect.DeepEqual(check.PlayerIDs, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("expected the first four players in the check, got %v", check.PlayerIDs)
+	}
+	check.Ready["b"] = true
+	if left, _ := db.LeaveQueue("channel", "c"); !left || !check.drop("c") {
+		t.Fatalf("expected c to leave the queue and the check")
+	}
+	queue, _ = db.GetQueue("channel")
+	check.fill(queue)
+	if !reflect.DeepEqual(check.PlayerIDs, []string{"a", "b", "d", "e"}) {
+		t.Fatalf("expected e to replace c, got %v", check.PlayerIDs)
+	}
+
+	// Only b accepted, so the others are replaced by the rest of the queue
+	if !reflect.DeepEqual(check.notReady(), []string{"a", "d", "e"}) {
+		t.Fatalf("unexpected players not ready: %v", check.notReady())
+	}
+	for _, playerID := range check.notReady() {
+		check.drop(playerID)
+	}
+	db.LeaveQueue("channel", "a", "d", "e")
+	queue, _ = db.GetQueue("channel")
+	check.fill(queue)
+	if len(check.PlayerIDs) != 2 || check.done() {
+		t.Fatalf("expected the check to be short of players, got %v", check.PlayerIDs)
+	}
+
+	for _, playerID := range []string{"g", "h"} {
+		db.JoinQueue(testGuildID, "channel", playerID)
+	}
+	queue, _ = db.GetQueue("channel")
+	check.fill(queue)
+	for _, playerID := range check.PlayerIDs {
+		check.Ready[playerID] = true
+	}
+	if !check.done() || !reflect.DeepEqual(check.PlayerIDs, []string{"b", "f", "g", "h"}) {
+		t.Fatalf("expected b, f, g and h to be ready, got %v", check.PlayerIDs)
+	}
+
+	// Queues are kept per channel
+	if other, _ := db.GetQueue("other"); !reflect.DeepEqual(other, []string{"a"}) {
+		t.Fatalf("expected a to still be queued in the other channel, got %v", other)
+	}
+}
+
+func TestQueueSizeConfig(t *testing.T) {
+	for value, want := range map[string]int{"4": 4, "12": 12, "7": 10, "0": 10, "-2": 10} {
+		t.Setenv("QUEUE_SIZE", value)
+		if got := LoadConfig().QueueSize; got != want {
+			t.Errorf("QUEUE_SIZE=%s gave a queue size of %d, expected %d", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// RatingChange is the result of a rated match for a single player.
+// Deviation, Volatility, Mu and Sigma hold the new values for rating
+// systems that track them; zero leaves the stored values untouched.
+type RatingChange struct {
+	PlayerID   string
+	MMRDelta   int
+	Deviation  float64
+	Volatility float64
+	Mu         float64
+	Sigma      float64
+}
+
+// RatingSystem turns a finished match into per-player rating changes.
+// Implementations must not modify the players in the match; the changes
+// are applied by updateMmr so every rating system is stored the same way.
+type RatingSystem interface {
+	Name() string
+	RateMatch(match *Match) []RatingChange
+	// ExpectedScore predicts the chance that team beats opponent
+	ExpectedScore(team, opponent *Team) float64
+}
+
+// RatingOptions tune how every rating system weighs a result
+type RatingOptions struct {
+	// MarginOfVictory scales rating changes by the round difference of
+	// matches with a recorded score, so a close game moves ratings less
+	MarginOfVictory bool
+}
+
+// Round difference that moves ratings by the full amount with MarginOfVictory
+const marginOfVictoryBaseline = 6
+
+// NewRatingSystem returns the rating system registered under name
+func NewRatingSystem(name string, opts ...RatingOptions) (RatingSystem, error) {
+	var o RatingOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "elo":
+		return &EloRatingSystem{RatingOptions: o}, nil
+	case "glicko", "glicko2", "glicko-2":
+		return &GlickoRatingSystem{RatingOptions: o}, nil
+	case "openskill", "trueskill", "weng-lin":
+		return &OpenSkillRatingSystem{RatingOptions: o}, nil
+	default:
+		return nil, fmt.Errorf("unknown rating system %q", name)
+	}
+}
+
+// marginFactor is how much the score of the match scales rating changes: 1
+// at the baseline margin, less for close games and more for blowouts. Matches
+// without a score and draws are rated in full.
+func (o RatingOptions) marginFactor(match *Match) float64 {
+	if !o.MarginOfVictory || !match.HasScore() || match.Draw {
+		return 1
+	}
+	margin := math.Abs(float64(match.WinnerScore - match.LoserScore))
+	return math.Log(margin+1) / math.Log(marginOfVictoryBaseline+1)
+}
+
+// scaleByMargin applies the margin of victory to the changes of a match
+func (o RatingOptions) scaleByMargin(match *Match, changes []RatingChange) []RatingChange {
+	factor := o.marginFactor(match)
+	if factor == 1 {
+		return changes
+	}
+	players := make(map[string]*Player)
+	for _, player := range append(append([]*Player{}, match.Winner.Players...), match.Loser.Players...) {
+		players[player.PlayerID] = player
+	}
+	for i, change := range changes {
+		changes[i] = scaleRatingChange(change, players[change.PlayerID], factor)
+	}
+	return changes
+}
+
+// scaleRatingChange scales how far a change moves the player's rating
+func scaleRatingChange(change RatingChange, player *Player, factor float64) RatingChange {
+	change.MMRDelta = int(math.Round(float64(change.MMRDelta) * factor))
+	if change.Sigma > 0 {
+		mu, _ := openSkillRating(player)
+		change.Mu = mu + (change.Mu-mu)*factor
+	}
+	return change
+}
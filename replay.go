@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReplayEntry compares a player's stored rating with the replayed one
+type ReplayEntry struct {
+	PlayerID   string
+	PlayerName string
+	OldMMR     int
+	NewMMR     int
+}
+
+func (e ReplayEntry) Diff() int {
+	return e.NewMMR - e.OldMMR
+}
+
+// ReplayReport summarises a rating replay
+type ReplayReport struct {
+	RatingSystem string
+	Matches      int
+	Applied      bool
+	Entries      []ReplayEntry
+}
+
+// ReplayRatings resets every player of a guild and replays the guild's matches
+// in MatchID order through rs, so ratings no longer depend on the rating code
+// that was live when each match was reported. Only when apply is set are the
+// players and the MMR history rewritten; otherwise the report is a dry run.
+func ReplayRatings(db *DB, guildID string, rs RatingSystem, apply bool) (*ReplayReport, error) {
+	stored, err := db.GetAllPlayers(guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load players: %v", err)
+	}
+	records, err := db.GetMatchRecords(guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load matches: %v", err)
+	}
+	performances, err := db.GetAllPerformances(guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load player performances: %v", err)
+	}
+	substitutions, err := db.GetAllSubstitutions(guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load substitutions: %v", err)
+	}
+	historyTimestamps, err := db.GetMmrHistoryTimestamps(guildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load MMR history: %v", err)
+	}
+
+	// Start everyone from scratch, keeping only their identity and flags
+	players := make(map[string]*Player, len(stored))
+	for _, old := range stored {
+		player := NewPlayer(guildID, old.PlayerID, old.PlayerName)
+		player.CoreMember = old.CoreMember
+		player.Sniper = old.Sniper
+		players[old.PlayerID] = player
+	}
+	getPlayer := func(playerID string) *Player {
+		if players[playerID] == nil {
+			players[playerID] = NewPlayer(guildID, playerID, playerID)
+		}
+		return players[playerID]
+	}
+
+	var history []MmrHistoryEntry
+	for _, record := range records {
+		match := &Match{
+			MatchID:      record.MatchID,
+			GuildID:      guildID,
+			Winner:       &Team{Name: "Winner"},
+			Loser:        &Team{Name: "Loser"},
+			Timestamp:    replayTimestamp(record, historyTimestamps[record.MatchID]),
+			Performances: performances[record.MatchID],
+			Draw:         record.Draw,
+			WinnerScore:  record.WinnerScore,
+			LoserScore:   record.LoserScore,
+		}
+		for _, playerID := range record.Winner {
+			match.Winner.Players = append(match.Winner.Players, getPlayer(playerID))
+		}
+		for _, playerID := range record.Loser {
+			match.Loser.Players = append(match.Loser.Players, getPlayer(playerID))
+		}
+		match.setSubstitutions(substitutions[record.MatchID], func(playerID string) (*Player, error) {
+			return getPlayer(playerID), nil
+		})
+
+		rateMatch(match, rs)
+
+		for _, player := range match.players() {
+			timestamp, ok := historyTimestamps[record.MatchID][player.PlayerID]
+			if !ok {
+				timestamp = match.Timestamp
+			}
+			history = append(history, MmrHistoryEntry{Player: *player, MatchID: record.MatchID, Timestamp: timestamp})
+		}
+	}
+
+	report := &ReplayReport{RatingSystem: rs.Name(), Matches: len(records), Applied: apply}
+	for _, old := range stored {
+		report.Entries = append(report.Entries, ReplayEntry{
+			PlayerID:   old.PlayerID,
+			PlayerName: old.PlayerName,
+			OldMMR:     old.MMR,
+			NewMMR:     players[old.PlayerID].MMR,
+		})
+	}
+	sort.SliceStable(report.Entries, func(i, j int) bool {
+		return math.Abs(float64(report.Entries[i].Diff())) > math.Abs(float64(report.Entries[j].Diff()))
+	})
+
+	if apply {
+		var replayed []*Player
+		for _, player := range players {
+			replayed = append(replayed, player)
+		}
+		if err := db.ReplaceRatings(guildID, replayed, history); err != nil {
+			return nil, fmt.Errorf("failed to store replayed ratings: %v", err)
+		}
+	}
+
+	return report, nil
+}
+
+// Matches saved before timestamps were recorded use their earliest MMR history entry
+func replayTimestamp(record *MatchRecord, historyTimestamps map[string]time.Time) time.Time {
+	timestamp := record.Timestamp
+	if !timestamp.IsZero() {
+		return timestamp
+	}
+	for _, t := range historyTimestamps {
+		if timestamp.IsZero() || t.Before(timestamp) {
+			timestamp = t
+		}
+	}
+	return timestamp
+}
+
+// Format renders the report as a table of rating differences, limited to maxRows players
+func (r *ReplayReport) Format(maxRows int) string {
+	var b strings.Builder
+	if r.Applied {
+		fmt.Fprintf(&b, "Replayed %d matches with %s. New ratings have been stored.\n", r.Matches, r.RatingSystem)
+	} else {
+		fmt.Fprintf(&b, "Dry run: replayed %d matches with %s. Nothing was changed.\n", r.Matches, r.RatingSystem)
+	}
+
+	b.WriteString("```\n")
+	fmt.Fprintf(&b, "%-20s %6s %6s %6s\n", "Player", "Old", "New", "Diff")
+	for i, entry := range r.Entries {
+		if i == maxRows {
+			fmt.Fprintf(&b, "... and %d more\n", len(r.Entries)-maxRows)
+			break
+		}
+		name := entry.PlayerName
+		if len([]rune(name)) > 20 {
+			name = string([]rune(name)[:20])
+		}
+		fmt.Fprintf(&b, "%-20s %6d %6d %+6d\n", name, entry.OldMMR, entry.NewMMR, entry.Diff())
+	}
+	b.WriteString("```")
+	return b.String()
+}
+
+// runReplayCLI implements the `replay` subcommand of the binary
+func runReplayCLI(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	dbName := fs.String("db", "match_data.db", "path to the match database")
+	guildID := fs.String("guild", config.LegacyGuildID, "guild whose ladder is replayed")
+	ratingName := fs.String("rating", "", "rating system to replay with (default: the guild's setting)")
+	apply := fs.Bool("apply", false, "store the replayed ratings instead of only reporting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *guildID == "" {
+		return fmt.Errorf("no guild given, use -guild or set LEGACY_GUILD_ID")
+	}
+
+	db, err := InitDB(*dbName)
+	if err != nil {
+		return fmt.Errorf("error initializing database: %v", err)
+	}
+	defer db.Close()
+
+	cfg, err := db.GetGuildConfig(*guildID)
+	if err != nil {
+		return err
+	}
+	if *ratingName == "" {
+		*ratingName = cfg.RatingSystem
+	}
+	rs, err := newGuildRatingSystem(*ratingName, cfg)
+	if err != nil {
+		return err
+	}
+
+	report, err := ReplayRatings(db, *guildID, rs, *apply)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report.Format(len(report.Entries)))
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Guild the test matches are played in
+const testGuildID = "guild"
+
+func newTestDB(t *testing.T) *DB {
+	db, err := InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Error initializing database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Save a match between the given players, creating them on first use
+func saveTestMatch(t *testing.T, db *DB, winnerIDs, loserIDs []string) *Match {
+	getTeam := func(playerIDs []string) *Team {
+		team := &Team{}
+		for _, playerID := range playerIDs {
+			player, err := db.GetPlayer(testGuildID, playerID)
+			if err != nil {
+				player = NewPlayer(testGuildID, playerID, playerID)
+				if err := db.SavePlayer(player); err != nil {
+					t.Fatalf("Error saving player: %v", err)
+				}
+			}
+			team.Players = append(team.Players, player)
+		}
+		return team
+	}
+
+	match := &Match{GuildID: testGuildID, Winner: getTeam(winnerIDs), Loser: getTeam(loserIDs), db: db}
+	match.Performances = map[string]PlayerStats{winnerIDs[0]: {Kills: 20, Assists: 3, Deaths: 10}}
+	if _, err := match.SaveMatch(db); err != nil {
+		t.Fatalf("Error saving match: %v", err)
+	}
+	return match
+}
+
+func TestReplayRatings(t *testing.T) {
+	db := newTestDB(t)
+	saveTestMatch(t, db, []string{"a", "b"}, []string{"c", "d"})
+	saveTestMatch(t, db, []string{"a", "c"}, []string{"b", "d"})
+	saveTestMatch(t, db, []string{"b", "d"}, []string{"a", "c"})
+
+	// Replaying with the same rating code reproduces the stored ratings
+	report, err := ReplayRatings(db, testGuildID, &EloRatingSystem{}, false)
+	if err != nil {
+		t.Fatalf("Error replaying: %v", err)
+	}
+	if report.Matches != 3 {
+		t.Fatalf("expected 3 replayed matches, got %d", report.Matches)
+	}
+	for _, entry := range report.Entries {
+		if entry.Diff() != 0 {
+			t.Errorf("player %s: stored %d, replayed %d", entry.PlayerID, entry.OldMMR, entry.NewMMR)
+		}
+	}
+
+	// A corrupted rating is reported by a dry run and fixed by applying
+	corrupted, _ := db.GetPlayer(testGuildID, "a")
+	corrupted.MMR = 5000
+	corrupted.Kills = 999
+	db.SavePlayer(corrupted)
+
+	report, err = ReplayRatings(db, testGuildID, &EloRatingSystem{}, false)
+	if err != nil {
+		t.Fatalf("Error replaying: %v", err)
+	}
+	if report.Entries[0].PlayerID != "a" || report.Entries[0].OldMMR != 5000 {
+		t.Fatalf("expected the corrupted player first in the report, got %+v", report.Entries[0])
+	}
+	if player, _ := db.GetPlayer(testGuildID, "a"); player.MMR != 5000 {
+		t.Fatalf("dry run must not change ratings")
+	}
+
+	if _, err := ReplayRatings(db, testGuildID, &EloRatingSystem{}, true); err != nil {
+		t.Fatalf("Error applying replay: %v", err)
+	}
+	player, _ := db.GetPlayer(testGuildID, "a")
+	if player.MMR != report.Entries[0].NewMMR || player.Kills != 40 || player.GamesPlayed != 3 {
+		t.Fatalf("unexpected replayed player: %+v", player)
+	}
+	mmrs, _, err := db.GetMmrHistory(testGuildID, "a")
+	if err != nil || len(mmrs) != 3 {
+		t.Fatalf("expected 3 history rows for player a, got %d (%v)", len(mmrs), err)
+	}
+}
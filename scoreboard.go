@@ -0,0 +1,513 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a scoreboard preview waits to be confirmed
+const scoreboardTimeout = 10 * time.Minute
+
+// ScoreboardLine is a player's line of a pasted scoreboard: `name K A D [ADR]`
+type ScoreboardLine struct {
+	Name  string
+	Stats PlayerStats
+}
+
+// Scoreboard is a parsed scoreboard waiting for its reporter to confirm it
+type Scoreboard struct {
+	ID         int
+	MatchID    int
+	ReporterID string
+	// Lines are the stats read from the scoreboard, by player ID. They are
+	// merged with the stats stored when the scoreboard is confirmed.
+	Lines map[string]PlayerStats
+}
+
+// scoreboards holds the previews that are still open, by ID
+var scoreboards = struct {
+	sync.Mutex
+	nextID int
+	boards map[int]*Scoreboard
+}{boards: make(map[int]*Scoreboard)}
+
+// parseScoreboard reads one player per line. The name may contain spaces;
+// the numbers at the end of the line are the kills, assists, deaths and
+// optionally the ADR. Lines that don't fit, such as headers, are returned
+// as ignored.
+func parseScoreboard(text string) ([]ScoreboardLine, []string) {
+	var lines []ScoreboardLine
+	var ignored []string
+	replacer := strings.NewReplacer("|", " ", ",", " ", "\t", " ")
+	for _, raw := range strings.Split(text, "\n") {
+		fields := strings.Fields(replacer.Replace(raw))
+		if len(fields) == 0 {
+			continue
+		}
+
+		numbers := 0
+		for numbers < len(fields) && numbers < 4 {
+			if _, err := strconv.ParseFloat(fields[len(fields)-1-numbers], 64); err != nil {
+				break
+			}
+			numbers++
+		}
+		if numbers == len(fields) {
+			numbers--
+		}
+		if numbers < 3 {
+			ignored = append(ignored, strings.TrimSpace(raw))
+			continue
+		}
+
+		name, values := strings.Join(fields[:len(fields)-numbers], " "), fields[len(fields)-numbers:]
+		var counts [3]int
+		valid := true
+		for i := range counts {
+			n, err := strconv.Atoi(values[i])
+			if err != nil {
+				valid = false
+			}
+			counts[i] = n
+		}
+		if !valid {
+			ignored = append(ignored, strings.TrimSpace(raw))
+			continue
+		}
+		line := ScoreboardLine{Name: name, Stats: PlayerStats{Kills: counts[0], Assists: counts[1], Deaths: counts[2]}}
+		if numbers == 4 {
+			adr, _ := strconv.ParseFloat(values[3], 64)
+			line.Stats.Extra = map[string]float64{"adr": adr}
+		}
+		lines = append(lines, line)
+	}
+	return lines, ignored
+}
+
+// normalizeName keeps only the lowercase letters and digits of a name
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r > 127 {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// levenshtein is the number of single character edits between two strings
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// nameDistance rates how well a scoreboard name fits a player, lower is
+// better: 0 for the same name or a mention of the player, 1 when one name
+// contains the other, otherwise the edit distance when it is small enough
+// to be a typo
+func nameDistance(name string, player *Player) (int, bool) {
+	if id, ok := parseUserMention(name); ok {
+		return 0, id == player.PlayerID
+	}
+	a, b := normalizeName(name), normalizeName(player.PlayerName)
+	switch {
+	case a == "" || b == "":
+		return 0, false
+	case a == b:
+		return 0, true
+	case strings.Contains(a, b) || strings.Contains(b, a):
+		return 1, true
+	}
+	d := levenshtein(a, b)
+	return d + 1, d <= min(len([]rune(a)), len([]rune(b)))/3
+}
+
+// matchScoreboard assigns the lines to the players by name, closest first,
+// so each player gets at most one line. It returns the lines by player ID
+// and the lines that fit nobody.
+func matchScoreboard(lines []ScoreboardLine, players []*Player) (map[string]ScoreboardLine, []ScoreboardLine) {
+	type candidate struct {
+		line, player, distance int
+	}
+	var candidates []candidate
+	for l, line := range lines {
+		for p, player := range players {
+			if d, ok := nameDistance(line.Name, player); ok {
+				candidates = append(candidates, candidate{l, p, d})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+
+	matched := make(map[string]ScoreboardLine)
+	used := make(map[int]bool)
+	for _, c := range candidates {
+		playerID := players[c.player].PlayerID
+		if used[c.line] {
+			continue
+		}
+		if _, ok := matched[playerID]; ok {
+			continue
+		}
+		matched[playerID] = lines[c.line]
+		used[c.line] = true
+	}
+
+	var unmatched []ScoreboardLine
+	for l, line := range lines {
+		if !used[l] {
+			unmatched = append(unmatched, line)
+		}
+	}
+	return matched, unmatched
+}
+
+// buildScoreboard parses a pasted scoreboard for a match into a preview.
+// Extended stats reported before are kept, with the ADR of the scoreboard
+// replacing the reported one; the preview shows them as they are now.
+func buildScoreboard(db *DB, match *Match, reporterID, text string) (*Scoreboard, *discordgo.MessageEmbed, error) {
+	lines, ignored := parseScoreboard(text)
+	if len(lines) == 0 {
+		return nil, nil, fmt.Errorf("no player lines found, expected one `name K A D [ADR]` line per player")
+	}
+	players := match.players()
+	matched, unmatched := matchScoreboard(lines, players)
+	if len(matched) == 0 {
+		return nil, nil, fmt.Errorf("none of the names fit a player of match %d", match.MatchID)
+	}
+
+	existing, err := db.GetRecordedPerformances(match.MatchID)
+	if err != nil {
+		return nil, nil, err
+	}
+	board := &Scoreboard{MatchID: match.MatchID, ReporterID: reporterID, Lines: make(map[string]PlayerStats)}
+	combined := make(map[string]PlayerStats)
+	for playerID, stats := range existing {
+		combined[playerID] = stats
+	}
+	for playerID, line := range matched {
+		stats := line.Stats
+		stats.Extra = mergeStatValues(existing[playerID].Extra, line.Stats.Extra)
+		if err := match.checkStats(playerID, stats); err != nil {
+			return nil, nil, fmt.Errorf("line %q: %v", line.Name, err)
+		}
+		board.Lines[playerID] = line.Stats
+		combined[playerID] = stats
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Scoreboard of match %d", match.MatchID),
+		Description: "Check every line went to the right player, then confirm to record the stats.",
+		Color:       0x00ff00,
+	}
+	var missing []*Player
+	for _, player := range players {
+		line, ok := matched[player.PlayerID]
+		if !ok {
+			missing = append(missing, player)
+			continue
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   player.PlayerName,
+			Value:  fmt.Sprintf("%s\nfrom `%s`", describeStats(combined[player.PlayerID]), line.Name),
+			Inline: true,
+		})
+	}
+	if len(unmatched) > 0 {
+		var names []string
+		for _, line := range unmatched {
+			names = append(names, fmt.Sprintf("`%s`", line.Name))
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Lines without a player", Value: strings.Join(names, ", ")})
+	}
+	if len(missing) > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Players without a line", Value: mentionPlayers(missing)})
+	}
+	if len(ignored) > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Ignored lines", Value: fmt.Sprintf("%d", len(ignored))})
+	}
+	if warnings := match.statsWarnings(combined); len(warnings) > 0 {
+		embed.Color = 0xffa500
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Warnings", Value: strings.Join(warnings, "\n")})
+	}
+	return board, embed, nil
+}
+
+// Keep a scoreboard until it is confirmed or the preview times out
+func storeScoreboard(board *Scoreboard) {
+	scoreboards.Lock()
+	scoreboards.nextID++
+	board.ID = scoreboards.nextID
+	scoreboards.boards[board.ID] = board
+	scoreboards.Unlock()
+
+	time.AfterFunc(scoreboardTimeout, func() {
+		scoreboards.Lock()
+		delete(scoreboards.boards, board.ID)
+		scoreboards.Unlock()
+	})
+}
+
+// The buttons of a scoreboard preview
+func scoreboardComponents(board *Scoreboard) []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Confirm",
+					CustomID: fmt.Sprintf("scoreboard_confirm_%d", board.ID),
+					Style:    discordgo.SuccessButton,
+				},
+				discordgo.Button{
+					Label:    "Cancel",
+					CustomID: fmt.Sprintf("scoreboard_cancel_%d", board.ID),
+					Style:    discordgo.DangerButton,
+				},
+			},
+		},
+	}
+}
+
+// canSubmitScoreboard reports whether the user may submit the stats of
+// everyone in the match: players of the match and admins can
+func canSubmitScoreboard(s *discordgo.Session, channelID string, match *Match, userID string) bool {
+	return match.hasPlayer(userID) || isAdmin(s, channelID, userID)
+}
+
+// Command to record the stats of a whole match from its scoreboard:
+// `!scoreboard <matchID>` followed by one `name K A D [ADR]` line per player.
+// Without lines it offers a form to paste the scoreboard into.
+func scoreboardCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	if len(args) < 2 {
+		s.ChannelMessageSend(m.ChannelID, "Usage: `!scoreboard <matchID>`, followed by one line per player: `name K A D [ADR]`.")
+		return
+	}
+	matchID, err := strconv.Atoi(args[1])
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Invalid match ID.")
+		return
+	}
+	match, err := db.GetMatch(matchID)
+	if err != nil || match.GuildID != m.GuildID {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d not found.", matchID))
+		return
+	}
+	if !match.statsOpen() {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d is %s, stats can no longer be reported.", matchID, match.Status))
+		return
+	}
+	if !canSubmitScoreboard(s, m.ChannelID, match, m.Author.ID) {
+		s.ChannelMessageSend(m.ChannelID, "Only players of the match and admins can submit its scoreboard.")
+		return
+	}
+
+	parts := strings.SplitN(m.Content, "\n", 2)
+	if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+		s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+			Content: fmt.Sprintf("Paste the scoreboard of match %d with one `name K A D [ADR]` line per player.", matchID),
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.Button{
+							Label:    "Paste Scoreboard",
+							CustomID: fmt.Sprintf("scoreboard_paste_%d", matchID),
+							Style:    discordgo.PrimaryButton,
+						},
+					},
+				},
+			},
+		})
+		return
+	}
+
+	board, embed, err := buildScoreboard(db, match, m.Author.ID, parts[1])
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error reading the scoreboard: %v", err))
+		return
+	}
+	storeScoreboard(board)
+	s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Embeds:     []*discordgo.MessageEmbed{embed},
+		Components: scoreboardComponents(board),
+	})
+}
+
+// Handle the "Paste Scoreboard" button by asking for the scoreboard
+func showScoreboardModal(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	matchID, err := strconv.Atoi(strings.TrimPrefix(i.MessageComponentData().CustomID, "scoreboard_paste_"))
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Invalid match ID.")
+		return
+	}
+	match, err := db.GetMatch(matchID)
+	if err != nil || match.GuildID != i.GuildID {
+		respondEphemeral(s, i.Interaction, "Match not found.")
+		return
+	}
+	if !match.statsOpen() {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Match %d is %s, stats can no longer be reported.", matchID, match.Status))
+		return
+	}
+	if !canSubmitScoreboard(s, i.ChannelID, match, i.Member.User.ID) {
+		respondEphemeral(s, i.Interaction, "Only players of the match and admins can submit its scoreboard.")
+		return
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: fmt.Sprintf("scoreboard_modal_%d", matchID),
+			Title:    fmt.Sprintf("Scoreboard of match %d", matchID),
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							CustomID:    "scoreboard",
+							Label:       "One line per player: name K A D [ADR]",
+							Style:       discordgo.TextInputParagraph,
+							Placeholder: "s1mple 24 5 12 98.4\nzywoo 19 7 14",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+// Preview the scoreboard pasted into the form
+func handleScoreboardSubmission(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	data := i.ModalSubmitData()
+	matchID, err := strconv.Atoi(strings.TrimPrefix(data.CustomID, "scoreboard_modal_"))
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Invalid match ID.")
+		return
+	}
+	match, err := db.GetMatch(matchID)
+	if err != nil || match.GuildID != i.GuildID {
+		respondEphemeral(s, i.Interaction, "Match not found.")
+		return
+	}
+	if !match.statsOpen() {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Match %d is %s, stats can no longer be reported.", matchID, match.Status))
+		return
+	}
+	if !canSubmitScoreboard(s, i.ChannelID, match, i.Member.User.ID) {
+		respondEphemeral(s, i.Interaction, "Only players of the match and admins can submit its scoreboard.")
+		return
+	}
+
+	var text string
+	for _, c := range data.Components {
+		for _, innerC := range c.(*discordgo.ActionsRow).Components {
+			if input := innerC.(*discordgo.TextInput); input.CustomID == "scoreboard" {
+				text = input.Value
+			}
+		}
+	}
+	board, embed, err := buildScoreboard(db, match, i.Member.User.ID, text)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Error reading the scoreboard: %v", err))
+		return
+	}
+	storeScoreboard(board)
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds:     []*discordgo.MessageEmbed{embed},
+			Components: scoreboardComponents(board),
+		},
+	})
+}
+
+// Handle the buttons of a scoreboard preview: the reporter confirms to record
+// every performance at once, or cancels
+func handleScoreboardButton(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	customID := i.MessageComponentData().CustomID
+	confirm := strings.HasPrefix(customID, "scoreboard_confirm_")
+	boardID, err := strconv.Atoi(customID[strings.LastIndex(customID, "_")+1:])
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Invalid scoreboard.")
+		return
+	}
+
+	scoreboards.Lock()
+	board := scoreboards.boards[boardID]
+	if board == nil {
+		scoreboards.Unlock()
+		respondEphemeral(s, i.Interaction, "This scoreboard expired, please submit it again.")
+		return
+	}
+	if board.ReporterID != i.Member.User.ID {
+		scoreboards.Unlock()
+		respondEphemeral(s, i.Interaction, "Only the player who submitted the scoreboard can confirm it.")
+		return
+	}
+	delete(scoreboards.boards, boardID)
+	scoreboards.Unlock()
+
+	update := func(content string) {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: &discordgo.InteractionResponseData{
+				Content:    content,
+				Components: []discordgo.MessageComponent{},
+			},
+		})
+	}
+	if !confirm {
+		update("Scoreboard discarded.")
+		return
+	}
+
+	match, err := db.GetMatch(board.MatchID)
+	if err != nil {
+		respondEphemeral(s, i.Interaction, "Match not found.")
+		return
+	}
+	before, _ := db.GetRecordedPerformances(board.MatchID)
+	if err := db.MergePerformances(board.MatchID, board.ReporterID, board.Lines); err != nil {
+		respondEphemeral(s, i.Interaction, fmt.Sprintf("Could not record the scoreboard: %v", err))
+		return
+	}
+
+	if after, err := db.GetRecordedPerformances(board.MatchID); err == nil {
+		if warnings := newWarnings(match.statsWarnings(before), match.statsWarnings(after)); len(warnings) > 0 {
+			flagStats(s, db, match, fmt.Sprintf("<@%s> submitted the scoreboard", board.ReporterID), warnings)
+		}
+	}
+
+	content := fmt.Sprintf("Scoreboard of match %d recorded by %s.", board.MatchID, i.Member.User.Username)
+	if match.Status == MatchStatusConfirmed {
+		finalized, err := settleMatch(db, board.MatchID)
+		if err != nil {
+			log.Printf("Error rating match %d: %v", board.MatchID, err)
+		}
+		if finalized != nil {
+			content += " All stats are in. Ratings updated."
+		}
+	}
+	update(content)
+}
@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestParseScoreboard(t *testing.T) {
+	lines, ignored := parseScoreboard("Player K A D ADR\nThe Dude 24 5 12 98.4\n\nzywoo | 19 | 7 | 14\nbroken 1 two 3")
+	if len(lines) != 2 || len(ignored) != 2 {
+		t.Fatalf("expected two lines and two ignored, got %v and %v", lines, ignored)
+	}
+	if lines[0].Name != "The Dude" || lines[0].Stats.Kills != 24 || lines[0].Stats.Deaths != 12 || lines[0].Stats.Extra["adr"] != 98.4 {
+		t.Errorf("unexpected first line: %+v", lines[0])
+	}
+	if lines[1].Name != "zywoo" || lines[1].Stats.Assists != 7 || lines[1].Stats.Extra != nil {
+		t.Errorf("unexpected second line: %+v", lines[1])
+	}
+}
+
+func TestMatchScoreboard(t *testing.T) {
+	players := []*Player{
+		{PlayerID: "1", PlayerName: "s1mple"},
+		{PlayerID: "2", PlayerName: "ZywOo"},
+		{PlayerID: "3", PlayerName: "NiKo"},
+		{PlayerID: "4", PlayerName: "device"},
+	}
+	lines := []ScoreboardLine{
+		{Name: "simple"},
+		{Name: "[VIT] ZywOo"},
+		{Name: "<@3>"},
+		{Name: "dev1ce"},
+		{Name: "somebody"},
+	}
+
+	matched, unmatched := matchScoreboard(lines, players)
+	expected := map[string]string{"1": "simple", "2": "[VIT] ZywOo", "3": "<@3>", "4": "dev1ce"}
+	for playerID, name := range expected {
+		if matched[playerID].Name != name {
+			t.Errorf("expected %s to get line %q, got %q", playerID, name, matched[playerID].Name)
+		}
+	}
+	if len(unmatched) != 1 || unmatched[0].Name != "somebody" {
+		t.Fatalf("expected only somebody unmatched, got %v", unmatched)
+	}
+
+	// A player gets only the closest of two fitting lines
+	matched, unmatched = matchScoreboard([]ScoreboardLine{{Name: "niko2"}, {Name: "niko"}}, players)
+	if matched["3"].Name != "niko" || len(unmatched) != 1 {
+		t.Fatalf("expected the exact name to win, got %v and %v", matched, unmatched)
+	}
+}
+
+func TestScoreboard(t *testing.T) {
+	db := newTestDB(t)
+	matchID := createTestMatch(t, db, []string{"alpha", "bravo"}, []string{"charlie", "delta"})
+	db.ReportMatchResult(matchID, 1)
+	db.SetMatchScore(matchID, 13, 9)
+	db.ReportPerformance(matchID, "alpha", "alpha", PlayerStats{Kills: 1, Extra: map[string]float64{"mvps": 3}})
+	match, _ := db.GetMatch(matchID)
+
+	for _, text := range []string{"alpha 99 0 0", "alpha 20 4 12 NaN"} {
+		if _, _, err := buildScoreboard(db, match, "alpha", text); err == nil {
+			t.Fatalf("expected %q to be rejected", text)
+		}
+	}
+	board, embed, err := buildScoreboard(db, match, "alpha", "alpha 20 4 12 95\nbravo 14 6 13\ncharly 13 2 17\ndelt 12 5 15 70.5")
+	if err != nil {
+		t.Fatalf("Error reading scoreboard: %v", err)
+	}
+	if len(board.Lines) != 4 || len(embed.Fields) != 4 {
+		t.Fatalf("expected every player matched, got %v", board.Lines)
+	}
+
+	// Stats corrected while the preview is open are kept when it is confirmed
+	db.ReportPerformance(matchID, "alpha", "alpha", PlayerStats{Kills: 1, Extra: map[string]float64{"mvps": 5}})
+	if err := db.MergePerformances(matchID, board.ReporterID, board.Lines); err != nil {
+		t.Fatalf("Error recording scoreboard: %v", err)
+	}
+	performances, _ := db.GetRecordedPerformances(matchID)
+	alpha := performances["alpha"]
+	if alpha.Kills != 20 || alpha.Extra["adr"] != 95 || alpha.Extra["mvps"] != 5 {
+		t.Fatalf("expected the scoreboard stats with the reported extras kept, got %+v", alpha)
+	}
+	if performances["delta"].Extra["adr"] != 70.5 || performances["charlie"].Deaths != 17 {
+		t.Fatalf("unexpected performances: %v", performances)
+	}
+	if edits, _ := db.GetPerformanceEdits(matchID); len(edits) != 6 || edits[2].EditorID != "alpha" {
+		t.Fatalf("expected the scoreboard in the audit trail, got %v", edits)
+	}
+}
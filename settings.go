@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// guildSetting is a config value a guild can override with !settings
+type guildSetting struct {
+	Key         string
+	Description string
+	get         func(cfg *Config) string
+	set         func(cfg *Config, value string) error
+}
+
+// guildSettings lists every per-guild setting in the order !settings shows them
+var guildSettings = []guildSetting{
+	{
+		Key:         "rating_system",
+		Description: "rating engine: elo, glicko2 or openskill",
+		get:         func(cfg *Config) string { return cfg.RatingSystem },
+		set: func(cfg *Config, value string) error {
+			if _, err := NewRatingSystem(value); err != nil {
+				return err
+			}
+			cfg.RatingSystem = value
+			return nil
+		},
+	},
+	{
+		Key:         "margin_of_victory",
+		Description: "scale rating changes by the round difference of scored matches: on or off",
+		get: func(cfg *Config) string {
+			if cfg.MarginOfVictory {
+				return "on"
+			}
+			return "off"
+		},
+		set: func(cfg *Config, value string) error {
+			switch strings.ToLower(value) {
+			case "on", "true", "yes":
+				cfg.MarginOfVictory = true
+			case "off", "false", "no":
+				cfg.MarginOfVictory = false
+			default:
+				return fmt.Errorf("expected on or off, got %q", value)
+			}
+			return nil
+		},
+	},
+	{
+		Key:         "result_confirmations",
+		Description: "losing players, or players of each team for a draw, that must confirm a result",
+		get:         func(cfg *Config) string { return strconv.Itoa(cfg.ResultConfirmations) },
+		set: func(cfg *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("expected a non-negative number, got %q", value)
+			}
+			cfg.ResultConfirmations = n
+			return nil
+		},
+	},
+	{
+		Key:         "result_confirm_timeout",
+		Description: "time before a result is confirmed automatically, e.g. 30m",
+		get:         func(cfg *Config) string { return cfg.ResultConfirmTimeout.String() },
+		set: func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("expected a duration such as 30m or 1h, got %q", value)
+			}
+			cfg.ResultConfirmTimeout = d
+			return nil
+		},
+	},
+	{
+		Key:         "stats_deadline",
+		Description: "time players have to report stats after a result is confirmed, e.g. 15m; 0 rates right away",
+		get:         func(cfg *Config) string { return cfg.StatsDeadline.String() },
+		set: func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("expected a duration such as 15m, got %q", value)
+			}
+			cfg.StatsDeadline = d
+			return nil
+		},
+	},
+	{
+		Key:         "review_channel",
+		Description: "channel where suspicious stats are flagged for admins, the match's channel when unset",
+		get: func(cfg *Config) string {
+			if cfg.ReviewChannelID == "" {
+				return "unset"
+			}
+			return fmt.Sprintf("<#%s>", cfg.ReviewChannelID)
+		},
+		set: func(cfg *Config, value string) error {
+			channelID, ok := parseChannelMention(value)
+			if !ok {
+				return fmt.Errorf("expected a channel such as #review, got %q", value)
+			}
+			cfg.ReviewChannelID = channelID
+			return nil
+		},
+	},
+	{
+		Key:         "team_vote_timeout",
+		Description: "time players have to vote on proposed teams, e.g. 2m",
+		get:         func(cfg *Config) string { return cfg.TeamVoteTimeout.String() },
+		set: func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("expected a duration such as 2m, got %q", value)
+			}
+			cfg.TeamVoteTimeout = d
+			return nil
+		},
+	},
+	{
+		Key:         "draft_pick_timeout",
+		Description: "time a captain has for each pick in !draft, e.g. 30s",
+		get:         func(cfg *Config) string { return cfg.DraftPickTimeout.String() },
+		set: func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("expected a duration such as 30s, got %q", value)
+			}
+			cfg.DraftPickTimeout = d
+			return nil
+		},
+	},
+	{
+		Key:         "variety_weight",
+		Description: "win chance gap (0-1) accepted to avoid repeating recent teammates, 0 to ignore them",
+		get:         func(cfg *Config) string { return strconv.FormatFloat(cfg.VarietyWeight, 'g', -1, 64) },
+		set: func(cfg *Config, value string) error {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f < 0 || f > 1 {
+				return fmt.Errorf("expected a number between 0 and 1, got %q", value)
+			}
+			cfg.VarietyWeight = f
+			return nil
+		},
+	},
+	{
+		Key:         "variety_matches",
+		Description: "recent matches whose teammates the balancer avoids repeating",
+		get:         func(cfg *Config) string { return strconv.Itoa(cfg.VarietyMatches) },
+		set: func(cfg *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("expected a non-negative number, got %q", value)
+			}
+			cfg.VarietyMatches = n
+			return nil
+		},
+	},
+	{
+		Key:         "synergy_weight",
+		Description: "win chance gap (0-1) accepted to split up all duos that win a lot together, stronger duos weighing more, 0 to ignore synergy",
+		get:         func(cfg *Config) string { return strconv.FormatFloat(cfg.SynergyWeight, 'g', -1, 64) },
+		set: func(cfg *Config, value string) error {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f < 0 || f > 1 {
+				return fmt.Errorf("expected a number between 0 and 1, got %q", value)
+			}
+			cfg.SynergyWeight = f
+			return nil
+		},
+	},
+	{
+		Key:         "queue_size",
+		Description: "players per match, for ready checks and full voice channels, an even number",
+		get:         func(cfg *Config) string { return strconv.Itoa(cfg.QueueSize) },
+		set: func(cfg *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 2 || n%2 != 0 {
+				return fmt.Errorf("expected an even number of at least 2, got %q", value)
+			}
+			cfg.QueueSize = n
+			return nil
+		},
+	},
+	{
+		Key:         "ready_check_timeout",
+		Description: "time queued players have to accept a ready check, e.g. 1m",
+		get:         func(cfg *Config) string { return cfg.ReadyCheckTimeout.String() },
+		set: func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("expected a duration such as 1m, got %q", value)
+			}
+			cfg.ReadyCheckTimeout = d
+			return nil
+		},
+	},
+	{
+		Key:         "session_timeout",
+		Description: "time without a game after which a voice channel's sit-out counts start over, e.g. 6h",
+		get:         func(cfg *Config) string { return cfg.SessionTimeout.String() },
+		set: func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("expected a duration such as 6h, got %q", value)
+			}
+			cfg.SessionTimeout = d
+			return nil
+		},
+	},
+	{
+		Key:         "max_snipers",
+		Description: "snipers allowed per team when balancing, 0 for no limit",
+		get:         func(cfg *Config) string { return strconv.Itoa(cfg.MaxSnipers) },
+		set: func(cfg *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("expected a non-negative number, got %q", value)
+			}
+			cfg.MaxSnipers = n
+			return nil
+		},
+	},
+}
+
+func findGuildSetting(key string) (*guildSetting, error) {
+	for i := range guildSettings {
+		if guildSettings[i].Key == strings.ToLower(key) {
+			return &guildSettings[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown setting %q", key)
+}
+
+// Retrieve the configuration of a guild: the bot-wide config with the
+// guild's own settings applied on top
+func (db *DB) GetGuildConfig(guildID string) (*Config, error) {
+	cfg := *config
+
+	rows, err := db.db.Query("SELECT Key, Value FROM guild_settings WHERE GuildID = ?", guildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		setting, err := findGuildSetting(key)
+		if err == nil {
+			err = setting.set(&cfg, value)
+		}
+		if err != nil {
+			log.Printf("Ignoring setting %s of guild %s: %v", key, guildID, err)
+		}
+	}
+	return &cfg, rows.Err()
+}
+
+// Store a guild's setting after checking the value is valid
+func (db *DB) SetGuildSetting(guildID, key, value string) error {
+	setting, err := findGuildSetting(key)
+	if err != nil {
+		return err
+	}
+	if err := setting.set(DefaultConfig(), value); err != nil {
+		return err
+	}
+
+	_, err = db.db.Exec(`
+		INSERT INTO guild_settings (GuildID, Key, Value) VALUES (?, ?, ?)
+		ON CONFLICT(GuildID, Key) DO UPDATE SET Value = excluded.Value
+	`, guildID, setting.Key, value)
+	return err
+}
+
+// Remove a guild's setting so the bot-wide value applies again
+func (db *DB) ResetGuildSetting(guildID, key string) error {
+	setting, err := findGuildSetting(key)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("DELETE FROM guild_settings WHERE GuildID = ? AND Key = ?", guildID, setting.Key)
+	return err
+}
+
+// Retrieve the rating system a guild's ladder is rated with
+func (db *DB) GetRatingSystem(guildID string) (RatingSystem, error) {
+	cfg, err := db.GetGuildConfig(guildID)
+	if err != nil {
+		return nil, err
+	}
+	return newGuildRatingSystem(cfg.RatingSystem, cfg)
+}
+
+// Create a rating system with the rating options of a guild's configuration
+func newGuildRatingSystem(name string, cfg *Config) (RatingSystem, error) {
+	return NewRatingSystem(name, RatingOptions{MarginOfVictory: cfg.MarginOfVictory})
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Substitution is a player replaced by another while a match was being played
+type Substitution struct {
+	OutPlayerID string
+	InPlayerID  string
+	// Round is the round the new player came in, 0 when unknown
+	Round     int
+	Timestamp time.Time
+}
+
+// Store a lobby's changed lineup on the lobby and on the match it is playing
+func (db *DB) UpdateLineup(lobby *Lobby) error {
+	return updateLineup(db.db, lobby)
+}
+
+func updateLineup(exec execer, lobby *Lobby) error {
+	team1IDs, team2IDs := lobby.Team1.GetPlayerIDs(), lobby.Team2.GetPlayerIDs()
+	if _, err := exec.Exec("UPDATE matches SET Team1 = ?, Team2 = ? WHERE MatchID = ?", team1IDs, team2IDs, lobby.MatchID); err != nil {
+		return err
+	}
+	_, err := exec.Exec("UPDATE lobbies SET Team1 = ?, Team2 = ? WHERE LobbyID = ?", team1IDs, team2IDs, lobby.LobbyID)
+	return err
+}
+
+// Swap a player of a live match for another, storing the new lineup along
+// with when the swap happened
+func (db *DB) RecordSubstitution(lobby *Lobby, sub Substitution) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO substitutions (MatchID, OutPlayerID, InPlayerID, Round, Timestamp)
+		VALUES (?, ?, ?, ?, ?)
+	`, lobby.MatchID, sub.OutPlayerID, sub.InPlayerID, sub.Round, sub.Timestamp.UTC())
+	if err != nil {
+		return err
+	}
+	if err := updateLineup(tx, lobby); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Retrieve the substitutions of a match in the order they happened
+func (db *DB) GetSubstitutions(matchID int) ([]Substitution, error) {
+	subs, err := db.querySubstitutions("WHERE MatchID = ?", matchID)
+	return subs[matchID], err
+}
+
+// Retrieve the substitutions of every match of a guild, keyed by match
+func (db *DB) GetAllSubstitutions(guildID string) (map[int][]Substitution, error) {
+	return db.querySubstitutions("WHERE MatchID IN (SELECT MatchID FROM matches WHERE GuildID = ?)", guildID)
+}
+
+func (db *DB) querySubstitutions(where string, args ...interface{}) (map[int][]Substitution, error) {
+	rows, err := db.db.Query("SELECT MatchID, OutPlayerID, InPlayerID, Round, Timestamp FROM substitutions "+where+" ORDER BY SubstitutionID", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := make(map[int][]Substitution)
+	for rows.Next() {
+		var matchID int
+		var sub Substitution
+		var timestamp sql.NullTime
+		if err := rows.Scan(&matchID, &sub.OutPlayerID, &sub.InPlayerID, &sub.Round, &timestamp); err != nil {
+			return nil, err
+		}
+		sub.Timestamp = timestamp.Time
+		subs[matchID] = append(subs[matchID], sub)
+	}
+	return subs, rows.Err()
+}
+
+// setSubstitutions attaches the substitutions of the match along with the
+// players who were subbed out
+func (m *Match) setSubstitutions(subs []Substitution, getPlayer func(playerID string) (*Player, error)) error {
+	m.Substitutions = subs
+	m.Substituted = make(map[string]*Player)
+	for _, sub := range subs {
+		player, err := getPlayer(sub.OutPlayerID)
+		if err != nil {
+			return fmt.Errorf("failed to get substituted player %s: %v", sub.OutPlayerID, err)
+		}
+		m.Substituted[sub.OutPlayerID] = player
+	}
+	return nil
+}
+
+// substitutionChains groups the substitutions by the lineup slot they
+// happened in, so a player who came in and was subbed out again is followed
+func (m *Match) substitutionChains() [][]Substitution {
+	var chains [][]Substitution
+	for _, sub := range m.Substitutions {
+		placed := false
+		for i, chain := range chains {
+			if chain[len(chain)-1].InPlayerID == sub.OutPlayerID {
+				chains[i] = append(chain, sub)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			chains = append(chains, []Substitution{sub})
+		}
+	}
+	return chains
+}
+
+// subbedOut returns the players who started for team but were substituted
+func (m *Match) subbedOut(team *Team) []*Player {
+	var players []*Player
+	for _, chain := range m.substitutionChains() {
+		if !isPlayerInTeam(team, chain[len(chain)-1].InPlayerID) {
+			continue
+		}
+		for _, sub := range chain {
+			players = append(players, m.Substituted[sub.OutPlayerID])
+		}
+	}
+	return players
+}
+
+// lineup returns everyone who played for team, including players subbed out
+func (m *Match) lineup(team *Team) []*Player {
+	return append(append([]*Player{}, team.Players...), m.subbedOut(team)...)
+}
+
+// players returns everyone who played in the match
+func (m *Match) players() []*Player {
+	return append(m.lineup(m.Winner), m.lineup(m.Loser)...)
+}
+
+// hasPlayer reports whether the player played in the match
+func (m *Match) hasPlayer(playerID string) bool {
+	for _, player := range m.players() {
+		if player.PlayerID == playerID {
+			return true
+		}
+	}
+	return false
+}
+
+// playShares returns the share of the match each substituted player played.
+// With the match length and every swap round known they are credited by the
+// rounds they played; otherwise everyone who filled a slot gets an equal share.
+func (m *Match) playShares(totalRounds int) map[string]float64 {
+	shares := make(map[string]float64)
+	for _, chain := range m.substitutionChains() {
+		// The rounds each player of the slot started, ending with the match length
+		starts := []int{0}
+		known := totalRounds > 0
+		for _, sub := range chain {
+			start := sub.Round - 1
+			if sub.Round <= 0 || start <= starts[len(starts)-1] || start >= totalRounds {
+				known = false
+			}
+			starts = append(starts, start)
+		}
+		starts = append(starts, totalRounds)
+
+		playerIDs := []string{chain[0].OutPlayerID}
+		for _, sub := range chain {
+			playerIDs = append(playerIDs, sub.InPlayerID)
+		}
+		for i, playerID := range playerIDs {
+			if known {
+				shares[playerID] = float64(starts[i+1]-starts[i]) / float64(totalRounds)
+			} else {
+				shares[playerID] = 1 / float64(len(playerIDs))
+			}
+		}
+	}
+	return shares
+}
+
+// rateWithSubstitutions rates the match with rs. A player who was subbed out
+// is rated as if they had played in their replacement's place, and the rating
+// changes of everyone who filled a slot are scaled by their share of the match.
+func rateWithSubstitutions(match *Match, rs RatingSystem) []RatingChange {
+	changes := rs.RateMatch(match)
+	if len(match.Substitutions) == 0 {
+		return changes
+	}
+
+	for _, chain := range match.substitutionChains() {
+		replacementID := chain[len(chain)-1].InPlayerID
+		for _, sub := range chain {
+			player := match.Substituted[sub.OutPlayerID]
+			rated := *match
+			rated.Winner = withPlayerInstead(match.Winner, replacementID, player)
+			rated.Loser = withPlayerInstead(match.Loser, replacementID, player)
+			for _, change := range rs.RateMatch(&rated) {
+				if change.PlayerID == player.PlayerID {
+					changes = append(changes, change)
+				}
+			}
+		}
+	}
+
+	shares := match.playShares(match.TotalRounds())
+	players := make(map[string]*Player)
+	for _, player := range match.players() {
+		players[player.PlayerID] = player
+	}
+	for i, change := range changes {
+		if share, ok := shares[change.PlayerID]; ok {
+			changes[i] = scaleRatingChange(change, players[change.PlayerID], share)
+		}
+	}
+	return changes
+}
+
+// withPlayerInstead returns team with player in place of the given player ID
+func withPlayerInstead(team *Team, playerID string, player *Player) *Team {
+	replaced := &Team{Name: team.Name}
+	for _, p := range team.Players {
+		if p.PlayerID == playerID {
+			p = player
+		}
+		replaced.Players = append(replaced.Players, p)
+	}
+	return replaced
+}
+
+// Command to swap a player of a lobby for another, e.g. after a disconnect:
+// `!sub @out @in [round N] [lobby]`. During a live match the swap is recorded
+// so both players share the rating change of the result.
+func substituteCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB, discordInstance *Discord) {
+	usage := "Usage: `!sub @out @in`, optionally followed by `round N` when the new player came in."
+	if len(args) < 3 {
+		s.ChannelMessageSend(m.ChannelID, usage)
+		return
+	}
+	outID, ok1 := parseUserMention(args[1])
+	inID, ok2 := parseUserMention(args[2])
+	if !ok1 || !ok2 || outID == inID {
+		s.ChannelMessageSend(m.ChannelID, usage)
+		return
+	}
+
+	round := 0
+	var lobbyArgs []string
+	for i := 3; i < len(args); i++ {
+		if strings.ToLower(args[i]) == "round" && i+1 < len(args) {
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				s.ChannelMessageSend(m.ChannelID, "The round must be a positive number.")
+				return
+			}
+			round = n
+			i++
+			continue
+		}
+		lobbyArgs = append(lobbyArgs, args[i])
+	}
+
+	ts := NewTeamStorage(db, 48*time.Hour)
+	lobby, err := findLobbyForCommand(s, m, lobbyArgs, ts)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v. Please run `!teams` to form new teams.", err))
+		return
+	}
+	match, err := db.GetMatch(lobby.MatchID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading match %d: %v", lobby.MatchID, err))
+		return
+	}
+	if match.Status != MatchStatusCreated && match.Status != MatchStatusLive {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Match %d is %s, players can only be swapped before a result is reported.", match.MatchID, match.Status))
+		return
+	}
+	if isPlayerInTeam(lobby.Team1, inID) || isPlayerInTeam(lobby.Team2, inID) || match.Substituted[inID] != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("<@%s> already played in this match.", inID))
+		return
+	}
+	if !isPlayerInTeam(lobby.Team1, outID) && !isPlayerInTeam(lobby.Team2, outID) {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("<@%s> is not playing in lobby %d.", outID, lobby.LobbyID))
+		return
+	}
+
+	players, err := loadPlayers(db, discordInstance, m.GuildID, []string{inID})
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	lobby.Team1 = withPlayerInstead(lobby.Team1, outID, players[0])
+	lobby.Team2 = withPlayerInstead(lobby.Team2, outID, players[0])
+
+	// Before the match starts this only changes the lineup
+	if match.Status == MatchStatusCreated {
+		if err := db.UpdateLineup(lobby); err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error storing teams: %v", err))
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s replaces <@%s> in lobby %d.\nTeam 1: %s\nTeam 2: %s",
+			players[0].PlayerName, outID, lobby.LobbyID, getTeamNames(lobby.Team1), getTeamNames(lobby.Team2)))
+		return
+	}
+
+	sub := Substitution{OutPlayerID: outID, InPlayerID: inID, Round: round, Timestamp: time.Now()}
+	if err := db.RecordSubstitution(lobby, sub); err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error recording substitution: %v", err))
+		return
+	}
+	when := ""
+	if round > 0 {
+		when = fmt.Sprintf(" at round %d", round)
+	}
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s subs in for <@%s>%s in match %d; both share the rating change of the result, by rounds played when the round and score are known.\nTeam 1: %s\nTeam 2: %s",
+		players[0].PlayerName, outID, when, match.MatchID, getTeamNames(lobby.Team1), getTeamNames(lobby.Team2)))
+}
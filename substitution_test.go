@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSubstitutionSharesRating(t *testing.T) {
+	db := newTestDB(t)
+	ts := NewTeamStorage(db, time.Hour)
+	lobby := storeTestLobby(t, ts, testGuildID, "text", "voice", []string{"a", "b"}, []string{"c", "d"})
+	sub := NewPlayer(testGuildID, "e", "e")
+	if err := db.SavePlayer(sub); err != nil {
+		t.Fatalf("Error saving player: %v", err)
+	}
+
+	// b disconnects during the live match and e takes over
+	if err := db.TransitionMatch(lobby.MatchID, MatchStatusLive); err != nil {
+		t.Fatalf("Error starting match: %v", err)
+	}
+	lobby.Team1 = withPlayerInstead(lobby.Team1, "b", sub)
+	if err := db.RecordSubstitution(lobby, Substitution{OutPlayerID: "b", InPlayerID: "e", Round: 7, Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Error recording substitution: %v", err)
+	}
+	if stored, _ := ts.GetLobby(lobby.LobbyID); stored.Team1.GetPlayerIDs() != "a,e" {
+		t.Fatalf("expected the lobby to hold the new lineup, got %s", stored.Team1.GetPlayerIDs())
+	}
+
+	if err := db.ReportMatchResult(lobby.MatchID, 1); err != nil {
+		t.Fatalf("Error reporting result: %v", err)
+	}
+	if _, err := ForceConfirmMatch(db, lobby.MatchID); err != nil {
+		t.Fatalf("Error confirming match: %v", err)
+	}
+
+	// Without the match length both players of the slot get half the change
+	a, _ := db.GetPlayer(testGuildID, "a")
+	b, _ := db.GetPlayer(testGuildID, "b")
+	e, _ := db.GetPlayer(testGuildID, "e")
+	full := a.MMR - defaultMMR
+	if full <= 0 {
+		t.Fatalf("expected the winner a to gain MMR, got %d", full)
+	}
+	for _, player := range []*Player{b, e} {
+		if player.MMR-defaultMMR != (full+1)/2 && player.MMR-defaultMMR != full/2 {
+			t.Errorf("expected %s to gain about %d, got %d", player.PlayerID, full/2, player.MMR-defaultMMR)
+		}
+		if player.GamesPlayed != 1 || player.Wins != 1 {
+			t.Errorf("expected %s to be credited with the win, got %+v", player.PlayerID, player)
+		}
+	}
+
+	// Voiding takes the win back from both
+	if _, err := VoidMatch(db, lobby.MatchID, testGuildID); err != nil {
+		t.Fatalf("Error voiding match: %v", err)
+	}
+	b, _ = db.GetPlayer(testGuildID, "b")
+	if b.MMR != defaultMMR || b.Wins != 0 || b.GamesPlayed != 0 {
+		t.Fatalf("expected b to be reset by the void, got %+v", b)
+	}
+}
+
+func TestPlayShares(t *testing.T) {
+	match := &Match{Substitutions: []Substitution{
+		{OutPlayerID: "a", InPlayerID: "b", Round: 6},
+		{OutPlayerID: "c", InPlayerID: "d"},
+		{OutPlayerID: "b", InPlayerID: "e", Round: 16},
+	}}
+
+	// a played rounds 1-5, b 6-15 and e 16-20; the round of d is unknown
+	shares := match.playShares(20)
+	expected := map[string]float64{"a": 0.25, "b": 0.5, "e": 0.25, "c": 0.5, "d": 0.5}
+	for playerID, share := range expected {
+		if shares[playerID] != share {
+			t.Errorf("expected %s to get %.2f, got %.2f", playerID, share, shares[playerID])
+		}
+	}
+
+	// Without the match length every player of a slot gets an equal share
+	shares = match.playShares(0)
+	if shares["a"] != 1.0/3 || shares["c"] != 0.5 {
+		t.Fatalf("expected equal shares, got %v", shares)
+	}
+}
+
+func TestSubstitutionSharesByScore(t *testing.T) {
+	// b played rounds 1-4 of a 13-3 win before e took over
+	match := newTestMatch([]int{1000, 1000}, []int{1000, 1000})
+	b := match.Winner.Players[1]
+	e := &Player{PlayerID: "e", MMR: 1000, GamesPlayed: 20, Kills: 20, Deaths: 20}
+	match.Winner.Players[1] = e
+	match.Substitutions = []Substitution{{OutPlayerID: "b", InPlayerID: "e", Round: 5}}
+	match.Substituted = map[string]*Player{"b": b}
+	match.WinnerScore, match.LoserScore = 13, 3
+
+	deltas := make(map[string]int)
+	for _, change := range rateWithSubstitutions(match, &EloRatingSystem{}) {
+		deltas[change.PlayerID] = change.MMRDelta
+	}
+	full := deltas["a"]
+	if deltas["b"] != int(math.Round(float64(full)/4)) || deltas["e"] != int(math.Round(float64(full)*3/4)) {
+		t.Fatalf("expected b and e to split %d by a quarter and three quarters, got %d and %d", full, deltas["b"], deltas["e"])
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+)
+
+// PairRecord is how two players did as teammates and as opponents
+type PairRecord struct {
+	GamesTogether int
+	WinsTogether  int
+	GamesAgainst  int
+	// WinsAgainst counts the games the first player of the pair won against the second
+	WinsAgainst int
+}
+
+// SynergyMatrix holds the record of every pair of players, by player ID
+type SynergyMatrix map[string]map[string]*PairRecord
+
+// BuildSynergyMatrix collects pairwise records from finished matches
+func BuildSynergyMatrix(records []*MatchRecord) SynergyMatrix {
+	m := make(SynergyMatrix)
+	for _, record := range records {
+		// A draw has no winning pairing to learn from
+		if record.Draw {
+			continue
+		}
+		for t, team := range [][]string{record.Winner, record.Loser} {
+			won := t == 0
+			for _, a := range team {
+				for _, b := range team {
+					if a == b {
+						continue
+					}
+					pair := m.record(a, b)
+					pair.GamesTogether++
+					if won {
+						pair.WinsTogether++
+					}
+				}
+			}
+		}
+		for _, winner := range record.Winner {
+			for _, loser := range record.Loser {
+				pair := m.record(winner, loser)
+				pair.GamesAgainst++
+				pair.WinsAgainst++
+				m.record(loser, winner).GamesAgainst++
+			}
+		}
+	}
+	return m
+}
+
+func (m SynergyMatrix) record(a, b string) *PairRecord {
+	if m[a] == nil {
+		m[a] = make(map[string]*PairRecord)
+	}
+	if m[a][b] == nil {
+		m[a][b] = &PairRecord{}
+	}
+	return m[a][b]
+}
+
+// Pair returns the record of a with b
+func (m SynergyMatrix) Pair(a, b string) PairRecord {
+	if record := m[a][b]; record != nil {
+		return *record
+	}
+	return PairRecord{}
+}
+
+// Synergy is how much better than even two players do as teammates, from
+// -0.5 to 0.5. The win rate is smoothed towards 50% so a couple of lucky
+// games do not make a duo look strong.
+func (m SynergyMatrix) Synergy(a, b string) float64 {
+	pair := m.Pair(a, b)
+	return (float64(pair.WinsTogether)+synergyPriorGames/2)/(float64(pair.GamesTogether)+synergyPriorGames) - 0.5
+}
+
+// Imaginary even games every pair starts with when judging their synergy
+const synergyPriorGames = 4
+
+// stackedSynergy is the share of the lobby's synergy that the split keeps on
+// the same team, from 0 (every pair that does better than even together is
+// split up) to 1 (all of them are teammates). Each pair counts by how much
+// better than even it does, so one strong duo is not watered down by the
+// other pairs of a large team.
+func (b *balancer) stackedSynergy(inTeam1 []bool) float64 {
+	var stacked, total float64
+	for i := range inTeam1 {
+		for j := i + 1; j < len(inTeam1); j++ {
+			if b.synergy[i][j] <= 0 {
+				continue
+			}
+			total += b.synergy[i][j]
+			if inTeam1[i] == inTeam1[j] {
+				stacked += b.synergy[i][j]
+			}
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return stacked / total
+}
+
+// Command to show how two players do together and against each other
+func synergyCommand(s *discordgo.Session, m *discordgo.MessageCreate, args []string, db *DB) {
+	if len(args) < 3 {
+		s.ChannelMessageSend(m.ChannelID, "Please mention two players, e.g. `!synergy @a @b`.")
+		return
+	}
+	playerIDs := make([]string, 2)
+	for i := range playerIDs {
+		userID, ok := parseUserMention(args[i+1])
+		if !ok {
+			s.ChannelMessageSend(m.ChannelID, "Invalid user mention. Please mention a user like @username.")
+			return
+		}
+		playerIDs[i] = userID
+	}
+
+	var names []string
+	for _, playerID := range playerIDs {
+		player, err := db.GetPlayer(m.GuildID, playerID)
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Player <@%s> has not played on this server yet.", playerID))
+			return
+		}
+		names = append(names, player.PlayerName)
+	}
+
+	records, err := db.GetMatchRecords(m.GuildID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error loading matches: %v", err))
+		return
+	}
+	matrix := BuildSynergyMatrix(records)
+	pair := matrix.Pair(playerIDs[0], playerIDs[1])
+
+	together := "No games together"
+	if pair.GamesTogether > 0 {
+		together = fmt.Sprintf("%d wins in %d games (%.0f%%)", pair.WinsTogether, pair.GamesTogether, 100*float64(pair.WinsTogether)/float64(pair.GamesTogether))
+	}
+	against := "No games against each other"
+	if pair.GamesAgainst > 0 {
+		against = fmt.Sprintf("%s %d - %d %s", names[0], pair.WinsAgainst, pair.GamesAgainst-pair.WinsAgainst, names[1])
+	}
+
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Title: fmt.Sprintf("%s & %s", names[0], names[1]),
+		Color: 0x00ff00,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Together", Value: together},
+			{Name: "Against each other", Value: against},
+			{Name: "Synergy", Value: fmt.Sprintf("%+.0f%%", 100*matrix.Synergy(playerIDs[0], playerIDs[1]))},
+		},
+	})
+}
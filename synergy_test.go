@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSynergyMatrix(t *testing.T) {
+	records := []*MatchRecord{
+		{Winner: []string{"a", "b"}, Loser: []string{"c", "d"}},
+		{Winner: []string{"a", "b"}, Loser: []string{"c", "d"}},
+		{Winner: []string{"a", "c"}, Loser: []string{"b", "d"}},
+	}
+	matrix := BuildSynergyMatrix(records)
+
+	ab := matrix.Pair("a", "b")
+	if ab.GamesTogether != 2 || ab.WinsTogether != 2 || ab.GamesAgainst != 1 || ab.WinsAgainst != 1 {
+		t.Fatalf("unexpected record for a with b: %+v", ab)
+	}
+	if ba := matrix.Pair("b", "a"); ba.WinsAgainst != 0 || ba.GamesTogether != 2 {
+		t.Fatalf("unexpected record for b with a: %+v", ba)
+	}
+	if matrix.Synergy("a", "b") <= 0 || matrix.Synergy("c", "d") >= 0 {
+		t.Fatalf("expected a+b to have positive and c+d negative synergy, got %f and %f", matrix.Synergy("a", "b"), matrix.Synergy("c", "d"))
+	}
+	if matrix.Synergy("a", "z") != 0 {
+		t.Fatalf("expected no synergy for players who never played together")
+	}
+
+	// With equal ratings the balancer should split up the winning duo
+	var records2 []*MatchRecord
+	for i := 0; i < 10; i++ {
+		records2 = append(records2, &MatchRecord{Winner: []string{"a", "b"}, Loser: []string{"c", "d"}})
+	}
+	var players []*Player
+	for _, playerID := range []string{"a", "b", "c", "d", "e", "f"} {
+		players = append(players, &Player{PlayerID: playerID, PlayerName: playerID, MMR: 1000})
+	}
+	opts := BalanceOptions{Synergy: BuildSynergyMatrix(records2), SynergyWeight: 0.2}
+	for i := 0; i < 10; i++ {
+		split, err := BalanceTeams(players, &EloRatingSystem{}, opts)
+		if err != nil {
+			t.Fatalf("Error balancing teams: %v", err)
+		}
+		team := split.Team1.GetPlayerIDs()
+		if strings.Contains(team, "a") == strings.Contains(team, "b") {
+			t.Fatalf("expected a and b on different teams, got %s vs %s", split.Team1.GetPlayerIDs(), split.Team2.GetPlayerIDs())
+		}
+	}
+}
+
+func TestSynergyPenaltyIsBounded(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	var records []*MatchRecord
+	for i := 0; i < 10; i++ {
+		records = append(records, &MatchRecord{Winner: ids, Loser: []string{"x"}})
+	}
+	players := getTestPlayers(ids)
+	opts := BalanceOptions{Apart: [][]string{{"a", "b"}}, Synergy: BuildSynergyMatrix(records), SynergyWeight: 1, VarietyWeight: 1}
+	b, err := newBalancer(players, &EloRatingSystem{}, opts)
+	if err != nil {
+		t.Fatalf("Error creating balancer: %v", err)
+	}
+
+	// Even with every pair stacked the penalty stays within its weight, so a
+	// broken constraint always costs more than any valid split
+	allTogether := make([]bool, len(players))
+	for i := range allTogether {
+		allTogether[i] = true
+	}
+	if stacked := b.stackedSynergy(allTogether); stacked < 0.99 || stacked > 1 {
+		t.Fatalf("expected the whole lobby on one team to stack all synergy, got %f", stacked)
+	}
+	if b.violationCost() <= 0.5+opts.SynergyWeight+opts.VarietyWeight {
+		t.Fatalf("expected a broken constraint to outweigh every penalty, got %f", b.violationCost())
+	}
+}
+
+func TestSynergySplitsDuoInFullLobby(t *testing.T) {
+	var records []*MatchRecord
+	for i := 0; i < 10; i++ {
+		records = append(records, &MatchRecord{Winner: []string{"a", "b"}, Loser: []string{"x", "y"}})
+	}
+
+	// Only teams with a and b together are perfectly even, yet the strong duo
+	// should be split up at the cost of a slightly uneven 5v5
+	var players []*Player
+	for _, playerID := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		players = append(players, &Player{PlayerID: playerID, PlayerName: playerID, MMR: 1000})
+	}
+	players[0].MMR, players[1].MMR, players[2].MMR = 1100, 1100, 1200
+	opts := BalanceOptions{Synergy: BuildSynergyMatrix(records), SynergyWeight: 0.2}
+	split, err := BalanceTeams(players, &EloRatingSystem{}, opts)
+	if err != nil {
+		t.Fatalf("Error balancing teams: %v", err)
+	}
+	team := split.Team1.GetPlayerIDs()
+	if strings.Contains(team, "a") == strings.Contains(team, "b") {
+		t.Fatalf("expected a and b on different teams, got %s vs %s", split.Team1.GetPlayerIDs(), split.Team2.GetPlayerIDs())
+	}
+}
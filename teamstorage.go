@@ -3,6 +3,8 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -18,47 +20,121 @@ func NewTeamStorage(db *DB, expirationDuration time.Duration) *TeamStorage {
 	}
 }
 
-// Store teams temporarily in the database
-func (ts *TeamStorage) StoreTeams(team1, team2 *Team) error {
-	return ts.db.StoreTeams(team1, team2)
+// Lobby is a pair of stored teams playing in a guild's text and voice channel.
+// Several lobbies can run at the same time; each one tracks its own match.
+type Lobby struct {
+	LobbyID        int
+	GuildID        string
+	ChannelID      string
+	VoiceChannelID string
+	Team1          *Team
+	Team2          *Team
+	MatchID        int
 }
 
-// Retrieve stored teams from the database with expiration logic
-func (ts *TeamStorage) GetStoredTeams() (*Team, *Team, error) {
-	team1IDs, team2IDs, timestamp, err := ts.db.GetStoredTeams()
+// Store a lobby's teams temporarily in the database, along with the match they are playing
+func (ts *TeamStorage) StoreTeams(lobby *Lobby) error {
+	if err := ts.db.StoreLobby(lobby); err != nil {
+		return err
+	}
+	return ts.db.SetLobbyMatch(lobby.LobbyID, lobby.MatchID)
+}
+
+// Retrieve a lobby by ID with expiration logic
+func (ts *TeamStorage) GetLobby(lobbyID int) (*Lobby, error) {
+	stored, err := ts.db.GetLobby(lobbyID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil, errors.New("no stored teams found")
+			return nil, fmt.Errorf("lobby %d not found", lobbyID)
+		}
+		return nil, err
+	}
+	return ts.loadLobby(stored)
+}
+
+// FindLobby resolves the lobby a command refers to: the lobby of the caller's
+// voice channel, otherwise the only lobby started from the text channel
+func (ts *TeamStorage) FindLobby(guildID, channelID, voiceChannelID string) (*Lobby, error) {
+	stored, err := ts.db.GetLobbies(guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	var inChannel []*StoredLobby
+	for _, lobby := range stored {
+		if voiceChannelID != "" && lobby.VoiceChannelID == voiceChannelID {
+			return ts.loadLobby(lobby)
+		}
+		if lobby.ChannelID == channelID {
+			inChannel = append(inChannel, lobby)
+		}
+	}
+
+	switch len(inChannel) {
+	case 0:
+		return nil, errors.New("no stored teams found")
+	case 1:
+		return ts.loadLobby(inChannel[0])
+	default:
+		var ids []string
+		for _, lobby := range inChannel {
+			ids = append(ids, fmt.Sprintf("%d", lobby.LobbyID))
+		}
+		return nil, fmt.Errorf("several lobbies are running here (%s), join the lobby's voice channel or give its ID", strings.Join(ids, ", "))
+	}
+}
+
+// Retrieve every active lobby of a guild
+func (ts *TeamStorage) GetLobbies(guildID string) ([]*Lobby, error) {
+	stored, err := ts.db.GetLobbies(guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	var lobbies []*Lobby
+	for _, s := range stored {
+		lobby, err := ts.loadLobby(s)
+		if err != nil {
+			continue
 		}
-		return nil, nil, err
+		lobbies = append(lobbies, lobby)
 	}
+	return lobbies, nil
+}
 
+// Convert a stored lobby into teams, clearing it if it has expired
+func (ts *TeamStorage) loadLobby(stored *StoredLobby) (*Lobby, error) {
 	// Check expiration
-	if time.Since(timestamp) > ts.expirationDuration {
-		err := ts.db.ClearStoredTeams()
+	if time.Since(stored.Timestamp) > ts.expirationDuration {
+		err := ts.db.DeleteLobby(stored.LobbyID)
 		if err != nil {
-			return nil, nil, errors.New("failed to clear expired teams")
+			return nil, errors.New("failed to clear expired teams")
 		}
-		return nil, nil, errors.New("stored teams have expired")
+		return nil, errors.New("stored teams have expired")
 	}
 
 	// Convert player IDs into player objects
-	team1Players, err := getPlayersFromIDs(team1IDs, ts.db)
+	team1Players, err := getPlayersFromIDs(stored.GuildID, stored.Team1IDs, ts.db)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	team2Players, err := getPlayersFromIDs(team2IDs, ts.db)
+	team2Players, err := getPlayersFromIDs(stored.GuildID, stored.Team2IDs, ts.db)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	team1 := &Team{Name: "Team 1", Players: team1Players}
-	team2 := &Team{Name: "Team 2", Players: team2Players}
-
-	return team1, team2, nil
+	return &Lobby{
+		LobbyID:        stored.LobbyID,
+		GuildID:        stored.GuildID,
+		ChannelID:      stored.ChannelID,
+		VoiceChannelID: stored.VoiceChannelID,
+		Team1:          &Team{Name: "Team 1", Players: team1Players},
+		Team2:          &Team{Name: "Team 2", Players: team2Players},
+		MatchID:        stored.MatchID,
+	}, nil
 }
 
-// Clear stored teams
-func (ts *TeamStorage) ClearStoredTeams() error {
-	return ts.db.ClearStoredTeams()
+// Clear a lobby's stored teams
+func (ts *TeamStorage) ClearLobby(lobbyID int) error {
+	return ts.db.DeleteLobby(lobbyID)
 }
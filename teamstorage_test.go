@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func storeTestLobby(t *testing.T, ts *TeamStorage, guildID, channelID, voiceChannelID string, team1IDs, team2IDs []string) *Lobby {
+	getTeam := func(playerIDs []string) *Team {
+		team := &Team{}
+		for _, playerID := range playerIDs {
+			player := NewPlayer(guildID, playerID, playerID)
+			if err := ts.db.SavePlayer(player); err != nil {
+				t.Fatalf("Error saving player: %v", err)
+			}
+			team.Players = append(team.Players, player)
+		}
+		return team
+	}
+
+	lobby := &Lobby{GuildID: guildID, ChannelID: channelID, VoiceChannelID: voiceChannelID, Team1: getTeam(team1IDs), Team2: getTeam(team2IDs)}
+	matchID, err := ts.db.CreateMatch(guildID, lobby.Team1, lobby.Team2, channelID)
+	if err != nil {
+		t.Fatalf("Error creating match: %v", err)
+	}
+	lobby.MatchID = matchID
+	if err := ts.StoreTeams(lobby); err != nil {
+		t.Fatalf("Error storing lobby: %v", err)
+	}
+	return lobby
+}
+
+func TestConcurrentLobbies(t *testing.T) {
+	ts := NewTeamStorage(newTestDB(t), time.Hour)
+	alpha := storeTestLobby(t, ts, "guild", "text", "voice-a", []string{"a"}, []string{"b"})
+	bravo := storeTestLobby(t, ts, "guild", "text", "voice-b", []string{"c"}, []string{"d"})
+
+	// Each voice channel resolves to its own lobby
+	lobby, err := ts.FindLobby("guild", "text", "voice-b")
+	if err != nil || lobby.LobbyID != bravo.LobbyID || lobby.Team1.GetPlayerIDs() != "c" {
+		t.Fatalf("expected lobby %d for voice-b, got %+v (%v)", bravo.LobbyID, lobby, err)
+	}
+	lobby, err = ts.FindLobby("guild", "text", "voice-a")
+	if err != nil || lobby.LobbyID != alpha.LobbyID {
+		t.Fatalf("expected lobby %d for voice-a, got %+v (%v)", alpha.LobbyID, lobby, err)
+	}
+
+	// Without a voice channel two lobbies in one text channel are ambiguous
+	if _, err := ts.FindLobby("guild", "text", ""); err == nil {
+		t.Fatalf("expected an error for ambiguous lobbies")
+	}
+
+	// Re-forming teams in the same voice channel replaces that lobby only
+	replaced := storeTestLobby(t, ts, "guild", "text", "voice-a", []string{"e"}, []string{"f"})
+	if replaced.LobbyID != alpha.LobbyID {
+		t.Fatalf("expected lobby %d to be reused, got %d", alpha.LobbyID, replaced.LobbyID)
+	}
+	lobbies, _ := ts.GetLobbies("guild")
+	if len(lobbies) != 2 {
+		t.Fatalf("expected 2 lobbies, got %d", len(lobbies))
+	}
+
+	// Lobbies of other guilds are not visible
+	if lobbies, _ := ts.GetLobbies("other"); len(lobbies) != 0 {
+		t.Fatalf("expected no lobbies in another guild")
+	}
+}
+
+func TestQueueLobbies(t *testing.T) {
+	ts := NewTeamStorage(newTestDB(t), time.Hour)
+	first := storeTestLobby(t, ts, "guild", "text", "", []string{"a"}, []string{"b"})
+	second := storeTestLobby(t, ts, "guild", "text", "", []string{"c"}, []string{"d"})
+
+	// A second queue game in the same text channel keeps the first one's match
+	if second.LobbyID == first.LobbyID {
+		t.Fatalf("expected each queue game to get its own lobby, got %d twice", first.LobbyID)
+	}
+	lobby, err := ts.GetLobby(first.LobbyID)
+	if err != nil || lobby.MatchID != first.MatchID {
+		t.Fatalf("expected lobby %d to keep match %d, got %+v (%v)", first.LobbyID, first.MatchID, lobby, err)
+	}
+
+	// Lobbies of settled matches make way for the next game
+	if err := ts.db.TransitionMatch(first.MatchID, MatchStatusVoided); err != nil {
+		t.Fatalf("Error voiding match: %v", err)
+	}
+	storeTestLobby(t, ts, "guild", "text", "", []string{"e"}, []string{"f"})
+	if _, err := ts.GetLobby(first.LobbyID); err == nil {
+		t.Fatalf("expected the lobby of the voided match to be dropped")
+	}
+	if lobbies, _ := ts.GetLobbies("guild"); len(lobbies) != 2 {
+		t.Fatalf("expected 2 lobbies, got %d", len(lobbies))
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of team splits !teams proposes for a vote
+const teamProposalCount = 3
+
+// TeamVote is a running vote between proposed team splits
+type TeamVote struct {
+	ID             int
+	GuildID        string
+	ChannelID      string
+	VoiceChannelID string
+	MessageID      string
+	Proposals      []*TeamSplit
+	// Voters is how many players are in the lobby; a majority of them decides early
+	Voters int
+	// Votes maps each voter to the index of the proposal they picked
+	Votes    map[string]int
+	Deadline time.Time
+	// Bench holds the players sitting out, recorded once the lobby is formed
+	Bench        []string
+	SessionStart time.Time
+}
+
+// teamVotes holds the votes that are still open, by ID
+var teamVotes = struct {
+	sync.Mutex
+	nextID int
+	votes  map[int]*TeamVote
+}{votes: make(map[int]*TeamVote)}
+
+// Post the proposals with a button per split and close the vote after the timeout
+func startTeamVote(s *discordgo.Session, db *DB, vote *TeamVote, timeout time.Duration) {
+	teamVotes.Lock()
+	teamVotes.nextID++
+	vote.ID = teamVotes.nextID
+	vote.Votes = make(map[string]int)
+	vote.Deadline = time.Now().Add(timeout)
+	teamVotes.votes[vote.ID] = vote
+	embed, components := vote.embed(), vote.components(false)
+	teamVotes.Unlock()
+
+	message, err := s.ChannelMessageSendComplex(vote.ChannelID, &discordgo.MessageSend{
+		Embeds:     []*discordgo.MessageEmbed{embed},
+		Components: components,
+	})
+	if err != nil {
+		log.Printf("Error posting team proposals: %v", err)
+		teamVotes.Lock()
+		delete(teamVotes.votes, vote.ID)
+		teamVotes.Unlock()
+		return
+	}
+
+	teamVotes.Lock()
+	vote.MessageID = message.ID
+	teamVotes.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		finishTeamVote(s, db, vote.ID)
+	})
+}
+
+// canVote reports whether the user plays in the proposed teams. Only they
+// count towards Voters, so benched players and spectators cannot vote.
+func (v *TeamVote) canVote(userID string) bool {
+	split := v.Proposals[0]
+	return isPlayerInTeam(split.Team1, userID) || isPlayerInTeam(split.Team2, userID)
+}
+
+// castVote records a player's pick and reports whether a majority now agrees
+func (v *TeamVote) castVote(userID string, option int) bool {
+	v.Votes[userID] = option
+	return v.tally()[option]*2 > v.Voters
+}
+
+func (v *TeamVote) tally() []int {
+	counts := make([]int, len(v.Proposals))
+	for _, option := range v.Votes {
+		counts[option]++
+	}
+	return counts
+}
+
+// leader is the proposal with the most votes; ties go to the better balanced one
+func (v *TeamVote) leader() int {
+	counts := v.tally()
+	best := 0
+	for option, count := range counts {
+		if count > counts[best] {
+			best = option
+		}
+	}
+	return best
+}
+
+func (v *TeamVote) embed() *discordgo.MessageEmbed {
+	counts := v.tally()
+	embed := &discordgo.MessageEmbed{
+		Title:       "Vote for the teams",
+		Description: fmt.Sprintf("The players in the teams pick a split. Voting closes <t:%d:R>, or as soon as a majority agrees.", v.Deadline.Unix()),
+		Color:       0x00ff00,
+	}
+	for option, split := range v.Proposals {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  fmt.Sprintf("Option %d (%d vote(s))", option+1, counts[option]),
+			Value: describeSplit(split),
+		})
+	}
+	return embed
+}
+
+func (v *TeamVote) components(closed bool) []discordgo.MessageComponent {
+	var buttons []discordgo.MessageComponent
+	for option := range v.Proposals {
+		buttons = append(buttons, discordgo.Button{
+			Label:    fmt.Sprintf("Option %d", option+1),
+			CustomID: fmt.Sprintf("team_vote_%d_%d", v.ID, option),
+			Style:    discordgo.PrimaryButton,
+			Disabled: closed,
+		})
+	}
+	return []discordgo.MessageComponent{discordgo.ActionsRow{Components: buttons}}
+}
+
+// Handle a vote button on the proposed teams
+func handleTeamVote(s *discordgo.Session, i *discordgo.InteractionCreate, db *DB) {
+	parts := strings.Split(strings.TrimPrefix(i.MessageComponentData().CustomID, "team_vote_"), "_")
+	if len(parts) != 2 {
+		respondEphemeral(s, i.Interaction, "Invalid vote.")
+		return
+	}
+	voteID, err1 := strconv.Atoi(parts[0])
+	option, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		respondEphemeral(s, i.Interaction, "Invalid vote.")
+		return
+	}
+
+	teamVotes.Lock()
+	vote := teamVotes.votes[voteID]
+	if vote == nil || option < 0 || option >= len(vote.Proposals) {
+		teamVotes.Unlock()
+		respondEphemeral(s, i.Interaction, "This vote is closed.")
+		return
+	}
+	if !vote.canVote(i.Member.User.ID) {
+		teamVotes.Unlock()
+		respondEphemeral(s, i.Interaction, "Only players in the proposed teams can vote.")
+		return
+	}
+	majority := vote.castVote(i.Member.User.ID, option)
+	embed, components := vote.embed(), vote.components(false)
+	teamVotes.Unlock()
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Embeds:     []*discordgo.MessageEmbed{embed},
+			Components: components,
+		},
+	})
+
+	if majority {
+		finishTeamVote(s, db, voteID)
+	}
+}
+
+// Close a vote and store the winning split as the lobby's teams
+func finishTeamVote(s *discordgo.Session, db *DB, voteID int) {
+	teamVotes.Lock()
+	vote := teamVotes.votes[voteID]
+	if vote == nil {
+		// Already decided by a majority
+		teamVotes.Unlock()
+		return
+	}
+	delete(teamVotes.votes, voteID)
+	option := vote.leader()
+	votes := vote.tally()[option]
+	embed, components := vote.embed(), vote.components(true)
+	teamVotes.Unlock()
+
+	edit := discordgo.NewMessageEdit(vote.ChannelID, vote.MessageID).SetEmbed(embed)
+	edit.Components = &components
+	if _, err := s.ChannelMessageEditComplex(edit); err != nil {
+		log.Printf("Error closing team vote %d: %v", voteID, err)
+	}
+
+	split := vote.Proposals[option]
+	lobby, err := formLobby(db, vote.GuildID, vote.ChannelID, vote.VoiceChannelID, split)
+	if err != nil {
+		s.ChannelMessageSend(vote.ChannelID, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	recordRotation(db, lobby, vote.Bench, vote.SessionStart)
+	s.ChannelMessageSend(vote.ChannelID, fmt.Sprintf("Option %d won with %d vote(s).", option+1, votes))
+	announceLobby(s, vote.ChannelID, lobby, split)
+}
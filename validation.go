@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"log"
+	"math"
+	"strings"
+)
+
+// Rounds assumed for a match without a recorded score: a full match with overtime
+const maxUnscoredRounds = 30
+
+// Kills per round above which a player's stats are flagged for review
+const suspiciousKillsPerRound = 2.0
+
+// How far one team's kills may be off from the other team's deaths before the
+// stats are flagged, as a share of the deaths; suicides, team kills and the
+// bomb keep the two from matching exactly
+const statsTolerance = 0.15
+
+// statsRounds is the number of rounds stats are checked against
+func (m *Match) statsRounds() int {
+	if m.HasScore() {
+		return m.TotalRounds()
+	}
+	return maxUnscoredRounds
+}
+
+// opponents returns the players the given player played against
+func (m *Match) opponents(playerID string) []*Player {
+	winner, loser := m.lineup(m.Winner), m.lineup(m.Loser)
+	for _, player := range winner {
+		if player.PlayerID == playerID {
+			return loser
+		}
+	}
+	return winner
+}
+
+// checkStats rejects stats a player cannot have had in this match: negative
+// numbers, more kills or assists than opponents that could die, or more
+// deaths than rounds
+func (m *Match) checkStats(playerID string, stats PlayerStats) error {
+	if stats.Kills < 0 || stats.Assists < 0 || stats.Deaths < 0 {
+		return fmt.Errorf("stats cannot be negative")
+	}
+	rounds := m.statsRounds()
+	opponents := len(m.opponents(playerID))
+	if stats.Kills > rounds*opponents {
+		return fmt.Errorf("%d kills are not possible in %d rounds against %d players", stats.Kills, rounds, opponents)
+	}
+	if stats.Assists > rounds*opponents {
+		return fmt.Errorf("%d assists are not possible in %d rounds against %d players", stats.Assists, rounds, opponents)
+	}
+	if stats.Deaths > rounds {
+		return fmt.Errorf("%d deaths are not possible in %d rounds", stats.Deaths, rounds)
+	}
+	return checkExtendedStats(stats.Extra, rounds, opponents)
+}
+
+// statsWarnings lists what looks wrong with the stats reported for the match:
+// players with implausibly many kills, and teams whose kills are far off the
+// other team's deaths once both teams have reported
+func (m *Match) statsWarnings(performances map[string]PlayerStats) []string {
+	var warnings []string
+	rounds := m.statsRounds()
+	for _, player := range m.players() {
+		stats, ok := performances[player.PlayerID]
+		if ok && float64(stats.Kills) > suspiciousKillsPerRound*float64(rounds) {
+			warnings = append(warnings, fmt.Sprintf("<@%s> reported %d kills in %d rounds", player.PlayerID, stats.Kills, rounds))
+		}
+	}
+
+	teams := [][]*Player{m.lineup(m.Winner), m.lineup(m.Loser)}
+	totals := make([]PlayerStats, len(teams))
+	for t, team := range teams {
+		for _, player := range team {
+			stats, ok := performances[player.PlayerID]
+			if !ok {
+				return warnings
+			}
+			totals[t].Kills += stats.Kills
+			totals[t].Deaths += stats.Deaths
+		}
+	}
+	for t := range teams {
+		kills, deaths := totals[t].Kills, totals[1-t].Deaths
+		tolerance := math.Max(3, statsTolerance*float64(deaths))
+		if math.Abs(float64(kills-deaths)) > tolerance {
+			warnings = append(warnings, fmt.Sprintf("%s reported %d kills but %s %d deaths",
+				mentionPlayers(teams[t]), kills, mentionPlayers(teams[1-t]), deaths))
+		}
+	}
+	return warnings
+}
+
+// newWarnings returns the warnings that were not raised before a submission
+func newWarnings(before, after []string) []string {
+	var warnings []string
+	for _, warning := range after {
+		if !containsString(before, warning) {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
+
+// Post suspicious stats to the guild's review channel, or to the match's
+// channel when none is set, so admins can look into them. reported describes
+// the submission that raised the warnings.
+func flagStats(s *discordgo.Session, db *DB, match *Match, reported string, warnings []string) {
+	cfg, err := db.GetGuildConfig(match.GuildID)
+	if err != nil {
+		log.Printf("Error loading settings to flag stats of match %d: %v", match.MatchID, err)
+		return
+	}
+	channelID := cfg.ReviewChannelID
+	if channelID == "" {
+		channelID = match.ChannelID
+	}
+
+	_, err = s.ChannelMessageSendEmbed(channelID, &discordgo.MessageEmbed{
+		Title: fmt.Sprintf("Suspicious stats in match %d", match.MatchID),
+		Description: fmt.Sprintf("%s.\n%s\n\nThe match is not rated before the stats deadline so they can be corrected. "+
+			"Admins can check `!statslog %d`, then `!confirm %d` or `!void %d`.",
+			reported, strings.Join(warnings, "\n"), match.MatchID, match.MatchID, match.MatchID),
+		Color: 0xffa500,
+	})
+	if err != nil {
+		log.Printf("Error flagging stats of match %d: %v", match.MatchID, err)
+	}
+}
+
+// parseChannelMention extracts the channel ID from a channel mention or a bare ID
+func parseChannelMention(arg string) (string, bool) {
+	id := strings.TrimSuffix(strings.TrimPrefix(arg, "<#"), ">")
+	if id == "" || strings.Trim(id, "0123456789") != "" {
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestCheckStats(t *testing.T) {
+	match := newTestMatch([]int{1000, 1000}, []int{1000, 1000})
+	match.WinnerScore, match.LoserScore = 13, 7
+
+	tests := []struct {
+		stats PlayerStats
+		valid bool
+	}{
+		{PlayerStats{Kills: 25, Assists: 4, Deaths: 12}, true},
+		{PlayerStats{Kills: -5}, false},
+		{PlayerStats{Kills: 41}, false},
+		{PlayerStats{Assists: 9999}, false},
+		{PlayerStats{Deaths: 21}, false},
+	}
+	for _, test := range tests {
+		if err := match.checkStats("a", test.stats); (err == nil) != test.valid {
+			t.Errorf("checkStats(%+v) = %v, expected valid %t", test.stats, err, test.valid)
+		}
+	}
+
+	// Without a score the bounds allow a full match
+	match.WinnerScore, match.LoserScore = 0, 0
+	if err := match.checkStats("a", PlayerStats{Kills: 41, Deaths: 25}); err != nil {
+		t.Fatalf("expected stats of an unscored match to be accepted, got %v", err)
+	}
+}
+
+func TestStatsWarnings(t *testing.T) {
+	match := newTestMatch([]int{1000, 1000}, []int{1000, 1000})
+	match.WinnerScore, match.LoserScore = 13, 7
+	performances := map[string]PlayerStats{
+		"a": {Kills: 20, Deaths: 10},
+		"b": {Kills: 18, Deaths: 11},
+		"A": {Kills: 12, Deaths: 19},
+	}
+
+	// Nothing to compare until both teams have reported
+	if warnings := match.statsWarnings(performances); len(warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", warnings)
+	}
+	performances["B"] = PlayerStats{Kills: 9, Deaths: 20}
+	if warnings := match.statsWarnings(performances); len(warnings) != 0 {
+		t.Fatalf("expected consistent stats, got %v", warnings)
+	}
+
+	// One team's kills far off the other's deaths, and too many kills per round
+	performances["a"] = PlayerStats{Kills: 45, Deaths: 10}
+	warnings := match.statsWarnings(performances)
+	if len(warnings) != 2 {
+		t.Fatalf("expected two warnings, got %v", warnings)
+	}
+	if fresh := newWarnings(warnings[:1], warnings); len(fresh) != 1 || fresh[0] != warnings[1] {
+		t.Fatalf("expected only the new warning, got %v", fresh)
+	}
+}
+
+func TestFlaggedStatsWaitForDeadline(t *testing.T) {
+	db := newTestDB(t)
+	matchID := createTestMatch(t, db, []string{"a"}, []string{"b"})
+	db.ReportMatchResult(matchID, 1)
+	db.SetMatchScore(matchID, 13, 7)
+	// Stats that cannot be right are rejected outright
+	if err := db.ReportPerformance(matchID, "a", "a", PlayerStats{Kills: 30, Deaths: 5}); err == nil {
+		t.Fatalf("expected 30 kills in 20 rounds to be rejected")
+	}
+
+	// Possible but inconsistent stats are stored and flagged
+	for playerID, stats := range map[string]PlayerStats{"a": {Kills: 15, Deaths: 5}, "b": {Kills: 5, Deaths: 8}} {
+		if err := db.ReportPerformance(matchID, playerID, playerID, stats); err != nil {
+			t.Fatalf("Error reporting stats: %v", err)
+		}
+	}
+	match, _ := db.GetMatch(matchID)
+	performances, _ := db.GetRecordedPerformances(matchID)
+	if warnings := match.statsWarnings(performances); len(warnings) != 1 {
+		t.Fatalf("expected one warning, got %v", warnings)
+	}
+	if _, _, err := ConfirmMatchResult(db, matchID, "b"); err != nil {
+		t.Fatalf("Error confirming: %v", err)
+	}
+	if match, _ = db.GetMatch(matchID); match.Status != MatchStatusConfirmed {
+		t.Fatalf("expected flagged stats to hold the match, got %s", match.Status)
+	}
+
+	// Correcting the stats lets the match be rated
+	if err := db.ReportPerformance(matchID, "b", "b", PlayerStats{Kills: 5, Deaths: 15}); err != nil {
+		t.Fatalf("Error correcting stats: %v", err)
+	}
+	if finalized, err := settleMatch(db, matchID); err != nil || finalized == nil {
+		t.Fatalf("expected the corrected match to be rated, got %v, %v", finalized, err)
+	}
+}
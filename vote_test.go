@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestProposeSplitsAndVote(t *testing.T) {
+	players := getTestPlayers([]string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"})
+	splits, err := ProposeSplits(players, &EloRatingSystem{}, BalanceOptions{}, teamProposalCount)
+	if err != nil || len(splits) != teamProposalCount {
+		t.Fatalf("expected %d proposals, got %d (%v)", teamProposalCount, len(splits), err)
+	}
+
+	// Proposals are distinct splits, most balanced first
+	seen := make(map[string]bool)
+	for i, split := range splits {
+		team := split.Team1
+		if strings.Contains(split.Team2.GetPlayerIDs(), "a") {
+			team = split.Team2
+		}
+		var ids []string
+		for _, player := range team.Players {
+			ids = append(ids, player.PlayerID)
+		}
+		sort.Strings(ids)
+		key := strings.Join(ids, ",")
+		if seen[key] {
+			t.Fatalf("proposal %d repeats an earlier split: %s", i+1, key)
+		}
+		seen[key] = true
+		if i > 0 && split.Gap() < splits[i-1].Gap() {
+			t.Fatalf("proposal %d is better balanced than proposal %d", i+1, i)
+		}
+	}
+
+	vote := &TeamVote{Proposals: splits, Voters: 10, Votes: make(map[string]int)}
+	if vote.leader() != 0 {
+		t.Fatalf("without votes the best balanced proposal should lead")
+	}
+	if !vote.canVote(players[0].PlayerID) || vote.canVote("bench") {
+		t.Fatalf("expected only players in the proposed teams to be able to vote")
+	}
+	for i, userID := range []string{"a", "b", "c", "d", "e"} {
+		if vote.castVote(userID, 2) {
+			t.Fatalf("vote %d should not be a majority of 10", i+1)
+		}
+	}
+	vote.castVote("a", 1)
+	if vote.leader() != 2 {
+		t.Fatalf("expected option 3 to lead, got %d", vote.leader()+1)
+	}
+	if vote.castVote("f", 2) || !vote.castVote("a", 2) {
+		t.Fatalf("six of ten votes should be a majority, five should not")
+	}
+}